@@ -3,14 +3,16 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/mangudaigb/conversation-service/internal"
+	"github.com/mangudaigb/conversation-service/internal/auth"
+	"github.com/mangudaigb/conversation-service/internal/cluster"
 	consumer2 "github.com/mangudaigb/conversation-service/internal/consumer"
-	"github.com/mangudaigb/conversation-service/internal/repo"
-	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/conversation-service/internal/events"
+	"github.com/mangudaigb/conversation-service/internal/settings"
 	"github.com/mangudaigb/conversation-service/pkg"
 	"github.com/mangudaigb/dhauli-base/config"
-	"github.com/mangudaigb/dhauli-base/consumer"
 	"github.com/mangudaigb/dhauli-base/db"
 	"github.com/mangudaigb/dhauli-base/discover"
 	"github.com/mangudaigb/dhauli-base/logger"
@@ -31,6 +33,11 @@ func main() {
 		panic(err)
 	}
 
+	sts, err := settings.Load(cfg)
+	if err != nil {
+		log.Fatalf("Error reading service settings: %v", err)
+	}
+
 	tp := tracing.InitTracerProvider(cfg, log)
 	defer func() {
 		if err := tp.Shutdown(context.Background()); err != nil {
@@ -40,40 +47,65 @@ func main() {
 	tr := tp.Tracer("conversation-service")
 
 	registry := discover.NewRegistryInfo(cfg, log)
-	registry.Register(discover.SERVICE)
+	instance := registry.Register(discover.SERVICE)
 
-	StartConsumer(context.Background(), cfg, tr, log)
-
-	server := pkg.NewConversationServer(cfg, tr, log)
-	server.Start()
-}
+	zkClient, err := db.NewZkClient(cfg, log, time.Minute*time.Duration(cfg.Discovery.SessionTimeout))
+	if err != nil {
+		log.Fatalf("Error creating zookeeper client: %v", err)
+	}
+	defer zkClient.Close()
+	peers := cluster.NewPeers(cfg, log, zkClient, instance, sts.Cluster.Secret)
+	peers.Start()
+	defer peers.Close()
 
-func StartConsumer(ctx context.Context, cfg *config.Config, tr trace.Tracer, log *logger.Logger) {
 	mongoClient, err := db.NewMongoClient(cfg, log)
 	if err != nil {
 		log.Fatalf("Error creating mongo client: %v", err)
 	}
+	publisher := events.NewKafkaPublisher(cfg, log, sts.Events.Topic)
+	defer publisher.Close()
+	services := pkg.NewServices(cfg, sts, log, mongoClient, peers, publisher)
+	defer services.Close()
 
-	var interactionHistoryRepo = repo.NewInteractionHistoryRepository(cfg, log, *mongoClient.Client, "interactions_history")
-	var interactionRepo = repo.NewMongoInteractionRepository(cfg, log, *mongoClient.Client, "interactions")
-	var conversationRepo = repo.NewConversationRepository(cfg, log, *mongoClient.Client, "conversations")
-	var conversationSvc = svc.NewConversationService(log, conversationRepo)
-	var interactionHistorySvc = svc.NewInteractionHistoryService(log, interactionHistoryRepo)
-	var interactionSvc = svc.NewInteractionService(log, interactionRepo, interactionHistorySvc, conversationSvc)
-	var interactionMsgHandler = consumer2.NewInteractionMsgHandler(log, interactionSvc)
-	var conversationMsgHandler = consumer2.NewConversationMsgHandler(log, conversationSvc)
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	relayLeader := cluster.NewLeader(cfg, log, zkClient, instance, "outbox-relay")
+	go relayLeader.Run(relayCtx, services.Outbox.Relay)
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	sweeperLeader := cluster.NewLeader(cfg, log, zkClient, instance, "orphan-sweeper")
+	go sweeperLeader.Run(jobsCtx, services.Orphans.Run)
+	purgerLeader := cluster.NewLeader(cfg, log, zkClient, instance, "trash-purger")
+	go purgerLeader.Run(jobsCtx, services.Trash.Run)
+	retentionLeader := cluster.NewLeader(cfg, log, zkClient, instance, "retention")
+	go retentionLeader.Run(jobsCtx, services.Retention.Run)
 
-	var msgHandler = internal.NewMessageHandler(tr, log, interactionMsgHandler, conversationMsgHandler)
-
-	log.Infof("Starting kafka consumer")
-	csmr := consumer.NewKafkaConsumer(cfg, tr, log, msgHandler.HandlerFunc)
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	defer stopConsumer()
+	csmr := StartConsumer(consumerCtx, cfg, sts, tr, log, services)
 	defer csmr.Stop()
 
-	go func() {
-		err := csmr.Consume(context.Background())
-		if err != nil { // Should never happen
-			log.Errorf("Error running the consumer: %v", err)
-			return
+	deadLetters := consumer2.NewDeadLetterQueue(cfg, sts, log)
+	defer deadLetters.Close()
+
+	var verifier *auth.Verifier
+	if sts.Auth.Enabled {
+		if verifier, err = auth.NewVerifier(sts.Auth); err != nil {
+			log.Fatalf("Error loading token verification keys: %v", err)
 		}
-	}()
+	}
+	server := pkg.NewConversationServer(cfg, tr, log, services, deadLetters, verifier, sts.Auth, sts.Cluster.Secret)
+	server.Start()
+}
+
+func StartConsumer(ctx context.Context, cfg *config.Config, sts *settings.Settings, tr trace.Tracer, log *logger.Logger, services *pkg.Services) *consumer2.KafkaConsumer {
+	var interactionMsgHandler = consumer2.NewInteractionMsgHandler(log, services.Interaction, services.Stream, services.Conversation)
+	var conversationMsgHandler = consumer2.NewConversationMsgHandler(log, services.Conversation, services.Interaction)
+
+	var msgHandler = internal.NewMessageHandler(tr, log, interactionMsgHandler, conversationMsgHandler, services.Idempotency)
+
+	log.Infof("Starting kafka consumer")
+	csmr := consumer2.NewKafkaConsumer(cfg, sts, tr, log, msgHandler.HandlerFunc)
+	csmr.Start(ctx)
+	return csmr
 }
@@ -0,0 +1,132 @@
+// Package apperr classifies the failures of this service so every transport reports them the
+// same way: repos and services return an *Error of some Kind, handlers translate the Kind into
+// an HTTP status or a messaging error code.
+package apperr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type Kind string
+
+const (
+	Internal           Kind = "internal"
+	Validation         Kind = "validation"
+	Unauthorized       Kind = "unauthorized"
+	Forbidden          Kind = "forbidden"
+	NotFound           Kind = "not_found"
+	Conflict           Kind = "conflict"
+	PreconditionFailed Kind = "precondition_failed"
+	Unavailable        Kind = "unavailable"
+)
+
+// Error is a failure of a known kind. Message is safe to show to callers; Err keeps the cause
+// for logs and for errors.Is.
+type Error struct {
+	Kind    Kind
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(kind Kind, format string, args ...any) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrap classifies err, keeping it as the cause.
+func Wrap(kind Kind, err error, format string, args ...any) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+func NewNotFound(format string, args ...any) *Error {
+	return New(NotFound, format, args...)
+}
+
+func NewConflict(format string, args ...any) *Error {
+	return New(Conflict, format, args...)
+}
+
+func NewValidation(format string, args ...any) *Error {
+	return New(Validation, format, args...)
+}
+
+func NewForbidden(format string, args ...any) *Error {
+	return New(Forbidden, format, args...)
+}
+
+// KindOf tells the kind of err. Driver errors that were not classified where they happened are
+// recognised too, anything else is Internal.
+func KindOf(err error) Kind {
+	var e *Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &e):
+		return e.Kind
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return NotFound
+	case mongo.IsDuplicateKeyError(err):
+		return Conflict
+	case mongo.IsTimeout(err), mongo.IsNetworkError(err), errors.Is(err, context.DeadlineExceeded):
+		return Unavailable
+	default:
+		return Internal
+	}
+}
+
+// Status is the HTTP status for err. Messaging uses it as the ErrorData code as well.
+func Status(err error) int {
+	switch KindOf(err) {
+	case Validation:
+		return http.StatusBadRequest
+	case Unauthorized:
+		return http.StatusUnauthorized
+	case Forbidden:
+		return http.StatusForbidden
+	case NotFound:
+		return http.StatusNotFound
+	case Conflict:
+		return http.StatusConflict
+	case PreconditionFailed:
+		return http.StatusPreconditionFailed
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Retryable tells whether trying again, unchanged, may succeed.
+func Retryable(err error) bool {
+	switch KindOf(err) {
+	case Unavailable, Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// Detail is the description of err that may be shown to callers. Internal errors and driver
+// errors are not described, their cause only goes to the logs.
+func Detail(err error) string {
+	var e *Error
+	if KindOf(err) != Internal && errors.As(err, &e) {
+		return e.Message
+	}
+	return http.StatusText(Status(err))
+}
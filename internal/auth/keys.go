@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// Signing algorithms accepted for tokens.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	HS256 = "HS256"
+)
+
+// key verifies the signatures of one algorithm. A key without id verifies tokens naming any.
+type key struct {
+	id     string
+	alg    string
+	public crypto.PublicKey
+	secret []byte
+}
+
+// readPEMKeys reads the public keys and certificates of a PEM file.
+func readPEMKeys(path string) ([]key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []key
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var public crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				public = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		k, err := publicKey("", public)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no public key", path)
+	}
+	return keys, nil
+}
+
+func publicKey(id string, public crypto.PublicKey) (key, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return key{id: id, alg: RS256, public: pub}, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return key{}, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+		}
+		return key{id: id, alg: ES256, public: pub}, nil
+	default:
+		return key{}, fmt.Errorf("unsupported key type %T", public)
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// readJWKS reads the signing keys of a JSON Web Key Set file. Keys of other uses or algorithms are
+// skipped.
+func readJWKS(path string) ([]key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var keys []key
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		parsed, err := k.key()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", path, k.Kid, err)
+		}
+		if parsed.alg == "" || (k.Alg != "" && k.Alg != parsed.alg) {
+			continue
+		}
+		keys = append(keys, parsed)
+	}
+	return keys, nil
+}
+
+func (k jwk) key() (key, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return key{}, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return key{}, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return key{}, fmt.Errorf("invalid RSA exponent")
+		}
+		return publicKey(k.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())})
+	case "EC":
+		if k.Crv != "P-256" {
+			return key{}, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return key{}, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return key{}, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return key{}, fmt.Errorf("invalid P-256 coordinates")
+		}
+		// ecdh checks the point is on the curve
+		if _, err = ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return key{}, err
+		}
+		return publicKey(k.Kid, &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)})
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return key{}, err
+		}
+		// anyone could sign with an empty secret
+		if len(secret) == 0 {
+			return key{}, fmt.Errorf("empty oct key")
+		}
+		return key{id: k.Kid, alg: HS256, secret: secret}, nil
+	default:
+		return key{}, nil
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
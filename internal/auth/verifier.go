@@ -0,0 +1,225 @@
+// Package auth verifies the JSON Web Tokens the REST API is called with against locally
+// configured keys and maps their claims onto the principal of the request.
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+type Verifier struct {
+	keys     []key
+	issuer   string
+	audience string
+	leeway   time.Duration
+	claims   struct{ organization, tenant, group, name, scope string }
+	now      func() time.Time
+}
+
+func NewVerifier(cfg settings.Auth) (*Verifier, error) {
+	v := &Verifier{
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		leeway:   cfg.Leeway,
+		now:      time.Now,
+	}
+	v.claims.organization = cfg.Claims.Organization
+	v.claims.tenant = cfg.Claims.Tenant
+	v.claims.group = cfg.Claims.Group
+	v.claims.name = cfg.Claims.Name
+	v.claims.scope = cfg.Claims.Scope
+	if cfg.HMACSecret != "" {
+		v.keys = append(v.keys, key{alg: HS256, secret: []byte(cfg.HMACSecret)})
+	}
+	for _, path := range cfg.KeyFiles {
+		keys, err := readPEMKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	for _, path := range cfg.JWKSFiles {
+		keys, err := readJWKS(path)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("no keys configured to verify tokens with")
+	}
+	if v.audience == "" {
+		return nil, fmt.Errorf("no audience configured for tokens")
+	}
+	return v, nil
+}
+
+// Verify checks the signature, expiry, issuer and audience of token and returns who it was
+// issued to. AuthInfo is returned without the token itself, so it can travel with events.
+func (v *Verifier) Verify(token string) (*messaging.AuthInfo, *messaging.Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, invalid("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil, invalid("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, invalid("malformed token signature")
+	}
+	if !v.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, nil, invalid("invalid token signature")
+	}
+
+	var claims map[string]any
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, nil, invalid("malformed token claims")
+	}
+	if err = v.checkClaims(claims); err != nil {
+		return nil, nil, err
+	}
+	subject := stringClaim(claims, "sub")
+	if subject == "" {
+		return nil, nil, invalid("token has no subject")
+	}
+	info := &messaging.AuthInfo{
+		Subject: subject,
+		Issuer:  stringClaim(claims, "iss"),
+		Scopes:  stringClaim(claims, v.claims.scope),
+	}
+	principal := &messaging.Principal{
+		Organization: entities.OrganizationStub{ID: stringClaim(claims, v.claims.organization)},
+		Tenant:       entities.TenantStub{ID: stringClaim(claims, v.claims.tenant)},
+		Group:        entities.GroupStub{ID: stringClaim(claims, v.claims.group)},
+		User:         entities.UserStub{ID: subject, Name: stringClaim(claims, v.claims.name)},
+	}
+	return info, principal, nil
+}
+
+// verifySignature tries the keys of alg that the token's key id selects. Keys only ever verify
+// their own algorithm, so a public key cannot be passed off as an HMAC secret.
+func (v *Verifier) verifySignature(alg, kid string, input, signature []byte) bool {
+	digest := sha256.Sum256(input)
+	for _, k := range v.keys {
+		if k.alg != alg || (kid != "" && k.id != "" && k.id != kid) {
+			continue
+		}
+		switch alg {
+		case HS256:
+			mac := hmac.New(sha256.New, k.secret)
+			mac.Write(input)
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case RS256:
+			if rsa.VerifyPKCS1v15(k.public.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		case ES256:
+			// JWS carries r and s side by side rather than ASN.1 encoded
+			if len(signature) != 64 {
+				return false
+			}
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(k.public.(*ecdsa.PublicKey), digest[:], r, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *Verifier) checkClaims(claims map[string]any) error {
+	now := v.now()
+	exp, ok := timeClaim(claims, "exp")
+	if !ok {
+		return invalid("token has no expiry")
+	}
+	if now.After(exp.Add(v.leeway)) {
+		return invalid("token expired at %s", exp.Format(time.RFC3339))
+	}
+	if nbf, ok := timeClaim(claims, "nbf"); ok && now.Before(nbf.Add(-v.leeway)) {
+		return invalid("token not valid before %s", nbf.Format(time.RFC3339))
+	}
+	if v.issuer != "" && stringClaim(claims, "iss") != v.issuer {
+		return invalid("token was not issued by %s", v.issuer)
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == v.audience {
+			return nil
+		}
+	case []any:
+		for _, a := range aud {
+			if a == v.audience {
+				return nil
+			}
+		}
+	}
+	return invalid("token is not meant for %s", v.audience)
+}
+
+func invalid(format string, args ...any) error {
+	return apperr.New(apperr.Unauthorized, format, args...)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// stringClaim returns a string claim, joining a list of strings with spaces as scopes are.
+func stringClaim(claims map[string]any, name string) string {
+	switch c := claims[name].(type) {
+	case string:
+		return c
+	case []any:
+		var values []string
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, " ")
+	default:
+		return ""
+	}
+}
+
+func timeClaim(claims map[string]any, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/settings"
+)
+
+var testNow = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signer signs the header and claims of a token, returning the signature segment.
+type signer func(input []byte) []byte
+
+func hs256(secret []byte) signer {
+	return func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, private *rsa.PrivateKey) signer {
+	return func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+// es256 signs the way JWS does, r and s side by side, or ASN.1 encoded when asn1 is set.
+func es256(t *testing.T, private *ecdsa.PrivateKey, asn1 bool) signer {
+	return func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		if asn1 {
+			signature, err := ecdsa.SignASN1(rand.Reader, private, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return signature
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, private, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+}
+
+func token(t *testing.T, alg, kid string, claims map[string]any, sign signer) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := b64(h) + "." + b64(c)
+	return input + "." + b64(sign([]byte(input)))
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub":    "u1",
+		"iss":    "https://issuer.example.com",
+		"aud":    "conversations",
+		"exp":    testNow.Add(time.Hour).Unix(),
+		"tenant": "t1",
+		"group":  "g1",
+		"scope":  "conversations:read conversations:admin",
+	}
+}
+
+func testSettings() settings.Auth {
+	cfg := settings.Auth{
+		Issuer:   "https://issuer.example.com",
+		Audience: "conversations",
+		Leeway:   30 * time.Second,
+	}
+	cfg.Claims.Tenant = "tenant"
+	cfg.Claims.Group = "group"
+	cfg.Claims.Scope = "scope"
+	return cfg
+}
+
+func newTestVerifier(t *testing.T, cfg settings.Auth) *Verifier {
+	v, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatalf("NewVerifier() error = %v", err)
+	}
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func rsaJWK(kid string, public *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(public.N.Bytes()), "e": b64(big.NewInt(int64(public.E)).Bytes())}
+}
+
+func ecJWK(kid string, public *ecdsa.PublicKey) map[string]string {
+	x, y := make([]byte, 32), make([]byte, 32)
+	public.X.FillBytes(x)
+	public.Y.FillBytes(y)
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(x), "y": b64(y)}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	secret := []byte("a secret of a reasonable length")
+	cfg := testSettings()
+	cfg.HMACSecret = string(secret)
+	v := newTestVerifier(t, cfg)
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]any)
+		valid  bool
+	}{
+		{name: "valid", change: func(map[string]any) {}, valid: true},
+		{name: "expired", change: func(c map[string]any) { c["exp"] = testNow.Add(-time.Minute).Unix() }},
+		{name: "expired within the leeway", change: func(c map[string]any) { c["exp"] = testNow.Add(-10 * time.Second).Unix() }, valid: true},
+		{name: "missing expiry", change: func(c map[string]any) { delete(c, "exp") }},
+		{name: "expiry that is not a number", change: func(c map[string]any) { c["exp"] = "tomorrow" }},
+		{name: "not yet valid", change: func(c map[string]any) { c["nbf"] = testNow.Add(time.Minute).Unix() }},
+		{name: "not yet valid within the leeway", change: func(c map[string]any) { c["nbf"] = testNow.Add(10 * time.Second).Unix() }, valid: true},
+		{name: "valid since before", change: func(c map[string]any) { c["nbf"] = testNow.Add(-time.Minute).Unix() }, valid: true},
+		{name: "audience in a list", change: func(c map[string]any) { c["aud"] = []string{"other", "conversations"} }, valid: true},
+		{name: "list without the audience", change: func(c map[string]any) { c["aud"] = []string{"other", "another"} }},
+		{name: "other audience", change: func(c map[string]any) { c["aud"] = "other" }},
+		{name: "missing audience", change: func(c map[string]any) { delete(c, "aud") }},
+		{name: "other issuer", change: func(c map[string]any) { c["iss"] = "https://evil.example.com" }},
+		{name: "missing issuer", change: func(c map[string]any) { delete(c, "iss") }},
+		{name: "missing subject", change: func(c map[string]any) { delete(c, "sub") }},
+		{name: "empty subject", change: func(c map[string]any) { c["sub"] = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.change(claims)
+			info, principal, err := v.Verify(token(t, HS256, "", claims, hs256(secret)))
+			if !tt.valid {
+				if apperr.KindOf(err) != apperr.Unauthorized {
+					t.Errorf("Verify() error = %v, want an Unauthorized one", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if principal.User.ID != "u1" || principal.Tenant.ID != "t1" || principal.Group.ID != "g1" {
+				t.Errorf("principal = %+v, want user u1 of group g1 in tenant t1", principal)
+			}
+			if info.Subject != "u1" || info.Scopes != "conversations:read conversations:admin" {
+				t.Errorf("auth info = %+v", info)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	rsa1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	octSecret := []byte("shared secret of the oct key")
+	cfg := testSettings()
+	cfg.JWKSFiles = []string{writeJWKS(t,
+		rsaJWK("r1", &rsa1.PublicKey),
+		rsaJWK("r2", &rsa2.PublicKey),
+		ecJWK("e1", &ec1.PublicKey),
+		map[string]string{"kty": "oct", "kid": "h1", "k": b64(octSecret)},
+	)}
+	v := newTestVerifier(t, cfg)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		alg   string
+		kid   string
+		sign  signer
+		valid bool
+	}{
+		{name: "RS256 with its key id", alg: RS256, kid: "r1", sign: rs256(t, rsa1), valid: true},
+		{name: "RS256 selecting the second key", alg: RS256, kid: "r2", sign: rs256(t, rsa2), valid: true},
+		{name: "RS256 without a key id", alg: RS256, sign: rs256(t, rsa2), valid: true},
+		{name: "RS256 naming another key", alg: RS256, kid: "r1", sign: rs256(t, rsa2)},
+		{name: "RS256 with an unknown key id", alg: RS256, kid: "r9", sign: rs256(t, rsa1)},
+		{name: "RS256 by an unknown key", alg: RS256, sign: rs256(t, other)},
+		{name: "HS256 keyed with the RSA modulus", alg: HS256, kid: "r1", sign: hs256(rsa1.PublicKey.N.Bytes())},
+		{name: "HS256 keyed with the RSA JWK", alg: HS256, sign: hs256([]byte(b64(rsa1.PublicKey.N.Bytes())))},
+		{name: "HS256 with the oct key", alg: HS256, kid: "h1", sign: hs256(octSecret), valid: true},
+		{name: "HS256 naming an RSA key", alg: HS256, kid: "r1", sign: hs256(octSecret)},
+		{name: "ES256", alg: ES256, kid: "e1", sign: es256(t, ec1, false), valid: true},
+		{name: "ES256 ASN.1 encoded", alg: ES256, kid: "e1", sign: es256(t, ec1, true)},
+		{name: "ES256 one byte short", alg: ES256, kid: "e1", sign: func(input []byte) []byte { return es256(t, ec1, false)(input)[:63] }},
+		{name: "none", alg: "none", sign: func([]byte) []byte { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := v.Verify(token(t, tt.alg, tt.kid, validClaims(), tt.sign))
+			if tt.valid && err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+			if !tt.valid && apperr.KindOf(err) != apperr.Unauthorized {
+				t.Errorf("Verify() error = %v, want an Unauthorized one", err)
+			}
+		})
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	cfg := testSettings()
+	cfg.HMACSecret = "secret"
+	v := newTestVerifier(t, cfg)
+	for _, tok := range []string{"", "a.b", "a.b.c.d", "!!.e30.", b64([]byte(`{"alg":"HS256"}`)) + ".e30.!!"} {
+		if _, _, err := v.Verify(tok); apperr.KindOf(err) != apperr.Unauthorized {
+			t.Errorf("Verify(%q) error = %v, want an Unauthorized one", tok, err)
+		}
+	}
+}
+
+func TestReadJWKS(t *testing.T) {
+	ec1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		keys []map[string]string
+		ids  []string
+		fail bool
+	}{
+		{name: "empty oct key", keys: []map[string]string{{"kty": "oct", "kid": "h1", "k": ""}}, fail: true},
+		{name: "oct key", keys: []map[string]string{{"kty": "oct", "kid": "h1", "k": b64([]byte("secret"))}}, ids: []string{"h1"}},
+		{name: "encryption key", keys: []map[string]string{{"kty": "oct", "kid": "h1", "use": "enc", "k": b64([]byte("secret"))}}},
+		{name: "key of another algorithm", keys: []map[string]string{{"kty": "oct", "kid": "h1", "alg": "HS512", "k": b64([]byte("secret"))}}},
+		{name: "unsupported curve", keys: []map[string]string{{"kty": "EC", "kid": "e1", "crv": "P-384", "x": b64(ec384.X.Bytes()), "y": b64(ec384.Y.Bytes())}}},
+		{name: "point off the curve", keys: []map[string]string{{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(make([]byte, 32)), "y": b64(make([]byte, 32))}}, fail: true},
+		{name: "EC key", keys: []map[string]string{ecJWK("e1", &ec1.PublicKey)}, ids: []string{"e1"}},
+		{name: "RSA exponent too small", keys: []map[string]string{{"kty": "RSA", "kid": "r1", "n": b64([]byte{1, 2, 3}), "e": b64([]byte{1})}}, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := readJWKS(writeJWKS(t, tt.keys...))
+			if tt.fail {
+				if err == nil {
+					t.Errorf("readJWKS() = %+v, want an error", keys)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readJWKS() error = %v", err)
+			}
+			var ids []string
+			for _, k := range keys {
+				ids = append(ids, k.id)
+			}
+			if len(ids) != len(tt.ids) || (len(ids) > 0 && ids[0] != tt.ids[0]) {
+				t.Errorf("readJWKS() keys = %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
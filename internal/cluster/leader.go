@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/db"
+	"github.com/mangudaigb/dhauli-base/discover"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const leaderCheckInterval = 5 * time.Second
+
+// Leader runs a task on a single instance at a time. The instance holding the ephemeral lock
+// node runs it; the others wait for the node to disappear, which ZooKeeper guarantees when the
+// holder stops or loses its session.
+type Leader struct {
+	log    *logger.Logger
+	zk     *db.ZkClient
+	path   string
+	holder string
+}
+
+func NewLeader(cfg *config.Config, log *logger.Logger, zkClient *db.ZkClient, self *discover.InstanceInfo, task string) *Leader {
+	holder := primitive.NewObjectID().Hex()
+	if self != nil {
+		holder = self.Id
+	}
+	return &Leader{
+		log:    log,
+		zk:     zkClient,
+		path:   "/dhauli/services/" + cfg.Server.Name + "/locks/" + task,
+		holder: holder,
+	}
+}
+
+// Run blocks until ctx is done, running task whenever this instance holds the lock. The
+// context passed to task is cancelled as soon as the lock is lost. Without a ZooKeeper client
+// the instance is assumed to be alone and runs task straight away.
+func (l *Leader) Run(ctx context.Context, task func(ctx context.Context)) {
+	if l.zk == nil {
+		task(ctx)
+		return
+	}
+	for ctx.Err() == nil {
+		if err := l.zk.EnsurePath(path.Dir(l.path)); err != nil {
+			l.log.Errorf("Error creating lock path %s: %v", l.path, err)
+			l.sleep(ctx, watchRetryBackoff)
+			continue
+		}
+		_, err := l.zk.Conn.Create(l.path, []byte(l.holder), zk.FlagEphemeral, l.zk.ACL)
+		switch {
+		case err == nil:
+			l.log.Infof("Acquired lock %s", l.path)
+			l.lead(ctx, task)
+		case errors.Is(err, zk.ErrNodeExists) && l.holding():
+			// still ours from before a connection hiccup cancelled the task
+			l.lead(ctx, task)
+		case errors.Is(err, zk.ErrNodeExists):
+			exists, _, events, err := l.zk.Conn.ExistsW(l.path)
+			if err != nil {
+				l.log.Errorf("Error watching lock %s: %v", l.path, err)
+				l.sleep(ctx, watchRetryBackoff)
+			} else if exists {
+				select {
+				case <-ctx.Done():
+				case <-events:
+				}
+			}
+		default:
+			l.log.Errorf("Error acquiring lock %s: %v", l.path, err)
+			l.sleep(ctx, watchRetryBackoff)
+		}
+	}
+}
+
+func (l *Leader) lead(ctx context.Context, task func(ctx context.Context)) {
+	taskCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(leaderCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-taskCtx.Done():
+				return
+			case <-ticker.C:
+				if !l.holding() {
+					l.log.Errorf("Lost lock %s", l.path)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	task(taskCtx)
+
+	if data, stat, err := l.zk.Conn.Get(l.path); err == nil && string(data) == l.holder {
+		if err = l.zk.Conn.Delete(l.path, stat.Version); err != nil {
+			l.log.Errorf("Error releasing lock %s: %v", l.path, err)
+		}
+	}
+}
+
+func (l *Leader) holding() bool {
+	data, _, err := l.zk.Conn.Get(l.path)
+	return err == nil && string(data) == l.holder
+}
+
+func (l *Leader) sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,203 @@
+// Package cluster lets the instances of the service find each other through the ZooKeeper
+// registry and forward conversation changes, so a subscriber connected to any instance sees
+// changes committed on all of them.
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/db"
+	"github.com/mangudaigb/dhauli-base/discover"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+// ChangesPath is the route on which every instance accepts changes forwarded by its peers.
+const ChangesPath = "/internal/changes"
+
+const (
+	forwardQueueSize  = 1024
+	forwardBatchSize  = 64
+	forwardTimeout    = 2 * time.Second
+	watchRetryBackoff = 5 * time.Second
+)
+
+// Peers tracks the other registered instances of the service and forwards changes to them.
+// Changes are queued and sent by a single goroutine, in order, so a slow peer delays but never
+// reorders delivery. Peers accept changes only with the shared secret of the cluster, so nothing
+// is forwarded without one. A peer that misses changes is not a problem for correctness: subscribers
+// detect the gap in sequences and read the missing changes from Mongo.
+type Peers struct {
+	log    *logger.Logger
+	zk     *db.ZkClient
+	path   string
+	selfId string
+	secret string
+	client *http.Client
+	mu     sync.RWMutex
+	peers  map[string]discover.InstanceInfo
+	queue  chan dhauli.ChangeEvent
+	done   chan struct{}
+}
+
+func NewPeers(cfg *config.Config, log *logger.Logger, zk *db.ZkClient, self *discover.InstanceInfo, secret string) *Peers {
+	p := &Peers{
+		log:    log,
+		zk:     zk,
+		path:   "/dhauli/services/" + cfg.Server.Name + "/instances",
+		secret: secret,
+		client: &http.Client{Timeout: forwardTimeout},
+		peers:  make(map[string]discover.InstanceInfo),
+		queue:  make(chan dhauli.ChangeEvent, forwardQueueSize),
+		done:   make(chan struct{}),
+	}
+	if self != nil {
+		p.selfId = self.Id
+	}
+	return p
+}
+
+// Start watches the registry and begins forwarding. Without a ZooKeeper client the instance
+// runs standalone and changes stay local.
+func (p *Peers) Start() {
+	if p.secret == "" {
+		p.log.Infof("No cluster secret is set, conversation changes stay local")
+		go p.discard()
+		return
+	}
+	if p.zk != nil {
+		go p.watch()
+	}
+	go p.forward()
+}
+
+func (p *Peers) Broadcast(changes []dhauli.ChangeEvent) {
+	for _, change := range changes {
+		select {
+		case p.queue <- change:
+		default:
+			p.log.Errorf("Peer forward queue is full, dropping change %d of conversation %s", change.Seq, change.ConversationID)
+		}
+	}
+}
+
+func (p *Peers) Close() {
+	close(p.done)
+}
+
+func (p *Peers) watch() {
+	for {
+		children, _, events, err := p.zk.Conn.ChildrenW(p.path)
+		if err != nil {
+			p.log.Errorf("Error watching instances at %s: %v", p.path, err)
+			select {
+			case <-p.done:
+				return
+			case <-time.After(watchRetryBackoff):
+				continue
+			}
+		}
+		p.refresh(children)
+		select {
+		case <-p.done:
+			return
+		case <-events:
+		}
+	}
+}
+
+func (p *Peers) refresh(children []string) {
+	peers := make(map[string]discover.InstanceInfo, len(children))
+	for _, child := range children {
+		if child == p.selfId {
+			continue
+		}
+		data, err := p.zk.GetData(p.path + "/" + child)
+		if err != nil {
+			continue // the instance went away between listing and reading
+		}
+		var info discover.InstanceInfo
+		if err = json.Unmarshal(data, &info); err != nil {
+			p.log.Errorf("Error decoding instance info of %s: %v", child, err)
+			continue
+		}
+		peers[child] = info
+	}
+	p.mu.Lock()
+	p.peers = peers
+	p.mu.Unlock()
+	p.log.Infof("Forwarding conversation changes to %d peer instances", len(peers))
+}
+
+// discard empties the queue when there is nobody to forward to.
+func (p *Peers) discard() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.queue:
+		}
+	}
+}
+
+func (p *Peers) forward() {
+	for {
+		var batch []dhauli.ChangeEvent
+		select {
+		case <-p.done:
+			return
+		case change := <-p.queue:
+			batch = append(batch, change)
+		}
+	drain:
+		for len(batch) < forwardBatchSize {
+			select {
+			case change := <-p.queue:
+				batch = append(batch, change)
+			default:
+				break drain
+			}
+		}
+
+		body, err := json.Marshal(batch)
+		if err != nil {
+			p.log.Errorf("Error encoding %d changes for peers: %v", len(batch), err)
+			continue
+		}
+		p.mu.RLock()
+		peers := make([]discover.InstanceInfo, 0, len(p.peers))
+		for _, peer := range p.peers {
+			peers = append(peers, peer)
+		}
+		p.mu.RUnlock()
+		for _, peer := range peers {
+			p.send(peer, body)
+		}
+	}
+}
+
+func (p *Peers) send(peer discover.InstanceInfo, body []byte) {
+	url := fmt.Sprintf("http://%s:%d%s", peer.Ip, peer.Port, ChangesPath)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		p.log.Errorf("Error creating request to peer %s: %v", peer.Id, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.secret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.log.Errorf("Error forwarding changes to peer %s: %v", peer.Id, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		p.log.Errorf("Peer %s rejected forwarded changes with status %d", peer.Id, resp.StatusCode)
+	}
+}
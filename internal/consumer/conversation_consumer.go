@@ -2,50 +2,61 @@ package consumer
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/internal/handler"
+	"github.com/mangudaigb/conversation-service/internal/router"
 	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/consumer/messaging"
 	"github.com/mangudaigb/dhauli-base/logger"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type ConversationMsgHandler struct {
-	log  *logger.Logger
-	cSvc svc.ConversationService
+	log    *logger.Logger
+	cSvc   svc.ConversationService
+	iSvc   svc.InteractionService
+	access access
 }
 
-func (cmh *ConversationMsgHandler) ConversationHandlerFunc(ctx context.Context, message messaging.Message, action messaging.Action) (*dhauli.Conversation, error) {
-	var err error
-	var out *dhauli.Conversation
-	if action == "create" {
-		out, err = cmh.handleCreate(ctx, message)
-	} else if action == "update" {
-		out, err = cmh.cSvc.UpdateInteractionAnswer(ctx, message.ID, dhauli.InteractionStub{})
-	} else if action == "get" {
-		out, err = cmh.cSvc.GetConversationById(ctx, message.ID)
-	} else {
-		cmh.log.Errorf("Invalid action: %s", action)
-		return nil, errors.New("invalid action")
+// Register adds the conversation routes to r, along with the events of other services that
+// affect conversations.
+func (cmh *ConversationMsgHandler) Register(r *router.Router) {
+	for _, kind := range []messaging.Kind{messaging.REQUEST, messaging.COMMAND} {
+		r.Handle(router.Route{Type: contracts.Conversation, Action: messaging.CREATE, Kind: kind}, router.Typed(cmh.log, cmh.handleCreate))
+		r.Handle(router.Route{Type: contracts.Conversation, Action: messaging.UPDATE, Kind: kind}, router.Typed(cmh.log, cmh.handleUpdate))
+		r.Handle(router.Route{Type: contracts.Conversation, Action: messaging.DELETE, Kind: kind}, router.Typed(cmh.log, cmh.handleDelete))
+	}
+	for _, kind := range []messaging.Kind{messaging.REQUEST, messaging.QUERY} {
+		r.Handle(router.Route{Type: contracts.Conversation, Action: messaging.GET, Kind: kind}, router.Typed(cmh.log, cmh.handleGet))
 	}
-	return out, err
+	r.Handle(router.Route{Type: contracts.Session, Action: contracts.Ended, Kind: messaging.EVENT}, router.Typed(cmh.log, cmh.handleSessionEnded))
 }
 
-func (cmh *ConversationMsgHandler) handleCreate(ctx context.Context, msg messaging.Message) (*dhauli.Conversation, error) {
-	var req handler.ConversationRequest
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
-		cmh.log.Errorf("Error unmarshalling message for id: %s with %v", msg.ID, err)
+func (cmh *ConversationMsgHandler) handleCreate(ctx context.Context, msg messaging.Message, req handler.ConversationRequest) (any, error) {
+	if req.UserID == "" || req.WorkflowId == "" || req.SessionId == "" {
+		return nil, apperr.NewValidation("userId, workflowId and sessionId are required")
+	}
+	uid, trusted, err := cmh.access.user(ctx)
+	if err != nil {
 		return nil, err
 	}
+	if !trusted && uid != req.UserID {
+		return nil, apperr.NewForbidden("user %s cannot create conversations of user %s", uid, req.UserID)
+	}
 	c := dhauli.Conversation{
-		ID:         primitive.NewObjectID().Hex(),
 		WorkflowID: req.WorkflowId,
 		SessionID:  req.SessionId,
 		UserID:     req.UserID,
 	}
+	if req.Data.Query != "" {
+		c.Interactions = []dhauli.InteractionStub{
+			{
+				Query: req.Data.Query,
+			},
+		}
+	}
 	createdConversation, err := cmh.cSvc.CreateConversation(ctx, &c)
 	if err != nil {
 		cmh.log.Errorf("Error creating conversation: %v", err)
@@ -54,69 +65,164 @@ func (cmh *ConversationMsgHandler) handleCreate(ctx context.Context, msg messagi
 	return createdConversation, nil
 }
 
-func (cmh *ConversationMsgHandler) handleUpdate(ctx context.Context, msg messaging.Message) (*dhauli.Conversation, error) {
-	var req handler.ConversationRequest
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
-		cmh.log.Errorf("Error unmarshalling message for id: %s with %v", msg.ID, err)
+func (cmh *ConversationMsgHandler) handleGet(ctx context.Context, msg messaging.Message, req handler.ConversationRequest) (any, error) {
+	cid, err := conversationIdOf(msg, req)
+	if err != nil {
+		return nil, err
+	}
+	if err = cmh.access.conversation(ctx, cid, dhauli.RoleViewer); err != nil {
 		return nil, err
 	}
+	return cmh.cSvc.GetConversationById(ctx, cid)
+}
 
-	if req.Data.ID == "" {
-		cmh.log.Errorf("Interaction ID is required")
-		return nil, errors.New("interaction ID is required to update conversation")
+// handleUpdate mirrors the REST update: an answer update edits the referenced interaction, a
+// query update continues the conversation with a new interaction.
+func (cmh *ConversationMsgHandler) handleUpdate(ctx context.Context, msg messaging.Message, req handler.ConversationRequest) (any, error) {
+	cid, err := conversationIdOf(msg, req)
+	if err != nil {
+		return nil, err
+	}
+	if err = cmh.access.conversation(ctx, cid, dhauli.RoleEditor); err != nil {
+		return nil, err
 	}
 
-	var conversation *dhauli.Conversation
-	var err error
-	if req.UpdateType == handler.Answer {
-		conversation, err = cmh.cSvc.UpdateInteractionAnswer(ctx, req.ConversationId, req.Data)
-	} else if req.UpdateType == handler.Query {
-		interactionStub := dhauli.InteractionStub{
-			ID:    primitive.NewObjectID().Hex(),
-			Query: req.Data.Query,
+	switch req.UpdateType {
+	case handler.Answer:
+		if req.Data.ID == "" {
+			return nil, apperr.NewValidation("interaction id is required to update an answer")
+		}
+		inter, err := cmh.iSvc.GetInteractionById(ctx, req.Data.ID)
+		if err != nil {
+			return nil, err
+		}
+		if inter.ConversationID != cid {
+			return nil, apperr.NewNotFound("interaction %s not found in conversation %s", inter.ID, cid)
+		}
+		if _, err = cmh.iSvc.UpdateAnswerInInteraction(ctx, inter.ID, req.Data.Answer, req.UserID, string(handler.Answer), inter.Version); err != nil {
+			cmh.log.Errorf("Error updating answer of interaction %s: %v", inter.ID, err)
+			return nil, err
 		}
-		conversation, err = cmh.cSvc.AddInteractionByConversationId(ctx, req.ConversationId, interactionStub)
+	case handler.Query:
+		_, err = cmh.iSvc.CreateInteraction(ctx, &dhauli.Interaction{
+			WorkflowID:     req.WorkflowId,
+			SessionID:      req.SessionId,
+			ConversationID: cid,
+			Query:          req.Data.Query,
+		})
+		if err != nil {
+			cmh.log.Errorf("Error adding query to conversation %s: %v", cid, err)
+			return nil, err
+		}
+	default:
+		return nil, apperr.NewValidation("unknown update type %q", req.UpdateType)
 	}
+	return cmh.cSvc.GetConversationById(ctx, cid)
+}
+
+func (cmh *ConversationMsgHandler) handleDelete(ctx context.Context, msg messaging.Message, req handler.ConversationRequest) (any, error) {
+	cid, err := conversationIdOf(msg, req)
 	if err != nil {
-		cmh.log.Errorf("Error updating conversation: %v", err)
 		return nil, err
 	}
+	if err = cmh.access.conversation(ctx, cid, dhauli.RoleOwner); err != nil {
+		return nil, err
+	}
+	if err = cmh.cSvc.DeleteConversation(ctx, cid); err != nil {
+		cmh.log.Errorf("Error deleting conversation %s: %v", cid, err)
+		return nil, err
+	}
+	return map[string]string{"id": cid}, nil
+}
 
-	return conversation, nil
+type sessionEndedEvent struct {
+	SessionId string `json:"sessionId"`
 }
 
-func (cmh *ConversationMsgHandler) handleGet(ctx context.Context, msg messaging.Message) (*dhauli.Conversation, error) {
-	var req handler.ConversationRequest
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
-		cmh.log.Errorf("Error unmarshalling message for id: %s with %v", msg.ID, err)
+// handleSessionEnded closes every conversation of the session, so no further interactions can
+// be added to them. Conversations that are already closed are left alone.
+func (cmh *ConversationMsgHandler) handleSessionEnded(ctx context.Context, msg messaging.Message, event sessionEndedEvent) (any, error) {
+	sid := msg.SessionId
+	if sid == "" {
+		sid = event.SessionId
+	}
+	if sid == "" {
+		return nil, apperr.NewValidation("session id cannot be empty")
+	}
+	closed, err := cmh.cSvc.CloseSessionConversations(ctx, sid)
+	if err != nil {
+		cmh.log.Errorf("Error closing conversations of session %s: %v", sid, err)
 		return nil, err
 	}
+	cmh.log.Infof("Closed %d conversations of ended session %s", closed, sid)
+	return map[string]int{"closed": closed}, nil
+}
 
-	if req.ConversationId == "" {
-		return nil, errors.New("conversation id cannot be empty")
+// conversationIdOf takes the conversation from the message header, or from the payload for
+// producers that only set it there.
+func conversationIdOf(msg messaging.Message, req handler.ConversationRequest) (string, error) {
+	if msg.ConversationId != "" {
+		return msg.ConversationId, nil
 	}
-	return cmh.cSvc.GetConversationById(ctx, req.ConversationId)
+	if req.ConversationId != "" {
+		return req.ConversationId, nil
+	}
+	return "", apperr.NewValidation("conversation id cannot be empty")
+}
+
+type trustedKey struct{}
+
+// withTrustedSender marks the message handled with ctx as sent by a trusted service. Only the
+// topic the message was read from tells, never the message itself.
+func withTrustedSender(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trustedKey{}, true)
+}
+
+func trustedSender(ctx context.Context) bool {
+	trusted, _ := ctx.Value(trustedKey{}).(bool)
+	return trusted
 }
 
-//func createEnvelope(oldMsg *messaging.Message, oldEnv *messaging.Envelope, conversation *dhauli.Conversation) *messaging.Envelope {
-//	responseMsg, err := messaging.NewMessageFromOld(oldMsg, "conversation", oldMsg.Action, conversation)
-//	if err != nil {
-//		return messaging.MessageError(oldEnv, 500, errors.New("error creating response message"), false)
-//	}
-//	responseEnv := messaging.NewEnvelope(
-//		&responseMsg,
-//		messaging.WithCorrelationId(oldEnv.CorrelationId),
-//		messaging.WithTraceId(oldEnv.TraceId),
-//		messaging.WithIdempotencyKey(oldEnv.IdempotencyKey),
-//		messaging.WithKind(messaging.RESPONSE),
-//		messaging.WithEventName("success"),
-//	)
-//	return &responseEnv
-//}
+// access decides what messages may do on behalf of their user. Every message must name one.
+// Only the messages of trusted services skip the access control lists, and are only confined to
+// their tenant.
+type access struct {
+	cSvc svc.ConversationService
+}
+
+// user returns the user the message was sent on behalf of, and whether a trusted service sent it.
+func (a access) user(ctx context.Context) (string, bool, error) {
+	principal := svc.PrincipalFromContext(ctx)
+	if principal == nil || principal.User.ID == "" {
+		return "", false, apperr.New(apperr.Unauthorized, "the message names no user it is sent on behalf of")
+	}
+	return principal.User.ID, trustedSender(ctx), nil
+}
+
+// conversation checks that the user of the message holds role on conversation cid.
+func (a access) conversation(ctx context.Context, cid string, role string) error {
+	_, trusted, err := a.user(ctx)
+	if err != nil || trusted {
+		return err
+	}
+	return a.cSvc.Authorize(ctx, cid, role)
+}
+
+// interaction is conversation for the conversation of interaction iid.
+func (a access) interaction(ctx context.Context, iid string, role string) error {
+	_, trusted, err := a.user(ctx)
+	if err != nil || trusted {
+		return err
+	}
+	_, err = a.cSvc.AuthorizeInteraction(ctx, iid, role)
+	return err
+}
 
-func NewConversationMsgHandler(log *logger.Logger, cSvc svc.ConversationService) *ConversationMsgHandler {
+func NewConversationMsgHandler(log *logger.Logger, cSvc svc.ConversationService, iSvc svc.InteractionService) *ConversationMsgHandler {
 	return &ConversationMsgHandler{
-		log:  log,
-		cSvc: cSvc,
+		log:    log,
+		cSvc:   cSvc,
+		iSvc:   iSvc,
+		access: access{cSvc: cSvc},
 	}
 }
@@ -0,0 +1,103 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/settings"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const replayIdleTimeout = 2 * time.Second
+
+// DeadLetterQueue puts parked messages back on the main topic once whatever made them fail has
+// been fixed, or on the trusted topic they came from. Replays share a consumer group, so each
+// dead letter is replayed once.
+type DeadLetterQueue struct {
+	log           *logger.Logger
+	reader        kafka.ReaderConfig
+	writer        *kafka.Writer
+	topic         string
+	trustedTopics []string
+}
+
+func NewDeadLetterQueue(cfg *config.Config, sts *settings.Settings, log *logger.Logger) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		log: log,
+		reader: kafka.ReaderConfig{
+			Brokers:  cfg.Kafka.Brokers,
+			GroupID:  cfg.Kafka.GroupId + "-dlq-replay",
+			Topic:    sts.Retry.DeadLetterTopic,
+			MaxBytes: cfg.Kafka.MaxBytes,
+		},
+		writer: &kafka.Writer{
+			Addr: kafka.TCP(cfg.Kafka.Brokers...),
+		},
+		topic:         cfg.Kafka.Topic,
+		trustedTopics: sts.Consumer.TrustedTopics,
+	}
+}
+
+// Replay moves up to limit dead letters back to their topic and returns how many it moved.
+// Envelopes get a fresh retry budget; payloads that never parsed are replayed unchanged.
+func (q *DeadLetterQueue) Replay(ctx context.Context, limit int) (int, error) {
+	reader := kafka.NewReader(q.reader)
+	defer reader.Close()
+
+	replayed := 0
+	for replayed < limit {
+		fetchCtx, cancel := context.WithTimeout(ctx, replayIdleTimeout)
+		msg, err := reader.FetchMessage(fetchCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			break // nothing left to replay
+		}
+		if err != nil {
+			q.log.Errorf("Error fetching dead letter: %v", err)
+			return replayed, err
+		}
+
+		payload := msg.Value
+		var letter dhauli.DeadLetter
+		if err = json.Unmarshal(msg.Value, &letter); err == nil {
+			payload = letter.Payload
+		}
+		if envelope, err := messaging.FromJSON(payload); err == nil {
+			envelope.ID = primitive.NewObjectID().Hex()
+			envelope.RetryCount = 0
+			if payload, err = envelope.ToJSON(); err != nil {
+				return replayed, err
+			}
+		}
+		topic := q.topic
+		// the consumer set the origin of every dead letter, whatever the message claimed
+		if origin, ok := headerOf(msg, originHeader); ok && slices.Contains(q.trustedTopics, origin) {
+			topic = origin
+		}
+		if err = q.writer.WriteMessages(ctx, kafka.Message{Topic: topic, Key: msg.Key, Value: payload}); err != nil {
+			q.log.Errorf("Error replaying dead letter %s: %v", letter.ID, err)
+			return replayed, err
+		}
+		if err = reader.CommitMessages(ctx, msg); err != nil {
+			q.log.Errorf("Error committing replayed dead letter %s: %v", letter.ID, err)
+			return replayed, err
+		}
+		replayed++
+	}
+	q.log.Infof("Replayed %d dead letters", replayed)
+	return replayed, nil
+}
+
+func (q *DeadLetterQueue) Close() {
+	if err := q.writer.Close(); err != nil {
+		q.log.Errorf("Error closing dead letter writer: %v", err)
+	}
+}
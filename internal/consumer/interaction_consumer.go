@@ -2,38 +2,50 @@ package consumer
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/internal/handler"
+	"github.com/mangudaigb/conversation-service/internal/router"
 	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/consumer/messaging"
 	"github.com/mangudaigb/dhauli-base/logger"
 )
 
 type InteractionMsgHandler struct {
-	log  *logger.Logger
-	iSvc svc.InteractionService
+	log    *logger.Logger
+	iSvc   svc.InteractionService
+	sSvc   svc.StreamService
+	cSvc   svc.ConversationService
+	access access
 }
 
-func (ih *InteractionMsgHandler) InteractionHandlerFunc(ctx context.Context, message messaging.Message, action messaging.Action) (*dhauli.Interaction, error) {
-	var err error
-	var out *dhauli.Interaction
-	if action == "create" {
-		out, err = ih.handleCreate(ctx, message)
-	} else if action == "update" {
-		out, err = ih.handleUpdate(ctx, message)
-	} else if action == "get" {
-		out, err = ih.handleGet(ctx, message)
-	}
-	return out, err
+// Register adds the interaction routes to r. Writes are accepted as requests and as
+// fire-and-forget commands, reads as requests and as queries.
+func (ih *InteractionMsgHandler) Register(r *router.Router) {
+	for _, kind := range []messaging.Kind{messaging.REQUEST, messaging.COMMAND} {
+		r.Handle(router.Route{Type: contracts.Interaction, Action: messaging.CREATE, Kind: kind}, router.Typed(ih.log, ih.handleCreate))
+		r.Handle(router.Route{Type: contracts.Interaction, Action: messaging.UPDATE, Kind: kind}, router.Typed(ih.log, ih.handleUpdate))
+		r.Handle(router.Route{Type: contracts.Interaction, Action: messaging.DELETE, Kind: kind}, router.Typed(ih.log, ih.handleDelete))
+		r.Handle(router.Route{Type: contracts.Interaction, Action: contracts.Append, Kind: kind}, router.Typed(ih.log, ih.handleAppend))
+		for _, action := range []messaging.Action{contracts.Revert, contracts.Undo, contracts.Redo} {
+			r.Handle(router.Route{Type: contracts.Interaction, Action: action, Kind: kind}, router.Typed(ih.log, ih.handleRestore))
+		}
+	}
+	for _, kind := range []messaging.Kind{messaging.REQUEST, messaging.QUERY} {
+		r.Handle(router.Route{Type: contracts.Interaction, Action: messaging.GET, Kind: kind}, router.Typed(ih.log, ih.handleGet))
+	}
 }
 
-func (ih *InteractionMsgHandler) handleCreate(ctx context.Context, msg messaging.Message) (*dhauli.Interaction, error) {
-	var req handler.InteractionRequest
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
-		ih.log.Errorf("Error unmarshalling message for id: %s with %v", msg.ID, err)
+func (ih *InteractionMsgHandler) handleCreate(ctx context.Context, msg messaging.Message, req handler.InteractionRequest) (any, error) {
+	if req.ConversationId == "" {
+		req.ConversationId = msg.ConversationId
+	}
+	if req.ConversationId == "" {
+		return nil, apperr.NewValidation("conversation id cannot be empty")
+	}
+	if err := ih.access.conversation(ctx, req.ConversationId, dhauli.RoleEditor); err != nil {
 		return nil, err
 	}
 	interaction := dhauli.Interaction{
@@ -41,70 +53,139 @@ func (ih *InteractionMsgHandler) handleCreate(ctx context.Context, msg messaging
 		SessionID:      req.SessionId,
 		ConversationID: req.ConversationId,
 	}
-	if req.Type == handler.CONTEXT {
+	switch req.Type {
+	case handler.CONTEXT:
 		interaction.Context = req.Data
-	} else if req.Type == handler.ANSWER {
+	case handler.ANSWER:
 		interaction.Answer = req.Data
-	} else if req.Type == handler.QUERY {
+	case handler.QUERY:
 		interaction.Query = req.Data
 	}
 	createdInteraction, err := ih.iSvc.CreateInteraction(ctx, &interaction)
 	if err != nil {
-		ih.log.Errorf("Error creating conversation: %v", err)
+		ih.log.Errorf("Error creating interaction: %v", err)
 		return nil, err
 	}
 	return createdInteraction, nil
 }
 
-func (ih *InteractionMsgHandler) handleGet(ctx context.Context, msg messaging.Message) (*dhauli.Interaction, error) {
-	var req handler.InteractionRequest
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
-		ih.log.Errorf("Error unmarshalling message for id: %s with %v", msg.ID, err)
+func (ih *InteractionMsgHandler) handleGet(ctx context.Context, msg messaging.Message, req handler.InteractionRequest) (any, error) {
+	iid, err := interactionIdOf(msg, req)
+	if err != nil {
 		return nil, err
 	}
-	if req.InteractionId == "" {
-		return nil, errors.New("interaction id cannot be empty")
+	if err = ih.access.interaction(ctx, iid, dhauli.RoleViewer); err != nil {
+		return nil, err
 	}
-	return ih.iSvc.GetInteractionById(ctx, req.InteractionId)
+	return ih.iSvc.GetInteractionById(ctx, iid)
 }
 
-func (ih *InteractionMsgHandler) handleUpdate(ctx context.Context, msg messaging.Message) (*dhauli.Interaction, error) {
-	var req handler.InteractionRequest
-	if err := json.Unmarshal(msg.Data, &req); err != nil {
-		ih.log.Errorf("Error parsing Data of message: %v", err)
+func (ih *InteractionMsgHandler) handleUpdate(ctx context.Context, msg messaging.Message, req handler.InteractionRequest) (any, error) {
+	iid, err := interactionIdOf(msg, req)
+	if err != nil {
 		return nil, err
 	}
-	if req.InteractionId == "" {
-		ih.log.Errorf("Interaction ID is required")
-		return nil, errors.New("interaction id cannot be empty")
+	if err = ih.access.interaction(ctx, iid, dhauli.RoleEditor); err != nil {
+		return nil, err
 	}
 	var in *dhauli.Interaction
-	var err error
-	if req.Type == handler.CONTEXT {
-		in, err = ih.iSvc.UpdateContextInInteraction(ctx, req.InteractionId, req.Data, req.Actor, req.Action, req.Version)
-		if err != nil {
-			ih.log.Errorf("Failed to update context in interaction: %v", err)
-			return nil, err
-		}
-	} else if req.Type == handler.ANSWER {
-		in, err = ih.iSvc.UpdateAnswerInInteraction(ctx, req.InteractionId, req.Data, req.Actor, req.Action, req.Version)
-		if err != nil {
-			ih.log.Errorf("Failed to update answer in interaction: %v", err)
-			return nil, err
+	switch req.Type {
+	case handler.ANSWER:
+		in, err = ih.iSvc.UpdateAnswerInInteraction(ctx, iid, req.Data, req.Actor, req.Action, req.Version)
+	case handler.QUERY:
+		in, err = ih.iSvc.UpdateQueryInInteraction(ctx, iid, req.Data, req.Actor, req.Action, req.Version)
+	default:
+		if req.Merge {
+			in, err = ih.iSvc.MergeContextInInteraction(ctx, iid, req.Data, req.Actor, req.Action, req.Version)
+		} else {
+			in, err = ih.iSvc.UpdateContextInInteraction(ctx, iid, req.Data, req.Actor, req.Action, req.Version)
 		}
-	} else {
-		in, err = ih.iSvc.UpdateContextInInteraction(ctx, req.InteractionId, req.Data, req.Actor, req.Action, req.Version)
-		if err != nil {
-			ih.log.Errorf("Failed to update context in interaction: %%v", err)
-			return nil, err
+	}
+	if err != nil {
+		ih.log.Errorf("Failed to update %s in interaction %s: %v", req.Type, iid, err)
+		return nil, err
+	}
+	return in, nil
+}
+
+func (ih *InteractionMsgHandler) handleDelete(ctx context.Context, msg messaging.Message, req handler.InteractionRequest) (any, error) {
+	iid, err := interactionIdOf(msg, req)
+	if err != nil {
+		return nil, err
+	}
+	if err = ih.access.interaction(ctx, iid, dhauli.RoleEditor); err != nil {
+		return nil, err
+	}
+	if err = ih.iSvc.DeleteInteraction(ctx, iid, req.Cascade); err != nil {
+		ih.log.Errorf("Failed to delete interaction %s: %v", iid, err)
+		return nil, err
+	}
+	return map[string]string{"id": iid}, nil
+}
+
+// handleAppend adds a chunk to the answer being streamed. Only the final chunk yields the
+// interaction, with the accumulated answer selected.
+func (ih *InteractionMsgHandler) handleAppend(ctx context.Context, msg messaging.Message, req handler.InteractionRequest) (any, error) {
+	iid, err := interactionIdOf(msg, req)
+	if err != nil {
+		return nil, err
+	}
+	if err = ih.access.interaction(ctx, iid, dhauli.RoleEditor); err != nil {
+		return nil, err
+	}
+	_, in, err := ih.sSvc.Append(ctx, iid, req.Seq, req.Data, req.Actor, req.Model, req.Final)
+	if err != nil {
+		ih.log.Errorf("Failed to append answer chunk to interaction: %v", err)
+		return nil, err
+	}
+	return in, nil
+}
+
+// handleRestore reverts the interaction to the history entry given by historyId, or undoes or
+// redoes its last change, depending on the action.
+func (ih *InteractionMsgHandler) handleRestore(ctx context.Context, msg messaging.Message, req handler.InteractionRequest) (any, error) {
+	iid, err := interactionIdOf(msg, req)
+	if err != nil {
+		return nil, err
+	}
+	if err = ih.access.interaction(ctx, iid, dhauli.RoleEditor); err != nil {
+		return nil, err
+	}
+	var in *dhauli.Interaction
+	switch msg.Action {
+	case contracts.Revert:
+		if req.HistoryId == "" {
+			return nil, apperr.NewValidation("history id cannot be empty")
 		}
+		in, err = ih.iSvc.RevertInteraction(ctx, iid, req.HistoryId, req.Actor, req.Version)
+	case contracts.Undo:
+		in, err = ih.iSvc.UndoInteraction(ctx, iid, req.Actor, req.Version)
+	default:
+		in, err = ih.iSvc.RedoInteraction(ctx, iid, req.Actor, req.Version)
+	}
+	if err != nil {
+		ih.log.Errorf("Failed to %s interaction %s: %v", msg.Action, iid, err)
+		return nil, err
 	}
 	return in, nil
 }
 
-func NewInteractionMsgHandler(log *logger.Logger, iSvc svc.InteractionService) *InteractionMsgHandler {
+func interactionIdOf(msg messaging.Message, req handler.InteractionRequest) (string, error) {
+	if req.InteractionId != "" {
+		return req.InteractionId, nil
+	}
+	if msg.InteractionId != "" {
+		return msg.InteractionId, nil
+	}
+	return "", apperr.NewValidation("interaction id cannot be empty")
+}
+
+func NewInteractionMsgHandler(log *logger.Logger, iSvc svc.InteractionService, sSvc svc.StreamService, cSvc svc.ConversationService) *InteractionMsgHandler {
 	return &InteractionMsgHandler{
-		log:  log,
-		iSvc: iSvc,
+		log:    log,
+		iSvc:   iSvc,
+		sSvc:   sSvc,
+		cSvc:   cSvc,
+		access: access{cSvc: cSvc},
 	}
 }
@@ -0,0 +1,403 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/router"
+	"github.com/mangudaigb/conversation-service/internal/settings"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	notBeforeHeader = "x-not-before"
+	errorHeader     = "x-error"
+	originHeader    = "x-origin-topic"
+	routeRetryDelay = 3 * time.Second
+	fetchErrorDelay = 3 * time.Second
+)
+
+type Handler func(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope
+
+// KafkaConsumer feeds envelopes to the handler and routes the outcome. Successful responses go
+// to the router topic, for the kinds that are answered at all. Failures are re-queued to the retry topic with exponential
+// delay while the envelope has retries left, and parked on the dead-letter topic once it has
+// none, when the error says retrying is pointless, or when the message cannot even be parsed.
+// Messages are processed by a pool of workers, in order per conversation, and an offset is
+// only committed once the message and everything before it in the partition was routed.
+// Retries wait on their worker until they are due, and the later messages of their conversation
+// wait behind them, so neither the other conversations nor the order of their own are affected.
+// Messages of the trusted topics, and their retries, are handled as sent by a trusted service.
+type KafkaConsumer struct {
+	log           *logger.Logger
+	tr            trace.Tracer
+	handler       Handler
+	reader        *kafka.Reader
+	retryReader   *kafka.Reader
+	eventReaders  []*kafka.Reader
+	responses     *kafka.Writer
+	writer        *kafka.Writer
+	retryTopic    string
+	dlqTopic      string
+	trustedTopics []string
+	maxRetries    int
+	initialDelay  time.Duration
+	maxDelay      time.Duration
+	workers       int
+	queueDepth    int
+	gate          *retryGate
+}
+
+func NewKafkaConsumer(cfg *config.Config, sts *settings.Settings, tr trace.Tracer, log *logger.Logger, handler Handler) *KafkaConsumer {
+	topics := append(slices.Clone(sts.Consumer.EventTopics), sts.Consumer.TrustedTopics...)
+	eventReaders := make([]*kafka.Reader, 0, len(topics))
+	for _, topic := range topics {
+		eventReaders = append(eventReaders, kafka.NewReader(kafka.ReaderConfig{
+			Brokers:  cfg.Kafka.Brokers,
+			GroupID:  cfg.Kafka.GroupId,
+			Topic:    topic,
+			MaxBytes: cfg.Kafka.MaxBytes,
+		}))
+	}
+	return &KafkaConsumer{
+		log:     log,
+		tr:      tr,
+		handler: handler,
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:  cfg.Kafka.Brokers,
+			GroupID:  cfg.Kafka.GroupId,
+			Topic:    cfg.Kafka.Topic,
+			MaxBytes: cfg.Kafka.MaxBytes,
+		}),
+		retryReader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:  cfg.Kafka.Brokers,
+			GroupID:  cfg.Kafka.GroupId + "-retry",
+			Topic:    sts.Retry.Topic,
+			MaxBytes: cfg.Kafka.MaxBytes,
+		}),
+		eventReaders: eventReaders,
+		responses: &kafka.Writer{
+			Addr:  kafka.TCP(cfg.Kafka.Brokers...),
+			Topic: cfg.Kafka.RouterTopic,
+		},
+		writer: &kafka.Writer{
+			Addr: kafka.TCP(cfg.Kafka.Brokers...),
+		},
+		retryTopic:    sts.Retry.Topic,
+		dlqTopic:      sts.Retry.DeadLetterTopic,
+		trustedTopics: sts.Consumer.TrustedTopics,
+		maxRetries:    sts.Retry.MaxRetries,
+		initialDelay:  sts.Retry.InitialDelay,
+		maxDelay:      sts.Retry.MaxDelay,
+		workers:       sts.Consumer.Workers,
+		queueDepth:    sts.Consumer.QueueDepth,
+		gate:          newRetryGate(),
+	}
+}
+
+// Start consumes the main, the retry, the trusted and the subscribed event topics until ctx is
+// done.
+func (c *KafkaConsumer) Start(ctx context.Context) {
+	go c.consume(ctx, c.reader)
+	go c.consume(ctx, c.retryReader)
+	for _, reader := range c.eventReaders {
+		go c.consume(ctx, reader)
+	}
+}
+
+func (c *KafkaConsumer) Stop() {
+	closers := []interface{ Close() error }{c.reader, c.retryReader, c.responses, c.writer}
+	for _, reader := range c.eventReaders {
+		closers = append(closers, reader)
+	}
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			c.log.Errorf("Error while closing kafka client: %v", err)
+		}
+	}
+}
+
+func (c *KafkaConsumer) consume(ctx context.Context, reader *kafka.Reader) {
+	topic := reader.Config().Topic
+	offsets := newOffsetTracker(c.log, reader)
+	retries := reader == c.retryReader
+	hold := func(key string, msg kafka.Message) bool {
+		if retries {
+			notBefore, ok := notBeforeOf(msg)
+			return ok && time.Now().Before(notBefore)
+		}
+		return c.gate.held(key)
+	}
+	pool := newWorkerPool(c.workers, c.queueDepth, offsets)
+	pool.start(ctx, hold, func(ctx context.Context, msg kafka.Message) bool {
+		for ctx.Err() == nil {
+			err := c.process(ctx, msg)
+			if err == nil {
+				if retries {
+					c.gate.release(orderingKey(msg))
+				}
+				return true
+			}
+			c.log.Errorf("Error while routing message at %s/%d/%d, retrying: %v", topic, msg.Partition, msg.Offset, err)
+			sleep(ctx, routeRetryDelay)
+		}
+		return false
+	})
+	go offsets.commitLoop(ctx)
+	defer pool.wait()
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				c.log.Infof("Stopped consuming %s", topic)
+				return
+			}
+			c.log.Errorf("Error while fetching from %s: %v", topic, err)
+			sleep(ctx, fetchErrorDelay)
+			continue
+		}
+		if !pool.dispatch(ctx, orderingKey(msg), msg) {
+			return
+		}
+	}
+}
+
+// orderingKey is the conversation a message belongs to, or the interaction for messages naming
+// only that. Messages naming neither, like requests creating a conversation, fall back to the
+// message key and otherwise stay in the order of their partition.
+func orderingKey(msg kafka.Message) string {
+	var envelope struct {
+		Message struct {
+			ConversationId string `json:"conversationId"`
+			InteractionId  string `json:"interactionId"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(msg.Value, &envelope); err == nil {
+		if envelope.Message.ConversationId != "" {
+			return envelope.Message.ConversationId
+		}
+		if envelope.Message.InteractionId != "" {
+			return envelope.Message.InteractionId
+		}
+	}
+	if len(msg.Key) > 0 {
+		return string(msg.Key)
+	}
+	return fmt.Sprintf("partition/%d", msg.Partition)
+}
+
+// process handles msg and routes the outcome. An error means the outcome could not be written
+// and the message has to be processed again.
+func (c *KafkaConsumer) process(ctx context.Context, msg kafka.Message) error {
+	carrier := propagation.MapCarrier{}
+	for _, header := range msg.Headers {
+		carrier[header.Key] = string(header.Value)
+	}
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+	if slices.Contains(c.trustedTopics, c.originOf(msg)) {
+		ctx = withTrustedSender(ctx)
+	}
+	ctx, span := c.tr.Start(ctx, fmt.Sprintf("%s process", msg.Topic),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.Int64("message.offset", msg.Offset),
+			attribute.Int("message.partition", msg.Partition),
+		),
+	)
+	defer span.End()
+
+	envelope, err := messaging.FromJSON(msg.Value)
+	if err != nil {
+		c.log.Errorf("Error while unmarshalling message: %v", err)
+		span.SetStatus(codes.Error, err.Error())
+		return c.deadLetter(ctx, msg, nil, messaging.ErrorData{Code: 400, Message: "unparseable envelope: " + err.Error(), SkipRetry: true})
+	}
+	if envelope.MaxRetries == 0 {
+		envelope.MaxRetries = c.maxRetries
+	}
+	span.SetAttributes(
+		attribute.String("envelope.id", envelope.ID),
+		attribute.String("envelope.event_name", string(envelope.EventName)),
+		attribute.String("envelope.correlation_id", envelope.CorrelationId),
+		attribute.Int("envelope.retry_count", envelope.RetryCount),
+		attribute.Int("envelope.max_retries", envelope.MaxRetries),
+	)
+
+	response := c.handler(ctx, &envelope)
+	policy := router.PolicyFor(envelope.Kind)
+	failure, failed := failureOf(response)
+	if !failed {
+		if !policy.Respond {
+			return nil
+		}
+		return c.respond(ctx, response)
+	}
+	span.SetStatus(codes.Error, failure.Message)
+	if !failure.SkipRetry && envelope.RetryCount < envelope.MaxRetries {
+		return c.retry(ctx, msg, envelope)
+	}
+	if err = c.deadLetter(ctx, msg, &envelope, failure); err != nil {
+		return err
+	}
+	if !policy.Respond {
+		return nil
+	}
+	return c.respond(ctx, response)
+}
+
+// failureOf tells whether response reports a failure. Envelope errors are raised for requests
+// this service can never handle, so they are not retried.
+func failureOf(response *messaging.Envelope) (messaging.ErrorData, bool) {
+	if response == nil {
+		return messaging.ErrorData{Code: 500, Message: "no response"}, true
+	}
+	if response.Kind == messaging.ERROR {
+		return messaging.ErrorData{Code: 400, Message: string(response.EventName), SkipRetry: true}, true
+	}
+	if response.EventName != "error" {
+		return messaging.ErrorData{}, false
+	}
+	var data messaging.ErrorData
+	if err := response.Message.DecodeData(&data); err != nil {
+		return messaging.ErrorData{Code: 500, Message: "undecodable error response"}, true
+	}
+	return data, true
+}
+
+func (c *KafkaConsumer) retry(ctx context.Context, msg kafka.Message, envelope messaging.Envelope) error {
+	next := envelope.WithRetry()
+	delay := c.maxDelay
+	if shift := next.RetryCount - 1; shift < 32 {
+		delay = min(c.initialDelay<<shift, c.maxDelay)
+	}
+	value, err := next.ToJSON()
+	if err != nil {
+		return err
+	}
+	notBefore := time.Now().Add(delay)
+	headers := withHeader(msg.Headers, notBeforeHeader, notBefore.Format(time.RFC3339Nano))
+	headers = withHeader(headers, originHeader, c.originOf(msg))
+	c.log.Infof("Retrying message %s (%d/%d) in %s", envelope.ID, next.RetryCount, next.MaxRetries, delay)
+	err = c.writer.WriteMessages(ctx, kafka.Message{
+		Topic:   c.retryTopic,
+		Key:     msg.Key,
+		Value:   value,
+		Headers: headers,
+	})
+	if err != nil {
+		return err
+	}
+	c.gate.hold(orderingKey(msg), notBefore)
+	return nil
+}
+
+func (c *KafkaConsumer) deadLetter(ctx context.Context, msg kafka.Message, envelope *messaging.Envelope, failure messaging.ErrorData) error {
+	letter := dhauli.DeadLetter{
+		ID:        primitive.NewObjectID().Hex(),
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Code:      failure.Code,
+		Error:     failure.Message,
+		Payload:   msg.Value,
+		FailedAt:  time.Now(),
+	}
+	if envelope != nil {
+		letter.IdempotencyKey = envelope.IdempotencyKey
+		letter.RetryCount = envelope.RetryCount
+	}
+	value, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	c.log.Errorf("Dead-lettering message from %s/%d/%d: %s", msg.Topic, msg.Partition, msg.Offset, failure.Message)
+	return c.writer.WriteMessages(ctx, kafka.Message{
+		Topic:   c.dlqTopic,
+		Key:     msg.Key,
+		Value:   value,
+		Headers: withHeader(withHeader(msg.Headers, errorHeader, failure.Message), originHeader, c.originOf(msg)),
+	})
+}
+
+// originOf returns the topic msg was first sent to. Only retries say so in a header: the retry
+// topic is written by this service alone, the header of a message of any other topic could be
+// forged.
+func (c *KafkaConsumer) originOf(msg kafka.Message) string {
+	if msg.Topic != c.retryTopic {
+		return msg.Topic
+	}
+	if origin, ok := headerOf(msg, originHeader); ok {
+		return origin
+	}
+	return msg.Topic
+}
+
+func (c *KafkaConsumer) respond(ctx context.Context, response *messaging.Envelope) error {
+	value, err := response.ToJSON()
+	if err != nil {
+		c.log.Errorf("Error while marshalling response: %v", err)
+		return err
+	}
+	return c.responses.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(primitive.NewObjectID().Hex()),
+		Value: value,
+		Time:  time.Now(),
+	})
+}
+
+func notBeforeOf(msg kafka.Message) (time.Time, bool) {
+	value, ok := headerOf(msg, notBeforeHeader)
+	if !ok {
+		return time.Time{}, false
+	}
+	notBefore, err := time.Parse(time.RFC3339Nano, value)
+	return notBefore, err == nil
+}
+
+func headerOf(msg kafka.Message, key string) (string, bool) {
+	for _, header := range msg.Headers {
+		if header.Key == key {
+			return string(header.Value), true
+		}
+	}
+	return "", false
+}
+
+func withHeader(headers []kafka.Header, key, value string) []kafka.Header {
+	out := make([]kafka.Header, 0, len(headers)+1)
+	for _, header := range headers {
+		if header.Key != key {
+			out = append(out, header)
+		}
+	}
+	return append(out, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
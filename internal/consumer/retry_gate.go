@@ -0,0 +1,71 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+)
+
+// retryHoldGrace is how long after a retry is due its conversation stays held back. The retry
+// may be consumed by another instance, which cannot tell this one it is done.
+const retryHoldGrace = 30 * time.Second
+
+// retryGate holds back the later messages of a conversation while one of its messages waits on
+// the retry topic, so the retry is not overtaken. Holds are local to the instance: the retry
+// reader of the instance releases them, and they expire in case another instance got the retry.
+type retryGate struct {
+	mu    sync.Mutex
+	holds map[string]retryHold
+}
+
+type retryHold struct {
+	pending int
+	until   time.Time
+}
+
+func newRetryGate() *retryGate {
+	return &retryGate{holds: make(map[string]retryHold)}
+}
+
+// hold holds back key for a retry due at notBefore.
+func (g *retryGate) hold(key string, notBefore time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	h := g.holds[key]
+	h.pending++
+	h.until = maxTime(h.until, notBefore.Add(retryHoldGrace))
+	g.holds[key] = h
+}
+
+// release ends the hold of a retry of key that was processed.
+func (g *retryGate) release(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	h, ok := g.holds[key]
+	if !ok {
+		return
+	}
+	if h.pending--; h.pending <= 0 {
+		delete(g.holds, key)
+		return
+	}
+	g.holds[key] = h
+}
+
+// held reports whether the messages of key have to wait for a retry.
+func (g *retryGate) held(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	h, ok := g.holds[key]
+	if ok && time.Now().After(h.until) {
+		delete(g.holds, key)
+		return false
+	}
+	return ok
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,252 @@
+package consumer
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// parkPollInterval is how often workers check whether their parked messages may go on.
+	parkPollInterval = 250 * time.Millisecond
+	// commitRetryDelay is how long a failed commit waits before it is tried again.
+	commitRetryDelay = time.Second
+)
+
+// workerPool processes messages concurrently while keeping the messages of one conversation in
+// the order they were fetched: every ordering key is hashed onto one worker with its own queue.
+// Queues are bounded, so a saturated pool blocks dispatch and with it the fetch loop.
+// A message the hold function holds back is parked on its worker together with every later
+// message of its key, while the worker goes on with the other keys.
+type workerPool struct {
+	queues  []chan delivery
+	depth   int
+	offsets *offsetTracker
+	wg      sync.WaitGroup
+}
+
+type delivery struct {
+	key   string
+	msg   kafka.Message
+	epoch int
+}
+
+func newWorkerPool(workers, depth int, offsets *offsetTracker) *workerPool {
+	pool := &workerPool{
+		queues:  make([]chan delivery, max(workers, 1)),
+		depth:   max(depth, 1),
+		offsets: offsets,
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan delivery, pool.depth)
+	}
+	return pool
+}
+
+// start runs process for every dispatched message once hold lets it through. A message counts
+// as done, and becomes committable, only when process returns true.
+func (p *workerPool) start(ctx context.Context, hold func(key string, msg kafka.Message) bool, process func(ctx context.Context, msg kafka.Message) bool) {
+	for _, queue := range p.queues {
+		p.wg.Add(1)
+		go func(queue chan delivery) {
+			defer p.wg.Done()
+			w := &worker{parked: make(map[string][]delivery), hold: hold, process: process, offsets: p.offsets}
+			poll := time.NewTicker(parkPollInterval)
+			defer poll.Stop()
+			for {
+				// a worker full of parked messages stops taking new ones, which backs up dispatch
+				incoming := queue
+				if w.count >= p.depth {
+					incoming = nil
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-incoming:
+					w.parked[d.key] = append(w.parked[d.key], d)
+					w.count++
+					w.drain(ctx, d.key)
+				case <-poll.C:
+					for key := range w.parked {
+						w.drain(ctx, key)
+					}
+				}
+			}
+		}(queue)
+	}
+}
+
+// dispatch queues msg on the worker owning key and blocks while that worker is busy.
+func (p *workerPool) dispatch(ctx context.Context, key string, msg kafka.Message) bool {
+	epoch := p.offsets.track(msg)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	select {
+	case p.queues[h.Sum32()%uint32(len(p.queues))] <- delivery{key: key, msg: msg, epoch: epoch}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// worker is the state of one worker goroutine, which alone touches it.
+type worker struct {
+	parked  map[string][]delivery
+	count   int
+	hold    func(key string, msg kafka.Message) bool
+	process func(ctx context.Context, msg kafka.Message) bool
+	offsets *offsetTracker
+}
+
+// drain processes the parked messages of key in order until one is held back.
+func (w *worker) drain(ctx context.Context, key string) {
+	for msgs := w.parked[key]; len(msgs) > 0; msgs = w.parked[key] {
+		if ctx.Err() != nil || w.hold(key, msgs[0].msg) {
+			return
+		}
+		if w.process(ctx, msgs[0].msg) {
+			w.offsets.done(msgs[0].msg, msgs[0].epoch)
+		}
+		if len(msgs) == 1 {
+			delete(w.parked, key)
+		} else {
+			w.parked[key] = msgs[1:]
+		}
+		w.count--
+	}
+}
+
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// offsetTracker commits a partition only up to the last message before which everything is
+// done, so no message is skipped after a restart however the workers interleave. Offsets stay
+// committable until a commit of them succeeds.
+// After a rebalance the offsets fetched before it are never committed: their partition may belong
+// to another consumer now. A partition this consumer got back is fetched again from its committed
+// offset, and its tracking starts over in a new epoch; the messages of the old epoch still in
+// flight no longer count.
+type offsetTracker struct {
+	log        *logger.Logger
+	reader     *kafka.Reader
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+	ready      map[int]kafka.Message
+	signal     chan struct{}
+}
+
+type partitionOffsets struct {
+	epoch   int
+	pending []int64
+	done    map[int64]kafka.Message
+	// last is the offset fetched last, stale the last one fetched before a rebalance.
+	last  int64
+	stale int64
+}
+
+func newOffsetTracker(log *logger.Logger, reader *kafka.Reader) *offsetTracker {
+	return &offsetTracker{
+		log:        log,
+		reader:     reader,
+		partitions: make(map[int]*partitionOffsets),
+		ready:      make(map[int]kafka.Message),
+		signal:     make(chan struct{}, 1),
+	}
+}
+
+// track adds a fetched message and returns the epoch of its partition, which done needs.
+func (t *offsetTracker) track(msg kafka.Message) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// the tracker is the only reader of the stats, which reset on every read
+	if t.reader.Stats().Rebalances > 0 {
+		for id, partition := range t.partitions {
+			partition.stale = partition.last
+			delete(t.ready, id)
+		}
+	}
+	partition, ok := t.partitions[msg.Partition]
+	if !ok || msg.Offset <= partition.last {
+		epoch := 0
+		if ok {
+			epoch = partition.epoch + 1
+			delete(t.ready, msg.Partition)
+		}
+		partition = &partitionOffsets{epoch: epoch, done: make(map[int64]kafka.Message), stale: -1}
+		t.partitions[msg.Partition] = partition
+	}
+	partition.pending = append(partition.pending, msg.Offset)
+	partition.last = msg.Offset
+	return partition.epoch
+}
+
+func (t *offsetTracker) done(msg kafka.Message, epoch int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	partition := t.partitions[msg.Partition]
+	if partition == nil || partition.epoch != epoch {
+		return
+	}
+	partition.done[msg.Offset] = msg
+	advanced := false
+	for len(partition.pending) > 0 {
+		head, ok := partition.done[partition.pending[0]]
+		if !ok {
+			break
+		}
+		delete(partition.done, head.Offset)
+		partition.pending = partition.pending[1:]
+		if head.Offset > partition.stale {
+			t.ready[head.Partition] = head
+			advanced = true
+		}
+	}
+	if advanced {
+		select {
+		case t.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// commitLoop commits the latest committable message of every partition. It is the only
+// goroutine committing, so commits never go backwards. A failed commit is tried again.
+func (t *offsetTracker) commitLoop(ctx context.Context) {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.signal:
+		case <-retry:
+		}
+		retry = nil
+		t.mu.Lock()
+		msgs := make([]kafka.Message, 0, len(t.ready))
+		for _, msg := range t.ready {
+			msgs = append(msgs, msg)
+		}
+		t.mu.Unlock()
+		if len(msgs) == 0 {
+			continue
+		}
+		if err := t.reader.CommitMessages(ctx, msgs...); err != nil {
+			t.log.Errorf("Error while committing offsets of %s: %v", t.reader.Config().Topic, err)
+			retry = time.After(commitRetryDelay)
+			continue
+		}
+		t.mu.Lock()
+		for _, msg := range msgs {
+			// only what did not advance meanwhile is through
+			if ready, ok := t.ready[msg.Partition]; ok && ready.Offset == msg.Offset {
+				delete(t.ready, msg.Partition)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
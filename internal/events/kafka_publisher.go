@@ -0,0 +1,61 @@
+// Package events publishes the domain events of the service to Kafka.
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/segmentio/kafka-go"
+)
+
+type KafkaPublisher struct {
+	log    *logger.Logger
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher writes events to topic, keyed by conversation so that the events of one
+// conversation stay ordered within a partition.
+func NewKafkaPublisher(cfg *config.Config, log *logger.Logger, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		log: log,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Kafka.Brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+		},
+	}
+}
+
+func (kp *KafkaPublisher) Publish(ctx context.Context, envelopes ...messaging.Envelope) error {
+	if len(envelopes) == 0 {
+		return nil
+	}
+	msgs := make([]kafka.Message, 0, len(envelopes))
+	for _, envelope := range envelopes {
+		data, err := envelope.ToJSON()
+		if err != nil {
+			kp.log.Errorf("Error marshalling event %s: %v", envelope.EventName, err)
+			return err
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(envelope.Message.ConversationId),
+			Value: data,
+			Time:  envelope.CreatedAt,
+		})
+	}
+	if err := kp.writer.WriteMessages(ctx, msgs...); err != nil {
+		kp.log.Errorf("Error publishing %d events: %v", len(msgs), err)
+		return err
+	}
+	return nil
+}
+
+func (kp *KafkaPublisher) Close() {
+	if err := kp.writer.Close(); err != nil {
+		kp.log.Errorf("Error closing event writer: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+)
+
+// etag is the strong entity tag of a resource at version. variant tells the representations of
+// one resource apart, like the tree and the path view of a conversation, which share versions.
+func etag(version int, variant string) string {
+	if variant == "" {
+		return fmt.Sprintf(`"%d"`, version)
+	}
+	return fmt.Sprintf(`"%d-%s"`, version, variant)
+}
+
+// bodyTag is the weak entity tag of a representation without a version of its own, like a
+// list, derived from its content.
+func bodyTag(body any) string {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return ""
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// writeConditional answers a GET with body unless the client's copy, named by If-None-Match,
+// is still current, in which case only 304 is sent.
+func writeConditional(c *gin.Context, tag string, modified time.Time, body any) {
+	if tag == "" {
+		c.JSON(http.StatusOK, body)
+		return
+	}
+	c.Header("ETag", tag)
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if noneMatch := c.GetHeader("If-None-Match"); noneMatch != "" && tagListContains(noneMatch, tag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// tagListContains compares weakly, as If-None-Match requires.
+func tagListContains(list, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion reads the version an unsafe request is conditional on. ok is false when the
+// request has no If-Match, or If-Match is "*" and any version will do.
+func ifMatchVersion(c *gin.Context) (version int, ok bool, err error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return 0, false, nil
+	}
+	if strings.Contains(header, ",") || strings.HasPrefix(header, "W/") {
+		return 0, false, apperr.NewValidation("If-Match must be a single strong entity tag")
+	}
+	tag := strings.Trim(header, `"`)
+	if i := strings.IndexByte(tag, '-'); i >= 0 {
+		tag = tag[:i]
+	}
+	version, err = strconv.Atoi(tag)
+	if err != nil || version <= 0 {
+		return 0, false, apperr.NewValidation("If-Match %s is not an entity tag of this service", header)
+	}
+	return version, true, nil
+}
+
+// writePreconditionFailed answers a failed conditional request with the current representation,
+// so the client can redo its change without another round trip.
+func writePreconditionFailed(c *gin.Context, err error, tag string, current any) {
+	status := http.StatusPreconditionFailed
+	if tag != "" {
+		c.Header("ETag", tag)
+	}
+	c.Header("Content-Type", problemContentType)
+	c.AbortWithStatusJSON(status, Problem{
+		Type:     "urn:dhauli:problem:" + string(apperr.PreconditionFailed),
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   apperr.Detail(err),
+		Instance: c.Request.URL.Path,
+		Current:  current,
+	})
+}
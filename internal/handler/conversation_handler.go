@@ -1,13 +1,17 @@
 package handler
 
 import (
+	"context"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/internal/svc"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/logger"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"github.com/mangudaigb/dhauli-base/types/entities"
 )
 
 type UpdateType string
@@ -18,7 +22,8 @@ const (
 )
 
 type ConversationRequest struct {
-	UserID         string                 `json:"userId,omitempty" binding:"required"`
+	// UserID may be left out when the request is authenticated.
+	UserID         string                 `json:"userId,omitempty"`
 	WorkflowId     string                 `json:"workflowId,omitempty" binding:"required"`
 	SessionId      string                 `json:"sessionId,omitempty" binding:"required"`
 	ConversationId string                 `json:"conversationId,omitempty"`
@@ -41,71 +46,269 @@ func NewConversationHandler(log *logger.Logger, svc svc.ConversationService, iSv
 }
 
 func (ch *ConversationHandler) GetConversationsForUser(c *gin.Context) {
-	uid := c.Query("uid")
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
 	if uid == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
+		badRequest(c, "user ID is required")
 		return
 	}
 	docs, err := ch.svc.GetConversationList(c.Request.Context(), uid)
 	if err != nil {
 		ch.log.Errorf("Error getting conversation list for user %s: %v", uid, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		writeProblem(c, err)
+		return
+	}
+	var modified time.Time
+	for _, doc := range docs {
+		if doc.UpdatedAt.After(modified) {
+			modified = doc.UpdatedAt
+		}
 	}
-	c.JSON(http.StatusOK, docs)
+	writeConditional(c, bodyTag(docs), modified, docs)
 }
 
 func (ch *ConversationHandler) GetConversationById(c *gin.Context) {
 	id := c.Param("cid")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Interaction ID is required"})
+		badRequest(c, "interaction ID is required")
 		return
 	}
 
-	doc, err := ch.svc.GetConversationById(c.Request.Context(), id)
+	if c.Query("asOf") != "" || c.Query("version") != "" {
+		ch.getPastConversation(c, id)
+		return
+	}
+
+	var doc *dhauli.Conversation
+	var err error
+	variant := ""
+	if c.Query("view") == "tree" {
+		doc, err = ch.svc.GetConversationById(c.Request.Context(), id)
+		variant = "tree"
+	} else {
+		doc, err = ch.svc.GetConversationPath(c.Request.Context(), id, "")
+	}
 	if err != nil {
 		ch.log.Errorf("Error getting conversation %s: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		writeProblem(c, err)
+		return
+	}
+	writeConditional(c, etag(doc.Version, variant), doc.UpdatedAt, doc)
+}
+
+// getPastConversation answers with the whole tree of the conversation as it was at ?version or
+// at the RFC 3339 time ?asOf.
+func (ch *ConversationHandler) getPastConversation(c *gin.Context, id string) {
+	if raw := c.Query("version"); raw != "" {
+		version, err := strconv.Atoi(raw)
+		if err != nil {
+			badRequest(c, "version must be a number")
+			return
+		}
+		doc, err := ch.svc.GetConversationAtVersion(c.Request.Context(), id, version)
+		if err != nil {
+			ch.log.Errorf("Error getting version %d of conversation %s: %v", version, id, err)
+			writeProblem(c, err)
+			return
+		}
+		writeConditional(c, etag(doc.Version, "tree"), doc.UpdatedAt, doc)
+		return
+	}
+	asOf, err := timeParam(c, "asOf")
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	doc, err := ch.svc.GetConversationAsOf(c.Request.Context(), id, asOf)
+	if err != nil {
+		ch.log.Errorf("Error getting conversation %s as of %v: %v", id, asOf, err)
+		writeProblem(c, err)
+		return
+	}
+	writeConditional(c, etag(doc.Version, "tree"), doc.UpdatedAt, doc)
+}
+
+func (ch *ConversationHandler) GetBranches(c *gin.Context) {
+	id := c.Param("cid")
+	if id == "" {
+		badRequest(c, "conversation ID is required")
+		return
+	}
+	branches, err := ch.svc.ListBranches(c.Request.Context(), id)
+	if err != nil {
+		ch.log.Errorf("Error getting branches of conversation %s: %v", id, err)
+		writeProblem(c, err)
+		return
 	}
-	if doc == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+	writeConditional(c, bodyTag(branches), time.Time{}, branches)
+}
+
+func (ch *ConversationHandler) GetBranchPath(c *gin.Context) {
+	id := c.Param("cid")
+	iid := c.Param("iid")
+	if id == "" || iid == "" {
+		badRequest(c, "conversation ID and interaction ID are required")
+		return
+	}
+	doc, err := ch.svc.GetConversationPath(c.Request.Context(), id, iid)
+	if err != nil {
+		ch.log.Errorf("Error getting path to %s in conversation %s: %v", iid, id, err)
+		writeProblem(c, err)
+		return
+	}
+	writeConditional(c, etag(doc.Version, "path-"+iid), doc.UpdatedAt, doc)
+}
+
+func (ch *ConversationHandler) SwitchBranch(c *gin.Context) {
+	id := c.Param("cid")
+	iid := c.Param("iid")
+	if id == "" || iid == "" {
+		badRequest(c, "conversation ID and interaction ID are required")
+		return
+	}
+	if _, err := ch.svc.SwitchBranch(c.Request.Context(), id, iid); err != nil {
+		ch.log.Errorf("Error switching conversation %s to branch %s: %v", id, iid, err)
+		writeProblem(c, err)
+		return
+	}
+	doc, err := ch.svc.GetConversationPath(c.Request.Context(), id, "")
+	if err != nil {
+		writeProblem(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, doc)
 }
 
+// HoldConversation places the conversation under legal hold, which keeps retention and the trash
+// from purging it.
+func (ch *ConversationHandler) HoldConversation(c *gin.Context) {
+	ch.setLegalHold(c, true)
+}
+
+func (ch *ConversationHandler) ReleaseConversation(c *gin.Context) {
+	ch.setLegalHold(c, false)
+}
+
+func (ch *ConversationHandler) setLegalHold(c *gin.Context, hold bool) {
+	cid := c.Param("cid")
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	doc, err := ch.svc.SetLegalHold(svc.WithActor(c.Request.Context(), uid), cid, hold)
+	if err != nil {
+		ch.log.Errorf("Error setting legal hold of conversation %s to %v: %v", cid, hold, err)
+		writeProblem(c, err)
+		return
+	}
+	c.Header("ETag", etag(doc.Version, "tree"))
+	c.JSON(http.StatusOK, doc)
+}
+
+// GrantRequest is the body granting a role; Name is the display name of the grantee.
+type GrantRequest struct {
+	Role string `json:"role" binding:"required"`
+	Name string `json:"name,omitempty"`
+}
+
+// ShareConversation grants a role on the conversation to the user, group or tenant of the route,
+// as in PUT /conversations/:cid/acl/groups/:id, replacing what it was granted before.
+func (ch *ConversationHandler) ShareConversation(c *gin.Context) {
+	cid := c.Param("cid")
+	var req GrantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidBody(c, err)
+		return
+	}
+	grant, ok := grantOf(c, req.Name)
+	if !ok {
+		return
+	}
+	grant.Role = req.Role
+	ctx, ok := ch.conditional(c, cid)
+	if !ok {
+		return
+	}
+	doc, err := ch.svc.ShareConversation(ctx, cid, grant)
+	if err != nil {
+		ch.writeFailedWrite(c, cid, err)
+		return
+	}
+	c.Header("ETag", etag(doc.Version, "tree"))
+	c.JSON(http.StatusOK, doc)
+}
+
+// UnshareConversation revokes the role granted to the user, group or tenant of the route.
+func (ch *ConversationHandler) UnshareConversation(c *gin.Context) {
+	cid := c.Param("cid")
+	grant, ok := grantOf(c, "")
+	if !ok {
+		return
+	}
+	ctx, ok := ch.conditional(c, cid)
+	if !ok {
+		return
+	}
+	doc, err := ch.svc.UnshareConversation(ctx, cid, grant)
+	if err != nil {
+		ch.writeFailedWrite(c, cid, err)
+		return
+	}
+	c.Header("ETag", etag(doc.Version, "tree"))
+	c.JSON(http.StatusOK, doc)
+}
+
+// grantOf returns a grant for the grantee named by the :kind and :id of the route.
+func grantOf(c *gin.Context, name string) (dhauli.Grant, bool) {
+	id := c.Param("id")
+	var grant dhauli.Grant
+	switch c.Param("kind") {
+	case "users":
+		grant.User = &entities.UserStub{ID: id, Name: name}
+	case "groups":
+		grant.Group = &entities.GroupStub{ID: id, Name: name}
+	case "tenants":
+		grant.Tenant = &entities.TenantStub{ID: id, Name: name}
+	default:
+		badRequest(c, "conversations are shared with users, groups or tenants")
+		return grant, false
+	}
+	return grant, true
+}
+
 func (ch *ConversationHandler) CreateConversation(c *gin.Context) {
 	var req ConversationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		ch.log.Errorf("Error parsing request: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		invalidBody(c, err)
+		return
 	}
 
 	if req.Data.Query == "" {
 		ch.log.Errorf("Query is required to create a conversation")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Query is required"})
+		badRequest(c, "query is required")
 		return
 	}
-	cid := primitive.NewObjectID().Hex()
-	inter, err := ch.iSvc.CreateInteraction(c.Request.Context(), &dhauli.Interaction{
-		ID:             primitive.NewObjectID().Hex(),
-		WorkflowID:     req.WorkflowId,
-		SessionID:      req.SessionId,
-		ConversationID: cid,
-		Query:          req.Data.Query,
-	})
+	// the authenticated user owns the conversations they create
+	uid, err := caller(c, req.UserID)
 	if err != nil {
-		ch.log.Errorf("Error creating interaction: %v for conversations", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create interaction" + err.Error()})
+		writeProblem(c, err)
+		return
+	}
+	if uid == "" {
+		badRequest(c, "user ID is required")
 		return
 	}
-
 	conversation := dhauli.Conversation{
-		ID:         cid,
 		WorkflowID: req.WorkflowId,
 		SessionID:  req.SessionId,
+		UserID:     uid,
 		Interactions: []dhauli.InteractionStub{
 			{
-				ID:    inter.ID,
 				Query: req.Data.Query,
 			},
 		},
@@ -113,61 +316,178 @@ func (ch *ConversationHandler) CreateConversation(c *gin.Context) {
 	createdConversation, err := ch.svc.CreateConversation(c.Request.Context(), &conversation)
 	if err != nil {
 		ch.log.Errorf("Error creating conversation: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation" + err.Error()})
+		writeProblem(c, err)
 		return
 	}
 	c.JSON(http.StatusCreated, createdConversation)
 }
 
+// UpdateConversation honours If-Match: the update only applies while the conversation is
+// still at the tagged version.
 func (ch *ConversationHandler) UpdateConversation(c *gin.Context) {
 	conversationId := c.Param("cid")
 	if conversationId == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Conversation ID is required"})
+		badRequest(c, "conversation ID is required")
 		return
 	}
 	var req ConversationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		ch.log.Errorf("Error parsing request: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		invalidBody(c, err)
+		return
+	}
+	ctx, ok := ch.conditional(c, conversationId)
+	if !ok {
+		return
+	}
+	uid, err := caller(c, req.UserID)
+	if err != nil {
+		writeProblem(c, err)
+		return
 	}
+	ctx = svc.WithActor(ctx, uid)
 
-	var conversation *dhauli.Conversation
-	var err error
 	if req.UpdateType == Answer {
 		if req.Data.ID == "" {
 			ch.log.Errorf("Interaction ID is required")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Interaction ID is required"})
+			badRequest(c, "interaction ID is required")
 			return
 		}
-		conversation, err = ch.svc.UpdateInteractionAnswer(c.Request.Context(), conversationId, req.Data)
+		inter, err := ch.iSvc.GetInteractionById(ctx, req.Data.ID)
+		if err == nil && inter.ConversationID != conversationId {
+			err = apperr.NewNotFound("interaction %s not found in conversation %s", req.Data.ID, conversationId)
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update answer in conversation: " + err.Error()})
+			writeProblem(c, err)
 			return
 		}
-	} else if req.UpdateType == Query {
-		interactionStub := dhauli.InteractionStub{
-			ID:    primitive.NewObjectID().Hex(),
-			Query: req.Data.Query,
+		_, err = ch.iSvc.UpdateAnswerInInteraction(ctx, inter.ID, req.Data.Answer, uid, string(Answer), inter.Version)
+		if err != nil {
+			ch.writeFailedWrite(c, conversationId, err)
+			return
 		}
-		conversation, err = ch.svc.AddInteractionByConversationId(c.Request.Context(), conversationId, interactionStub)
+	} else if req.UpdateType == Query {
+		_, err := ch.iSvc.CreateInteraction(ctx, &dhauli.Interaction{
+			WorkflowID:     req.WorkflowId,
+			SessionID:      req.SessionId,
+			ConversationID: conversationId,
+			Query:          req.Data.Query,
+		})
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update answer in conversation: " + err.Error()})
+			ch.writeFailedWrite(c, conversationId, err)
 			return
 		}
 	}
 
+	conversation, err := ch.svc.GetConversationById(c.Request.Context(), conversationId)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	c.Header("ETag", etag(conversation.Version, "tree"))
 	c.JSON(http.StatusOK, conversation)
 }
 
+// DeleteConversation moves the conversation into the trash, on behalf of the caller or ?uid.
 func (ch *ConversationHandler) DeleteConversation(c *gin.Context) {
 	conversationId := c.Param("cid")
 	if conversationId == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Conversation ID is required"})
+		badRequest(c, "conversation ID is required")
+		return
+	}
+	ctx, ok := ch.conditional(c, conversationId)
+	if !ok {
+		return
+	}
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	err = ch.svc.DeleteConversation(svc.WithActor(ctx, uid), conversationId)
+	if err != nil {
+		ch.writeFailedWrite(c, conversationId, err)
+		return
+	}
+}
+
+func (ch *ConversationHandler) GetTrash(c *gin.Context) {
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	if uid == "" {
+		badRequest(c, "user ID is required")
+		return
+	}
+	docs, err := ch.svc.ListTrash(c.Request.Context(), uid)
+	if err != nil {
+		ch.log.Errorf("Error getting trash of user %s: %v", uid, err)
+		writeProblem(c, err)
+		return
+	}
+	writeConditional(c, bodyTag(docs), time.Time{}, docs)
+}
+
+func (ch *ConversationHandler) RestoreConversation(c *gin.Context) {
+	cid := c.Param("cid")
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		writeProblem(c, err)
 		return
 	}
-	err := ch.svc.DeleteConversation(c.Request.Context(), conversationId)
+	doc, err := ch.svc.RestoreConversation(svc.WithActor(c.Request.Context(), uid), cid)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete conversation: " + err.Error()})
+		ch.log.Errorf("Error restoring conversation %s: %v", cid, err)
+		writeProblem(c, err)
+		return
+	}
+	c.Header("ETag", etag(doc.Version, "tree"))
+	c.JSON(http.StatusOK, doc)
+}
+
+// PurgeConversation deletes a conversation in the trash for good.
+func (ch *ConversationHandler) PurgeConversation(c *gin.Context) {
+	cid := c.Param("cid")
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	if err := ch.svc.PurgeConversation(svc.WithActor(c.Request.Context(), uid), cid); err != nil {
+		ch.log.Errorf("Error purging conversation %s: %v", cid, err)
+		writeProblem(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// conditional makes the writes of conversation cid conditional on the version in If-Match.
+func (ch *ConversationHandler) conditional(c *gin.Context, cid string) (context.Context, bool) {
+	version, ok, err := ifMatchVersion(c)
+	if err != nil {
+		writeProblem(c, err)
+		return nil, false
+	}
+	if !ok {
+		return c.Request.Context(), true
+	}
+	return svc.WithIfMatch(c.Request.Context(), cid, version), true
+}
+
+// writeFailedWrite reports a failed write to conversation cid. When it failed on If-Match the
+// current conversation is sent along.
+func (ch *ConversationHandler) writeFailedWrite(c *gin.Context, cid string, err error) {
+	if apperr.KindOf(err) != apperr.PreconditionFailed {
+		ch.log.Errorf("Error writing conversation %s: %v", cid, err)
+		writeProblem(c, err)
+		return
+	}
+	current, getErr := ch.svc.GetConversationById(c.Request.Context(), cid)
+	if getErr != nil {
+		writeProblem(c, getErr)
 		return
 	}
+	writePreconditionFailed(c, err, etag(current.Version, "tree"), current)
 }
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+const defaultReplayLimit = 100
+
+type DeadLetterReplayer interface {
+	Replay(ctx context.Context, limit int) (int, error)
+}
+
+type DeadLetterHandler struct {
+	log      *logger.Logger
+	replayer DeadLetterReplayer
+}
+
+func NewDeadLetterHandler(log *logger.Logger, replayer DeadLetterReplayer) *DeadLetterHandler {
+	return &DeadLetterHandler{
+		log:      log,
+		replayer: replayer,
+	}
+}
+
+// Replay sends up to ?limit dead letters back to their topic.
+func (dh *DeadLetterHandler) Replay(c *gin.Context) {
+	limit := defaultReplayLimit
+	if raw := c.Query("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+			badRequest(c, "limit must be a positive number")
+			return
+		}
+	}
+	replayed, err := dh.replayer.Replay(c.Request.Context(), limit)
+	if err != nil {
+		dh.log.Errorf("Error replaying dead letters: %v", err)
+		writeProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"replayed": replayed})
+}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// HistoryPage is a page of history entries or other records listed oldest or newest first.
+type HistoryPage[T any] struct {
+	Items  []T   `json:"items"`
+	Total  int64 `json:"total"`
+	Offset int64 `json:"offset"`
+	Limit  int64 `json:"limit"`
+}
+
+type HistoryHandler struct {
+	log   *logger.Logger
+	iSvc  svc.InteractionService
+	hSvc  svc.InteractionHistoryService
+	chSvc svc.ConversationHistoryService
+}
+
+func NewHistoryHandler(log *logger.Logger, iSvc svc.InteractionService, hSvc svc.InteractionHistoryService, chSvc svc.ConversationHistoryService) *HistoryHandler {
+	return &HistoryHandler{
+		log:   log,
+		iSvc:  iSvc,
+		hSvc:  hSvc,
+		chSvc: chSvc,
+	}
+}
+
+// GetHistory lists the history of an interaction oldest first. It is filtered by ?actor, ?action
+// and the RFC 3339 times ?from and ?to, and paged by ?offset and ?limit.
+func (hh *HistoryHandler) GetHistory(c *gin.Context) {
+	iid := c.Param("iid")
+	query, ok := historyQuery(c)
+	if !ok {
+		return
+	}
+	items, total, err := hh.hSvc.ListHistory(c.Request.Context(), iid, query)
+	if err != nil {
+		hh.log.Errorf("Error listing history of interaction %s: %v", iid, err)
+		writeProblem(c, err)
+		return
+	}
+	page := HistoryPage[*dhauli.InteractionHistory]{Items: items, Total: total, Offset: query.Offset, Limit: query.Limit}
+	writeConditional(c, bodyTag(page), time.Time{}, page)
+}
+
+// GetConversationHistory lists the history of a conversation, filtered and paged like GetHistory.
+func (hh *HistoryHandler) GetConversationHistory(c *gin.Context) {
+	cid := c.Param("cid")
+	query, ok := historyQuery(c)
+	if !ok {
+		return
+	}
+	items, total, err := hh.chSvc.ListHistory(c.Request.Context(), cid, query)
+	if err != nil {
+		hh.log.Errorf("Error listing history of conversation %s: %v", cid, err)
+		writeProblem(c, err)
+		return
+	}
+	page := HistoryPage[*dhauli.ConversationHistory]{Items: items, Total: total, Offset: query.Offset, Limit: query.Limit}
+	writeConditional(c, bodyTag(page), time.Time{}, page)
+}
+
+func (hh *HistoryHandler) GetConversationHistoryEntry(c *gin.Context) {
+	cid, hid := c.Param("cid"), c.Param("hid")
+	entry, err := hh.chSvc.GetConversationHistoryById(c.Request.Context(), hid)
+	if err == nil && entry.ConversationID != cid {
+		err = apperr.NewNotFound("conversation history %s not found", hid)
+	}
+	if err != nil {
+		hh.log.Errorf("Error getting history %s of conversation %s: %v", hid, cid, err)
+		writeProblem(c, err)
+		return
+	}
+	writeConditional(c, etag(entry.Version, entry.ID), entry.CreatedAt, entry)
+}
+
+func historyQuery(c *gin.Context) (svc.HistoryQuery, bool) {
+	query := svc.HistoryQuery{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+	}
+	var err error
+	if query.From, err = timeParam(c, "from"); err != nil {
+		writeProblem(c, err)
+		return query, false
+	}
+	if query.To, err = timeParam(c, "to"); err != nil {
+		writeProblem(c, err)
+		return query, false
+	}
+	var ok bool
+	query.Offset, query.Limit, ok = pageQuery(c)
+	return query, ok
+}
+
+// pageQuery reads ?offset and ?limit.
+func pageQuery(c *gin.Context) (offset, limit int64, ok bool) {
+	limit = defaultHistoryLimit
+	var err error
+	if raw := c.Query("offset"); raw != "" {
+		if offset, err = strconv.ParseInt(raw, 10, 64); err != nil || offset < 0 {
+			badRequest(c, "offset must be a non-negative number")
+			return 0, 0, false
+		}
+	}
+	if raw := c.Query("limit"); raw != "" {
+		if limit, err = strconv.ParseInt(raw, 10, 64); err != nil || limit <= 0 || limit > maxHistoryLimit {
+			badRequest(c, "limit must be a number between 1 and %d", maxHistoryLimit)
+			return 0, 0, false
+		}
+	}
+	return offset, limit, true
+}
+
+func (hh *HistoryHandler) GetHistoryEntry(c *gin.Context) {
+	iid, hid := c.Param("iid"), c.Param("hid")
+	entry, err := hh.hSvc.GetInteractionHistoryById(c.Request.Context(), hid)
+	if err == nil && entry.InteractionID != iid {
+		err = apperr.NewNotFound("interaction history %s not found", hid)
+	}
+	if err != nil {
+		hh.log.Errorf("Error getting history %s of interaction %s: %v", hid, iid, err)
+		writeProblem(c, err)
+		return
+	}
+	// history entries never change
+	writeConditional(c, etag(entry.Version, entry.ID), entry.CreatedAt, entry)
+}
+
+// GetDiff answers with unified diffs of the interaction between the versions ?from and ?to, which
+// defaults to the current version.
+func (hh *HistoryHandler) GetDiff(c *gin.Context) {
+	iid := c.Param("iid")
+	from, err := strconv.Atoi(c.Query("from"))
+	if err != nil || from <= 0 {
+		badRequest(c, "from must be a version number")
+		return
+	}
+	var to int
+	if raw := c.Query("to"); raw != "" {
+		if to, err = strconv.Atoi(raw); err != nil || to <= 0 {
+			badRequest(c, "to must be a version number")
+			return
+		}
+	} else {
+		current, err := hh.iSvc.GetInteractionById(c.Request.Context(), iid)
+		if err != nil {
+			writeProblem(c, err)
+			return
+		}
+		to = current.Version
+	}
+	diff, err := hh.iSvc.DiffInteractionVersions(c.Request.Context(), iid, from, to)
+	if err != nil {
+		hh.log.Errorf("Error diffing versions %d and %d of interaction %s: %v", from, to, iid, err)
+		writeProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+func timeParam(c *gin.Context, name string) (time.Time, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, apperr.NewValidation("%s must be an RFC 3339 timestamp", name)
+	}
+	return t, nil
+}
@@ -1,9 +1,16 @@
 package handler
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/internal/svc"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/logger"
@@ -26,61 +33,123 @@ type InteractionRequest struct {
 	Action         string `json:"action,omitempty"`
 	Type           Type   `json:"type"`
 	Data           string `json:"data"`
+	Final          bool   `json:"final,omitempty"`
+	Model          string `json:"model,omitempty"`
 	Version        int    `json:"version,omitempty"`
+	// Merge asks for a context edit based on a stale version to be merged instead of rejected.
+	Merge bool `json:"merge,omitempty"`
+	// HistoryId names the history entry to revert to.
+	HistoryId string `json:"historyId,omitempty"`
+	// Seq numbers the chunks of a streamed answer from 1, see ChunkRequest.
+	Seq int `json:"seq,omitempty"`
+	// Cascade deletes the interactions following the deleted one too, instead of moving them up.
+	Cascade bool `json:"cascade,omitempty"`
+}
+
+type AnswerRequest struct {
+	Text     string         `json:"text" binding:"required"`
+	Actor    string         `json:"actor,omitempty"`
+	Model    string         `json:"model,omitempty"`
+	Metadata map[string]any `json:"metadata,omitempty"`
+	Select   bool           `json:"select,omitempty"`
+}
+
+type SelectAnswerRequest struct {
+	Actor string `json:"actor,omitempty"`
+}
+
+type RevertRequest struct {
+	HistoryId string `json:"historyId" binding:"required"`
+	Actor     string `json:"actor,omitempty"`
+}
+
+type UndoRequest struct {
+	Actor string `json:"actor,omitempty"`
+}
+
+// ChunkRequest is a chunk of a streamed answer. Seq numbers the chunks of the answer from 1 so
+// retried chunks are recognised; without it chunks are taken in the order they arrive.
+type ChunkRequest struct {
+	Seq   int    `json:"seq,omitempty"`
+	Delta string `json:"delta"`
+	Actor string `json:"actor,omitempty"`
+	Model string `json:"model,omitempty"`
+	Final bool   `json:"final,omitempty"`
 }
 
 type InteractionHandler struct {
 	log  *logger.Logger
 	iSvc svc.InteractionService
+	sSvc svc.StreamService
 }
 
-func NewInteractionHandler(log *logger.Logger, svc svc.InteractionService) *InteractionHandler {
+func NewInteractionHandler(log *logger.Logger, svc svc.InteractionService, sSvc svc.StreamService) *InteractionHandler {
 	return &InteractionHandler{
 		log:  log,
 		iSvc: svc,
+		sSvc: sSvc,
 	}
 }
 
 func (ch *InteractionHandler) GetInteractionsForConversation(c *gin.Context) {
 	cid := c.Param("cid")
 	if cid == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Conversation ID is required"})
+		badRequest(c, "conversation ID is required")
 		return
 	}
 	interactions, err := ch.iSvc.GetInteractionByConversationId(c.Request.Context(), cid)
 	if err != nil {
 		ch.log.Errorf("Error getting interactions for conversation id %s: %v", cid, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		writeProblem(c, err)
+		return
 	}
-	c.JSON(http.StatusOK, interactions)
+	var modified time.Time
+	for _, in := range interactions {
+		if in.UpdatedAt.After(modified) {
+			modified = in.UpdatedAt
+		}
+	}
+	writeConditional(c, bodyTag(interactions), modified, interactions)
 }
 
 func (ch *InteractionHandler) GetInteractionById(c *gin.Context) {
-	id := c.Param("id")
+	id := c.Param("iid")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Interaction ID is required"})
+		badRequest(c, "interaction ID is required")
 		return
 	}
 
-	doc, err := ch.iSvc.GetInteractionById(c.Request.Context(), id)
+	asOf, err := timeParam(c, "asOf")
 	if err != nil {
-		ch.log.Errorf("Error getting conversation %s: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		writeProblem(c, err)
+		return
+	}
+	if !asOf.IsZero() {
+		doc, err := ch.iSvc.GetInteractionAsOf(c.Request.Context(), id, asOf)
+		if err != nil {
+			ch.log.Errorf("Error getting interaction %s as of %v: %v", id, asOf, err)
+			writeProblem(c, err)
+			return
+		}
+		writeConditional(c, bodyTag(doc), time.Time{}, doc)
 		return
 	}
 
-	if doc == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Interaction not found"})
+	doc, err := ch.iSvc.GetInteractionById(c.Request.Context(), id)
+	if err != nil {
+		ch.log.Errorf("Error getting conversation %s: %v", id, err)
+		writeProblem(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, doc)
+	writeConditional(c, etag(doc.Version, ""), doc.UpdatedAt, doc)
 }
 
 func (ch *InteractionHandler) CreateInteraction(c *gin.Context) {
 	var req InteractionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		ch.log.Errorf("Error parsing request: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		invalidBody(c, err)
+		return
 	}
 	interaction := dhauli.Interaction{
 		WorkflowID:     req.WorkflowId,
@@ -96,58 +165,333 @@ func (ch *InteractionHandler) CreateInteraction(c *gin.Context) {
 	}
 	createdInteraction, err := ch.iSvc.CreateInteraction(c.Request.Context(), &interaction)
 	if err != nil {
-		ch.log.Errorf("Error creating conversation: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation" + err.Error()})
+		ch.log.Errorf("Error creating interaction: %v", err)
+		writeProblem(c, err)
 		return
 	}
-	//iStub := dhauli.InteractionStub{
-	//	ID:     createdInteraction.ID,
-	//	Query:  createdInteraction.Query,
-	//	Answer: createdInteraction.Answer,
-	//}
-	//_, err = ch.cSvc.AddInteractionByConversationId(c.Request.Context(), createdInteraction.ConversationID, iStub)
-	//if err != nil {
-	//	ch.log.Errorf("Error adding interaction to conversation: %v", err)
-	//}
-
 	c.JSON(http.StatusCreated, createdInteraction)
 }
 
+// UpdateInteraction applies the edit only while the interaction is at the version given by
+// If-Match or, for older clients, in the body. Without either the edit is unconditional.
 func (ch *InteractionHandler) UpdateInteraction(c *gin.Context) {
 	iid := c.Param("iid")
 	if iid == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Interaction ID is required"})
+		badRequest(c, "interaction ID is required")
 		return
 	}
 	var req InteractionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		ch.log.Errorf("Error parsing request: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		invalidBody(c, err)
+		return
 	}
 	if req.InteractionId == "" {
 		ch.log.Errorf("Interaction ID is required")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Interaction ID is required"})
+		badRequest(c, "interaction ID is required")
+		return
+	}
+	version, ok, err := ifMatchVersion(c)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	if ok {
+		req.Version = version
+	}
+	actor, err := writer(c, req.Actor)
+	if err != nil {
+		writeProblem(c, err)
+		return
 	}
 	var in *dhauli.Interaction
-	var err error
-	if req.Type == CONTEXT {
-		in, err = ch.iSvc.UpdateContextInInteraction(c.Request.Context(), iid, req.Data, req.Actor, req.Action, req.Version)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update context in interaction: " + err.Error()})
-			return
-		}
+	if req.Type == CONTEXT && req.Merge {
+		in, err = ch.iSvc.MergeContextInInteraction(c.Request.Context(), iid, req.Data, actor, req.Action, req.Version)
+	} else if req.Type == CONTEXT {
+		in, err = ch.iSvc.UpdateContextInInteraction(c.Request.Context(), iid, req.Data, actor, req.Action, req.Version)
 	} else if req.Type == ANSWER {
-		in, err = ch.iSvc.UpdateAnswerInInteraction(c.Request.Context(), iid, req.Data, req.Actor, req.Action, req.Version)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update answer in interaction: " + err.Error()})
+		in, err = ch.iSvc.UpdateAnswerInInteraction(c.Request.Context(), iid, req.Data, actor, req.Action, req.Version)
+	} else {
+		in, err = ch.iSvc.UpdateQueryInInteraction(c.Request.Context(), iid, req.Data, actor, req.Action, req.Version)
+	}
+	if err != nil {
+		ch.writeFailedWrite(c, iid, err)
+		return
+	}
+	c.Header("ETag", etag(in.Version, ""))
+	c.JSON(http.StatusOK, in)
+}
+
+// RevertInteraction restores the interaction from one of its history entries. Like every write it
+// honours If-Match.
+func (ch *InteractionHandler) RevertInteraction(c *gin.Context) {
+	iid := c.Param("iid")
+	var req RevertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		invalidBody(c, err)
+		return
+	}
+	version, _, err := ifMatchVersion(c)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	actor, err := writer(c, req.Actor)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	in, err := ch.iSvc.RevertInteraction(c.Request.Context(), iid, req.HistoryId, actor, version)
+	if err != nil {
+		ch.writeFailedWrite(c, iid, err)
+		return
+	}
+	c.Header("ETag", etag(in.Version, ""))
+	c.JSON(http.StatusOK, in)
+}
+
+func (ch *InteractionHandler) UndoInteraction(c *gin.Context) {
+	ch.step(c, ch.iSvc.UndoInteraction)
+}
+
+func (ch *InteractionHandler) RedoInteraction(c *gin.Context) {
+	ch.step(c, ch.iSvc.RedoInteraction)
+}
+
+func (ch *InteractionHandler) step(c *gin.Context, step func(ctx context.Context, iid, actor string, version int) (*dhauli.Interaction, error)) {
+	iid := c.Param("iid")
+	var req UndoRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			invalidBody(c, err)
 			return
 		}
-	} else {
-		in, err = ch.iSvc.UpdateQueryInInteraction(c.Request.Context(), iid, req.Data, req.Actor, req.Action, req.Version)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update context in interaction: " + err.Error()})
+	}
+	version, _, err := ifMatchVersion(c)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	actor, err := writer(c, req.Actor)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	in, err := step(c.Request.Context(), iid, actor, version)
+	if err != nil {
+		ch.writeFailedWrite(c, iid, err)
+		return
+	}
+	c.Header("ETag", etag(in.Version, ""))
+	c.JSON(http.StatusOK, in)
+}
+
+// DeleteInteraction deletes the interaction. The interactions following it move up to its parent,
+// or with ?cascade=true are deleted along with it. With If-Match it is deleted only at that version.
+func (ch *InteractionHandler) DeleteInteraction(c *gin.Context) {
+	iid := c.Param("iid")
+	cascade := false
+	if raw := c.Query("cascade"); raw != "" {
+		var err error
+		if cascade, err = strconv.ParseBool(raw); err != nil {
+			badRequest(c, "cascade must be true or false")
 			return
 		}
 	}
+	ctx := c.Request.Context()
+	if version, ok, err := ifMatchVersion(c); err != nil {
+		writeProblem(c, err)
+		return
+	} else if ok {
+		ctx = svc.WithIfMatch(ctx, iid, version)
+	}
+	if err := ch.iSvc.DeleteInteraction(ctx, iid, cascade); err != nil {
+		ch.writeFailedWrite(c, iid, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// writer returns the caller as the actor recorded for a write. An actor named in the body has to
+// be the caller.
+func writer(c *gin.Context, claimed string) (string, error) {
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		return "", err
+	}
+	if claimed != "" && claimed != uid {
+		return "", apperr.NewForbidden("user %s cannot act as user %s", uid, claimed)
+	}
+	return uid, nil
+}
+
+// writeFailedWrite reports a failed write to interaction iid. When it failed on its version
+// the current interaction is sent along.
+func (ch *InteractionHandler) writeFailedWrite(c *gin.Context, iid string, err error) {
+	var mergeConflict *svc.MergeConflictError
+	if errors.As(err, &mergeConflict) {
+		writeMergeConflict(c, mergeConflict)
+		return
+	}
+	if apperr.KindOf(err) != apperr.PreconditionFailed {
+		ch.log.Errorf("Error writing interaction %s: %v", iid, err)
+		writeProblem(c, err)
+		return
+	}
+	current, getErr := ch.iSvc.GetInteractionById(c.Request.Context(), iid)
+	if getErr != nil {
+		writeProblem(c, getErr)
+		return
+	}
+	writePreconditionFailed(c, err, etag(current.Version, ""), current)
+}
+
+func (ch *InteractionHandler) RegenerateInteraction(c *gin.Context) {
+	iid := c.Param("iid")
+	if iid == "" {
+		badRequest(c, "interaction ID is required")
+		return
+	}
+	in, err := ch.iSvc.ForkInteraction(c.Request.Context(), iid, "", "", svc.RegenerateAction)
+	if err != nil {
+		ch.log.Errorf("Error regenerating interaction %s: %v", iid, err)
+		writeProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, in)
+}
+
+func (ch *InteractionHandler) AddAnswer(c *gin.Context) {
+	iid := c.Param("iid")
+	if iid == "" {
+		badRequest(c, "interaction ID is required")
+		return
+	}
+	var req AnswerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ch.log.Errorf("Error parsing request: %v", err)
+		invalidBody(c, err)
+		return
+	}
+	actor, err := writer(c, req.Actor)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	candidate := dhauli.AnswerCandidate{
+		Text:     req.Text,
+		Actor:    actor,
+		Model:    req.Model,
+		Metadata: req.Metadata,
+	}
+	in, err := ch.iSvc.AddAnswerToInteraction(c.Request.Context(), iid, candidate, req.Select)
+	if err != nil {
+		ch.log.Errorf("Error adding answer to interaction %s: %v", iid, err)
+		writeProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, in)
+}
+
+func (ch *InteractionHandler) SelectAnswer(c *gin.Context) {
+	iid := c.Param("iid")
+	aid := c.Param("aid")
+	if iid == "" || aid == "" {
+		badRequest(c, "interaction ID and answer ID are required")
+		return
+	}
+	var req SelectAnswerRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		ch.log.Errorf("Error parsing request: %v", err)
+		invalidBody(c, err)
+		return
+	}
+	actor, err := writer(c, req.Actor)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	in, err := ch.iSvc.SelectAnswerInInteraction(c.Request.Context(), iid, aid, actor)
+	if err != nil {
+		ch.log.Errorf("Error selecting answer %s of interaction %s: %v", aid, iid, err)
+		writeProblem(c, err)
+		return
+	}
 	c.JSON(http.StatusOK, in)
 }
+
+func (ch *InteractionHandler) AppendAnswerChunk(c *gin.Context) {
+	iid := c.Param("iid")
+	if iid == "" {
+		badRequest(c, "interaction ID is required")
+		return
+	}
+	var req ChunkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ch.log.Errorf("Error parsing request: %v", err)
+		invalidBody(c, err)
+		return
+	}
+	actor, err := writer(c, req.Actor)
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	chunk, in, err := ch.sSvc.Append(c.Request.Context(), iid, req.Seq, req.Delta, actor, req.Model, req.Final)
+	if err != nil {
+		ch.log.Errorf("Error appending answer chunk to interaction %s: %v", iid, err)
+		writeProblem(c, err)
+		return
+	}
+	if in != nil {
+		c.JSON(http.StatusOK, in)
+		return
+	}
+	c.JSON(http.StatusAccepted, chunk)
+}
+
+// StreamAnswer delivers the answer of an interaction as Server-Sent Events. Buffered chunks are
+// replayed first; the Last-Event-ID header resumes after the given sequence.
+func (ch *InteractionHandler) StreamAnswer(c *gin.Context) {
+	iid := c.Param("iid")
+	if iid == "" {
+		badRequest(c, "interaction ID is required")
+		return
+	}
+	afterSeq, _ := strconv.Atoi(c.GetHeader("Last-Event-ID"))
+	chunks, err := ch.sSvc.Subscribe(c.Request.Context(), iid, afterSeq)
+	if err != nil {
+		ch.log.Errorf("Error subscribing to answer of interaction %s: %v", iid, err)
+		writeProblem(c, err)
+		return
+	}
+
+	// The server write timeout is meant for regular requests, not for streams.
+	if err = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		ch.log.Errorf("Error clearing write deadline for answer stream: %v", err)
+	}
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return false
+			}
+			event := "chunk"
+			if chunk.Final {
+				event = "final"
+			}
+			c.Render(-1, sse.Event{
+				Id:    strconv.Itoa(chunk.Seq),
+				Event: event,
+				Data:  chunk,
+			})
+			return !chunk.Final
+		case <-keepAlive.C:
+			_, _ = io.WriteString(w, ": keep-alive\n\n")
+			return true
+		}
+	})
+}
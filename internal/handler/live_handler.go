@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/conversation-service/internal/ws"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+const livePingInterval = 30 * time.Second
+
+type LiveMessageType string
+
+const (
+	LiveSubscribe    LiveMessageType = "subscribe"
+	LiveUnsubscribe  LiveMessageType = "unsubscribe"
+	LiveSubscribed   LiveMessageType = "subscribed"
+	LiveUnsubscribed LiveMessageType = "unsubscribed"
+	LiveEvent        LiveMessageType = "event"
+	LiveError        LiveMessageType = "error"
+)
+
+// LiveRequest is sent by the client. Since maps a conversation id to the last sequence the
+// client has seen; the changes after it are replayed before live delivery starts.
+type LiveRequest struct {
+	Type            LiveMessageType  `json:"type"`
+	ConversationIds []string         `json:"conversationIds"`
+	Since           map[string]int64 `json:"since,omitempty"`
+}
+
+type LiveResponse struct {
+	Type            LiveMessageType     `json:"type"`
+	ConversationIds []string            `json:"conversationIds,omitempty"`
+	ConversationId  string              `json:"conversationId,omitempty"`
+	Event           *dhauli.ChangeEvent `json:"event,omitempty"`
+	Error           string              `json:"error,omitempty"`
+}
+
+type LiveHandler struct {
+	log       *logger.Logger
+	cSvc      svc.ConversationService
+	changeSvc svc.ChangeService
+	upgrader  ws.Upgrader
+}
+
+// NewLiveHandler accepts live connections from pages of the service's own host and of origins.
+func NewLiveHandler(log *logger.Logger, cSvc svc.ConversationService, changeSvc svc.ChangeService, origins []string) *LiveHandler {
+	return &LiveHandler{
+		log:       log,
+		cSvc:      cSvc,
+		changeSvc: changeSvc,
+		upgrader:  ws.Upgrader{Origins: origins, Subprotocols: []string{AccessTokenProtocol}},
+	}
+}
+
+// liveSession is the state of one WebSocket connection. It is only touched by the goroutine
+// running Subscribe, which is also the only writer of data frames.
+type liveSession struct {
+	ctx  context.Context
+	uid  string
+	conn *ws.Conn
+	sub  *svc.ChangeSubscription
+	// conversations holds the subscribed ids, last the sequence delivered for those where it is known.
+	conversations map[string]bool
+	last          map[string]int64
+}
+
+func (s *liveSession) drop(cid string) {
+	s.sub.Remove(cid)
+	delete(s.conversations, cid)
+	delete(s.last, cid)
+}
+
+// Subscribe upgrades the request to a WebSocket over which the caller, or the user given by uid, subscribes
+// to changes of the conversations they may view. Every event carries the per-conversation sequence; gaps,
+// for example after a peer instance missed a forward, are filled from the change log. Browsers, which cannot
+// set the Authorization header, offer the subprotocols "access_token" and their token instead.
+func (lh *LiveHandler) Subscribe(c *gin.Context) {
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		writeProblem(c, err)
+		return
+	}
+	if uid == "" {
+		badRequest(c, "user ID is required")
+		return
+	}
+	conn, err := lh.upgrader.Upgrade(c.Writer, c.Request)
+	if err != nil {
+		lh.log.Errorf("Error upgrading live connection of user %s: %v", uid, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	requests := make(chan LiveRequest)
+	go func() {
+		defer cancel()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req LiveRequest
+			if err = json.Unmarshal(data, &req); err != nil {
+				_ = conn.WriteClose(ws.CloseProtocolError, "invalid request")
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	session := &liveSession{
+		ctx:           svc.WithActor(ctx, uid),
+		uid:           uid,
+		conn:          conn,
+		sub:           lh.changeSvc.Subscribe(),
+		conversations: make(map[string]bool),
+		last:          make(map[string]int64),
+	}
+	defer func() { session.sub.Close() }()
+
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			_ = conn.WriteClose(ws.CloseGoingAway, "")
+			return
+		case <-ping.C:
+			err = conn.WriteMessage(ws.PingMessage, nil)
+		case req := <-requests:
+			err = lh.handleRequest(session, req)
+		case change, ok := <-session.sub.Events():
+			if !ok {
+				err = lh.resubscribe(session)
+			} else {
+				err = lh.deliver(session, change)
+			}
+		}
+		if err != nil {
+			lh.log.Errorf("Closing live connection of user %s: %v", uid, err)
+			return
+		}
+	}
+}
+
+func (lh *LiveHandler) handleRequest(s *liveSession, req LiveRequest) error {
+	switch req.Type {
+	case LiveSubscribe:
+		var subscribed []string
+		for _, cid := range req.ConversationIds {
+			_, err := lh.cSvc.GetConversationById(s.ctx, cid)
+			if err == nil {
+				err = lh.cSvc.Authorize(s.ctx, cid, dhauli.RoleViewer)
+			}
+			if err != nil {
+				if err := lh.send(s, LiveResponse{Type: LiveError, ConversationId: cid, Error: "Conversation not found"}); err != nil {
+					return err
+				}
+				continue
+			}
+			s.sub.Add(cid)
+			s.conversations[cid] = true
+			subscribed = append(subscribed, cid)
+			if seq, ok := req.Since[cid]; ok {
+				s.last[cid] = seq
+				if err = lh.catchUp(s, cid); err != nil {
+					return err
+				}
+			} else {
+				delete(s.last, cid)
+			}
+		}
+		return lh.send(s, LiveResponse{Type: LiveSubscribed, ConversationIds: subscribed})
+	case LiveUnsubscribe:
+		for _, cid := range req.ConversationIds {
+			s.drop(cid)
+		}
+		return lh.send(s, LiveResponse{Type: LiveUnsubscribed, ConversationIds: req.ConversationIds})
+	default:
+		return lh.send(s, LiveResponse{Type: LiveError, Error: "Unknown request type"})
+	}
+}
+
+// deliver sends a live change unless the client already has it. Without a known sequence for
+// the conversation the first change establishes it.
+func (lh *LiveHandler) deliver(s *liveSession, change dhauli.ChangeEvent) error {
+	last, known := s.last[change.ConversationID]
+	if known && change.Seq <= last {
+		return nil
+	}
+	if known && change.Seq > last+1 {
+		return lh.catchUp(s, change.ConversationID)
+	}
+	return lh.sendChange(s, change)
+}
+
+func (lh *LiveHandler) catchUp(s *liveSession, cid string) error {
+	for s.conversations[cid] {
+		changes, err := lh.changeSvc.Since(s.ctx, cid, s.last[cid])
+		if err != nil {
+			return lh.send(s, LiveResponse{Type: LiveError, ConversationId: cid, Error: "Could not replay changes"})
+		}
+		for _, change := range changes {
+			if err = lh.sendChange(s, *change); err != nil {
+				return err
+			}
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// sendChange sends a change while the user may still view its conversation, which is checked
+// again for every change so a revoked grant ends the subscription. The change removing the
+// conversation is the last one sent for it.
+func (lh *LiveHandler) sendChange(s *liveSession, change dhauli.ChangeEvent) error {
+	cid := change.ConversationID
+	removed := change.Type == contracts.ConversationChangeDeleted || change.Type == contracts.ConversationChangeTrashed
+	if !removed {
+		if err := lh.cSvc.Authorize(s.ctx, cid, dhauli.RoleViewer); err != nil {
+			lh.log.Infof("Dropping live subscription of user %s to conversation %s: %v", s.uid, cid, err)
+			s.drop(cid)
+			return lh.send(s, LiveResponse{Type: LiveUnsubscribed, ConversationIds: []string{cid}})
+		}
+	}
+	s.last[cid] = change.Seq
+	if err := lh.send(s, LiveResponse{Type: LiveEvent, Event: &change}); err != nil {
+		return err
+	}
+	if removed {
+		s.drop(cid)
+	}
+	return nil
+}
+
+// resubscribe replaces a subscription that was dropped for falling behind and replays what the
+// client missed in the meantime.
+func (lh *LiveHandler) resubscribe(s *liveSession) error {
+	s.sub = lh.changeSvc.Subscribe()
+	for cid := range s.conversations {
+		s.sub.Add(cid)
+	}
+	for cid := range s.last {
+		if err := lh.catchUp(s, cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lh *LiveHandler) send(s *liveSession, resp LiveResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(ws.TextMessage, data)
+}
+
+// DeliverChanges accepts changes forwarded by a peer instance.
+func (lh *LiveHandler) DeliverChanges(c *gin.Context) {
+	var changes []dhauli.ChangeEvent
+	if err := c.ShouldBindJSON(&changes); err != nil {
+		invalidBody(c, err)
+		return
+	}
+	lh.changeSvc.Deliver(changes)
+	c.Status(http.StatusAccepted)
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/auth"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/conversation-service/internal/ws"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const CorrelationIdHeader = "X-Correlation-Id"
+
+// Headers naming the caller, set by the gateway in front of the service.
+const (
+	OrganizationIdHeader = "X-Organization-Id"
+	TenantIdHeader       = "X-Tenant-Id"
+	GroupIdHeader        = "X-Group-Id"
+	UserIdHeader         = "X-User-Id"
+)
+
+// CorrelationId carries the caller's correlation id, or a fresh one, into the request context so
+// the domain events of the request can be traced back to it.
+func CorrelationId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		correlationId := c.GetHeader(CorrelationIdHeader)
+		if correlationId == "" {
+			correlationId = primitive.NewObjectID().Hex()
+		}
+		c.Header(CorrelationIdHeader, correlationId)
+		c.Request = c.Request.WithContext(svc.WithCorrelationId(c.Request.Context(), correlationId))
+		c.Next()
+	}
+}
+
+// Identity makes the caller named by the identity headers the principal of the request, which
+// confines the request to the caller's tenant. A request without them is anonymous and only
+// reaches documents without a tenant. The identity is only claimed, so conversations shared with
+// it stay out of its reach.
+func Identity() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := &messaging.Principal{
+			Organization: entities.OrganizationStub{ID: c.GetHeader(OrganizationIdHeader)},
+			Tenant:       entities.TenantStub{ID: c.GetHeader(TenantIdHeader)},
+			Group:        entities.GroupStub{ID: c.GetHeader(GroupIdHeader)},
+			User:         entities.UserStub{ID: c.GetHeader(UserIdHeader)},
+		}
+		c.Request = c.Request.WithContext(svc.WithClaimedIdentity(svc.WithPrincipal(c.Request.Context(), principal)))
+		c.Next()
+	}
+}
+
+// AccessTokenProtocol is offered by browsers opening a WebSocket, which cannot set the
+// Authorization header, as the subprotocol before their bearer token.
+const AccessTokenProtocol = "access_token"
+
+// Authenticate requires a bearer token that verifier accepts, and makes the user it was issued to
+// the principal of the request in place of the identity headers.
+func Authenticate(log *logger.Logger, verifier *auth.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info, principal, ok := verify(c, log, verifier)
+		if !ok {
+			return
+		}
+		ctx := svc.WithAuthInfo(svc.WithPrincipal(c.Request.Context(), principal), info)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// AuthenticateAdmin is Authenticate for the admin routes, which act on the data of every tenant:
+// the user of the token does not become the principal, so the request is not confined to its
+// tenant. Only the scopes of the token are kept, for RequireScope.
+func AuthenticateAdmin(log *logger.Logger, verifier *auth.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info, _, ok := verify(c, log, verifier)
+		if !ok {
+			return
+		}
+		c.Request = c.Request.WithContext(svc.WithAuthInfo(c.Request.Context(), info))
+		c.Next()
+	}
+}
+
+// verify checks the bearer token of the request, answering the request when it is missing or
+// invalid.
+func verify(c *gin.Context, log *logger.Logger, verifier *auth.Verifier) (*messaging.AuthInfo, *messaging.Principal, bool) {
+	token := bearerToken(c.Request)
+	if token == "" {
+		c.Header("WWW-Authenticate", `Bearer`)
+		writeProblem(c, apperr.New(apperr.Unauthorized, "a bearer token is required"))
+		return nil, nil, false
+	}
+	info, principal, err := verifier.Verify(token)
+	if err != nil {
+		log.Infof("Rejected token for %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeProblem(c, err)
+		return nil, nil, false
+	}
+	return info, principal, true
+}
+
+// bearerToken returns the token of the Authorization header or, on a WebSocket upgrade, the
+// subprotocol following AccessTokenProtocol.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if !ws.IsUpgrade(r) {
+		return ""
+	}
+	protocols := ws.Subprotocols(r)
+	if i := slices.Index(protocols, AccessTokenProtocol); i >= 0 && i+1 < len(protocols) {
+		return protocols[i+1]
+	}
+	return ""
+}
+
+// RequireScope lets through only the requests whose token grants scope. It follows Authenticate.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info := svc.AuthInfoFromContext(c.Request.Context())
+		if info == nil || !slices.Contains(strings.Fields(info.Scopes), scope) {
+			c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			writeProblem(c, apperr.NewForbidden("the token does not grant %s", scope))
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSecret lets through only the requests bearing secret as their bearer token.
+func RequireSecret(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer`)
+			writeProblem(c, apperr.New(apperr.Unauthorized, "a valid bearer token is required"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// caller returns the user making the request: the principal when it names one, otherwise the user
+// the request claims to come from. A principal claiming to be another user is refused, and so is
+// an authenticated request naming no user, whatever it claims.
+func caller(c *gin.Context, claimed string) (string, error) {
+	ctx := c.Request.Context()
+	principal := svc.PrincipalFromContext(ctx)
+	if principal == nil || principal.User.ID == "" {
+		if svc.AuthInfoFromContext(ctx) != nil {
+			return "", apperr.New(apperr.Unauthorized, "the token names no user")
+		}
+		return claimed, nil
+	}
+	if claimed != "" && claimed != principal.User.ID {
+		return "", apperr.NewForbidden("user %s cannot act as user %s", principal.User.ID, claimed)
+	}
+	return principal.User.ID, nil
+}
+
+// Authorize lets through only the callers holding at least role on the conversation of the route.
+// The caller is the user of the principal or, without one, the user given by ?uid.
+func Authorize(cSvc svc.ConversationService, role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, err := acting(c)
+		if err == nil {
+			err = cSvc.Authorize(ctx, c.Param("cid"), role)
+		}
+		if err != nil {
+			writeProblem(c, err)
+			return
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// AuthorizeInteraction is Authorize for the interaction routes of a conversation. The interaction
+// named by the route must be part of the conversation.
+func AuthorizeInteraction(cSvc svc.ConversationService, role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cid, iid := c.Param("cid"), c.Param("iid")
+		ctx, err := acting(c)
+		if err == nil && iid == "" {
+			err = cSvc.Authorize(ctx, cid, role)
+		} else if err == nil {
+			var owner string
+			owner, err = cSvc.AuthorizeInteraction(ctx, iid, role)
+			if err == nil && owner != cid {
+				err = apperr.NewNotFound("interaction %s not found in conversation %s", iid, cid)
+			}
+		}
+		if err != nil {
+			writeProblem(c, err)
+			return
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// acting returns the request context with the caller as the actor. Anonymous callers are refused.
+func acting(c *gin.Context) (context.Context, error) {
+	uid, err := caller(c, c.Query("uid"))
+	if err != nil {
+		return nil, err
+	}
+	if uid == "" {
+		return nil, apperr.New(apperr.Unauthorized, "the caller must be identified")
+	}
+	return svc.WithActor(c.Request.Context(), uid), nil
+}
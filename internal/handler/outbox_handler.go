@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+type OutboxHandler struct {
+	log *logger.Logger
+	svc svc.OutboxService
+}
+
+func NewOutboxHandler(log *logger.Logger, svc svc.OutboxService) *OutboxHandler {
+	return &OutboxHandler{
+		log: log,
+		svc: svc,
+	}
+}
+
+// GetStats reports how far the event relay is behind. Relaying is only true on the instance
+// currently holding the relay lock.
+func (oh *OutboxHandler) GetStats(c *gin.Context) {
+	stats, err := oh.svc.Stats(c.Request.Context())
+	if err != nil {
+		oh.log.Errorf("Error getting outbox stats: %v", err)
+		writeProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
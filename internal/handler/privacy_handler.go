@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+type PrivacyHandler struct {
+	log *logger.Logger
+	svc svc.PrivacyService
+}
+
+func NewPrivacyHandler(log *logger.Logger, svc svc.PrivacyService) *PrivacyHandler {
+	return &PrivacyHandler{
+		log: log,
+		svc: svc,
+	}
+}
+
+// Export downloads everything stored about a user as a zip archive.
+func (ph *PrivacyHandler) Export(c *gin.Context) {
+	uid := c.Param("uid")
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", uid+"-export.zip"))
+	c.Status(http.StatusOK)
+	if _, err := ph.svc.Export(c.Request.Context(), uid, c.Writer); err != nil {
+		// the archive is already on its way, so all that is left is to cut it short
+		ph.log.Errorf("Error exporting data of user %s: %v", uid, err)
+		c.Abort()
+	}
+}
+
+// Erase erases everything stored about a user, by deleting it or with ?mode=anonymize by
+// anonymizing it, and answers with the signed report.
+func (ph *PrivacyHandler) Erase(c *gin.Context) {
+	uid := c.Param("uid")
+	report, err := ph.svc.Erase(c.Request.Context(), uid, c.Query("mode"))
+	if err != nil {
+		ph.log.Errorf("Error erasing data of user %s: %v", uid, err)
+		writeProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details body. Current is an extension member carrying the
+// current representation of the resource a conditional request failed on, Merge the report of
+// a merge that ran into conflicts.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Current  any    `json:"current,omitempty"`
+	Merge    any    `json:"merge,omitempty"`
+}
+
+// writeProblem answers with the problem details of err, its status given by the error kind.
+func writeProblem(c *gin.Context, err error) {
+	status := apperr.Status(err)
+	kind := apperr.KindOf(err)
+	c.Header("Content-Type", problemContentType)
+	c.AbortWithStatusJSON(status, Problem{
+		Type:     "urn:dhauli:problem:" + string(kind),
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   apperr.Detail(err),
+		Instance: c.Request.URL.Path,
+	})
+}
+
+func badRequest(c *gin.Context, format string, args ...any) {
+	writeProblem(c, apperr.NewValidation(format, args...))
+}
+
+// invalidBody reports a request body that could not be bound, naming what was wrong with it.
+func invalidBody(c *gin.Context, err error) {
+	writeProblem(c, apperr.NewValidation("invalid request: %v", err))
+}
+
+func writeMergeConflict(c *gin.Context, report *svc.MergeConflictError) {
+	status := http.StatusConflict
+	c.Header("Content-Type", problemContentType)
+	c.AbortWithStatusJSON(status, Problem{
+		Type:     "urn:dhauli:problem:" + string(apperr.Conflict),
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   apperr.Detail(report),
+		Instance: c.Request.URL.Path,
+		Merge:    report,
+	})
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+type RetentionHandler struct {
+	log *logger.Logger
+	svc svc.RetentionService
+}
+
+func NewRetentionHandler(log *logger.Logger, svc svc.RetentionService) *RetentionHandler {
+	return &RetentionHandler{
+		log: log,
+		svc: svc,
+	}
+}
+
+// Apply runs the retention rules now. With ?dryRun=true it only reports what they would expire.
+func (rh *RetentionHandler) Apply(c *gin.Context) {
+	dryRun := false
+	if raw := c.Query("dryRun"); raw != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(raw); err != nil {
+			badRequest(c, "dryRun must be true or false")
+			return
+		}
+	}
+	report, err := rh.svc.Apply(c.Request.Context(), dryRun)
+	if err != nil {
+		rh.log.Errorf("Error applying retention rules: %v", err)
+		writeProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// GetAudit lists the conversations expired by retention newest first, filtered by ?cid,
+// ?tenant, ?uid and ?rule and paged like the history.
+func (rh *RetentionHandler) GetAudit(c *gin.Context) {
+	query := svc.RetentionAuditQuery{
+		ConversationID: c.Query("cid"),
+		TenantID:       c.Query("tenant"),
+		UserID:         c.Query("uid"),
+		Rule:           c.Query("rule"),
+	}
+	var ok bool
+	if query.Offset, query.Limit, ok = pageQuery(c); !ok {
+		return
+	}
+	items, total, err := rh.svc.ListAudit(c.Request.Context(), query)
+	if err != nil {
+		rh.log.Errorf("Error listing retention audit: %v", err)
+		writeProblem(c, err)
+		return
+	}
+	page := HistoryPage[*dhauli.RetentionAudit]{Items: items, Total: total, Offset: query.Offset, Limit: query.Limit}
+	writeConditional(c, bodyTag(page), time.Time{}, page)
+}
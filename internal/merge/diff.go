@@ -0,0 +1,98 @@
+package merge
+
+import (
+	"fmt"
+	"strings"
+)
+
+// contextLines is the number of unchanged lines shown around every change of a unified diff.
+const contextLines = 3
+
+type edit struct {
+	kind byte
+	line string
+	// a and b are the 0-based positions in both texts before the edit
+	a, b int
+}
+
+// Unified returns the unified diff turning a into b, labelled fromName and toName, or an empty
+// string when both are the same.
+func Unified(a, b, fromName, toName string) (string, error) {
+	if a == b {
+		return "", nil
+	}
+	x, y := lines(a), lines(b)
+	m, err := matches(x, y)
+	if err != nil {
+		return "", err
+	}
+	var edits []edit
+	j := 0
+	for i, line := range x {
+		if m[i] < 0 {
+			edits = append(edits, edit{kind: '-', line: line, a: i, b: j})
+			continue
+		}
+		for ; j < m[i]; j++ {
+			edits = append(edits, edit{kind: '+', line: y[j], a: i, b: j})
+		}
+		edits = append(edits, edit{kind: ' ', line: line, a: i, b: j})
+		j++
+	}
+	for ; j < len(y); j++ {
+		edits = append(edits, edit{kind: '+', line: y[j], a: len(x), b: j})
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+	for start := 0; start < len(edits); {
+		if edits[start].kind == ' ' {
+			start++
+			continue
+		}
+		// a hunk runs from contextLines before its first change to contextLines after its last,
+		// absorbing changes that are closer than that
+		first := max(start-contextLines, 0)
+		end, unchanged := start, 0
+		for k := start; k < len(edits) && unchanged <= 2*contextLines; k++ {
+			if edits[k].kind == ' ' {
+				unchanged++
+				continue
+			}
+			end, unchanged = k, 0
+		}
+		last := min(end+contextLines, len(edits)-1)
+		writeHunk(&sb, edits[first:last+1])
+		start = last + 1
+	}
+	return sb.String(), nil
+}
+
+func writeHunk(sb *strings.Builder, hunk []edit) {
+	var aLen, bLen int
+	for _, e := range hunk {
+		if e.kind != '+' {
+			aLen++
+		}
+		if e.kind != '-' {
+			bLen++
+		}
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(hunk[0].a, aLen), hunkRange(hunk[0].b, bLen))
+	for _, e := range hunk {
+		sb.WriteByte(e.kind)
+		sb.WriteString(e.line)
+		sb.WriteByte('\n')
+	}
+}
+
+// hunkRange formats a range the way diff -u does; an empty range names the line before it.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
@@ -0,0 +1,76 @@
+package merge
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{
+			name: "empty input",
+		},
+		{
+			name: "same text",
+			a:    "a\nb",
+			b:    "a\nb",
+		},
+		{
+			name: "added to an empty text",
+			a:    "",
+			b:    "a\nb",
+			want: "--- v@1\n+++ v@2\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "everything deleted",
+			a:    "a\nb",
+			b:    "",
+			want: "--- v@1\n+++ v@2\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name: "line changed",
+			a:    "a\nb\nc",
+			b:    "a\nB\nc",
+			want: "--- v@1\n+++ v@2\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name: "insertion at the start",
+			a:    "a\nb\nc\nd\ne",
+			b:    "x\na\nb\nc\nd\ne",
+			want: "--- v@1\n+++ v@2\n@@ -1,3 +1,4 @@\n+x\n a\n b\n c\n",
+		},
+		{
+			name: "deletion at the end",
+			a:    "a\nb\nc\nd\ne",
+			b:    "a\nb\nc\nd",
+			want: "--- v@1\n+++ v@2\n@@ -2,4 +2,3 @@\n b\n c\n d\n-e\n",
+		},
+		{
+			name: "changes far apart",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\n9\nten",
+			want: "--- v@1\n+++ v@2\n" +
+				"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+		},
+		{
+			name: "changes close together share a hunk",
+			a:    "1\n2\n3\n4\n5\n6",
+			b:    "one\n2\n3\n4\n5\nsix",
+			want: "--- v@1\n+++ v@2\n@@ -1,6 +1,6 @@\n-1\n+one\n 2\n 3\n 4\n 5\n-6\n+six\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Unified(tt.a, tt.b, "v@1", "v@2")
+			if err != nil {
+				t.Fatalf("Unified() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Unified() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+// Package merge compares and merges versions of a text line by line, the way diff and diff3 do.
+package merge
+
+import (
+	"errors"
+	"strings"
+)
+
+// maxCells bounds the size of the longest-common-subsequence table, so a merge of huge texts
+// fails instead of exhausting memory.
+const maxCells = 4 << 20
+
+var ErrTooLarge = errors.New("texts are too large to merge")
+
+// Conflict is a region both sides changed differently. Line is the 1-based line of base the
+// region starts at; the slices hold the lines of the region in each version.
+type Conflict struct {
+	Line   int      `json:"line"`
+	Base   []string `json:"base"`
+	Ours   []string `json:"ours"`
+	Theirs []string `json:"theirs"`
+}
+
+// ThreeWay merges ours and theirs, two edits of base. Regions only one side changed take that
+// side's lines, regions both changed the same way are taken once. The merged text is only
+// meaningful when there are no conflicts.
+func ThreeWay(base, ours, theirs string) (string, []Conflict, error) {
+	o, a, b := lines(base), lines(ours), lines(theirs)
+	ma, err := matches(o, a)
+	if err != nil {
+		return "", nil, err
+	}
+	mb, err := matches(o, b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var merged []string
+	var conflicts []Conflict
+	chunk := func(i, k, ja, ka, jb, kb int) {
+		oc, ac, bc := o[i:k], a[ja:ka], b[jb:kb]
+		switch {
+		case equal(ac, oc):
+			merged = append(merged, bc...)
+		case equal(bc, oc), equal(ac, bc):
+			merged = append(merged, ac...)
+		default:
+			conflicts = append(conflicts, Conflict{Line: i + 1, Base: oc, Ours: ac, Theirs: bc})
+			merged = append(merged, ac...)
+		}
+	}
+	i, ja, jb := 0, 0, 0
+	for k := range o {
+		// base lines kept by both sides are stable, everything between them is a chunk
+		if ma[k] < 0 || mb[k] < 0 {
+			continue
+		}
+		chunk(i, k, ja, ma[k], jb, mb[k])
+		merged = append(merged, o[k])
+		i, ja, jb = k+1, ma[k]+1, mb[k]+1
+	}
+	chunk(i, len(o), ja, len(a), jb, len(b))
+	return strings.Join(merged, "\n"), conflicts, nil
+}
+
+func lines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// matches maps every line of o to the line of x it is kept as in a longest common
+// subsequence, or -1 when x dropped it.
+func matches(o, x []string) ([]int, error) {
+	n, m := len(o), len(x)
+	if n*m > maxCells {
+		return nil, ErrTooLarge
+	}
+	// lcs[i][j] is the length of the LCS of o[i:] and x[j:]
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if o[i] == x[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	match := make([]int, n)
+	for i := range match {
+		match[i] = -1
+	}
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case o[i] == x[j]:
+			match[i] = j
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return match, nil
+}
+
+func equal(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
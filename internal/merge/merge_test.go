@@ -0,0 +1,188 @@
+package merge
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestThreeWay(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		ours      string
+		theirs    string
+		merged    string
+		conflicts []Conflict
+	}{
+		{
+			name: "empty input",
+		},
+		{
+			name:   "nothing changed",
+			base:   "a\nb\nc",
+			ours:   "a\nb\nc",
+			theirs: "a\nb\nc",
+			merged: "a\nb\nc",
+		},
+		{
+			name:   "only ours changed",
+			base:   "a\nb\nc",
+			ours:   "a\nB\nc",
+			theirs: "a\nb\nc",
+			merged: "a\nB\nc",
+		},
+		{
+			name:   "only theirs changed",
+			base:   "a\nb\nc",
+			ours:   "a\nb\nc",
+			theirs: "a\nb\nC",
+			merged: "a\nb\nC",
+		},
+		{
+			name:   "both changed the same way",
+			base:   "a\nb\nc",
+			ours:   "a\nB\nc",
+			theirs: "a\nB\nc",
+			merged: "a\nB\nc",
+		},
+		{
+			name:   "changes in different places",
+			base:   "a\nb\nc\nd\ne",
+			ours:   "A\nb\nc\nd\ne",
+			theirs: "a\nb\nc\nd\nE",
+			merged: "A\nb\nc\nd\nE",
+		},
+		{
+			name:   "insertion at the start",
+			base:   "a\nb",
+			ours:   "x\na\nb",
+			theirs: "a\nb",
+			merged: "x\na\nb",
+		},
+		{
+			name:   "insertion at the end",
+			base:   "a\nb",
+			ours:   "a\nb",
+			theirs: "a\nb\nx",
+			merged: "a\nb\nx",
+		},
+		{
+			name:   "insertions at both ends",
+			base:   "a\nb",
+			ours:   "x\na\nb",
+			theirs: "a\nb\ny",
+			merged: "x\na\nb\ny",
+		},
+		{
+			name:   "deletion at the start",
+			base:   "a\nb\nc",
+			ours:   "b\nc",
+			theirs: "a\nb\nc",
+			merged: "b\nc",
+		},
+		{
+			name:   "deletion at the end",
+			base:   "a\nb\nc",
+			ours:   "a\nb\nc",
+			theirs: "a\nb",
+			merged: "a\nb",
+		},
+		{
+			name:   "everything deleted",
+			base:   "a\nb",
+			ours:   "",
+			theirs: "a\nb",
+			merged: "",
+		},
+		{
+			name:   "added to an empty base on one side",
+			base:   "",
+			ours:   "a\nb",
+			theirs: "",
+			merged: "a\nb",
+		},
+		{
+			name:   "same line changed differently",
+			base:   "a\nb\nc",
+			ours:   "a\nB\nc",
+			theirs: "a\nβ\nc",
+			merged: "a\nB\nc",
+			conflicts: []Conflict{
+				{Line: 2, Base: []string{"b"}, Ours: []string{"B"}, Theirs: []string{"β"}},
+			},
+		},
+		{
+			name:   "different insertions at the start",
+			base:   "a\nb",
+			ours:   "x\na\nb",
+			theirs: "y\na\nb",
+			merged: "x\na\nb",
+			conflicts: []Conflict{
+				{Line: 1, Base: []string{}, Ours: []string{"x"}, Theirs: []string{"y"}},
+			},
+		},
+		{
+			name:   "different insertions at the end",
+			base:   "a\nb",
+			ours:   "a\nb\nx",
+			theirs: "a\nb\ny",
+			merged: "a\nb\nx",
+			conflicts: []Conflict{
+				{Line: 3, Base: []string{}, Ours: []string{"x"}, Theirs: []string{"y"}},
+			},
+		},
+		{
+			name:   "deleted on one side and changed on the other",
+			base:   "a\nb\nc",
+			ours:   "a\nc",
+			theirs: "a\nB\nc",
+			merged: "a\nc",
+			conflicts: []Conflict{
+				{Line: 2, Base: []string{"b"}, Ours: []string{}, Theirs: []string{"B"}},
+			},
+		},
+		{
+			name:   "both added to an empty base",
+			base:   "",
+			ours:   "a",
+			theirs: "b",
+			merged: "a",
+			conflicts: []Conflict{
+				{Line: 1, Base: nil, Ours: []string{"a"}, Theirs: []string{"b"}},
+			},
+		},
+		{
+			name:   "conflict next to a clean change",
+			base:   "a\nb\nc\nd",
+			ours:   "A\nb\nc\nD",
+			theirs: "a\nb\nc\nδ",
+			merged: "A\nb\nc\nD",
+			conflicts: []Conflict{
+				{Line: 4, Base: []string{"d"}, Ours: []string{"D"}, Theirs: []string{"δ"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts, err := ThreeWay(tt.base, tt.ours, tt.theirs)
+			if err != nil {
+				t.Fatalf("ThreeWay() error = %v", err)
+			}
+			if merged != tt.merged {
+				t.Errorf("ThreeWay() merged = %q, want %q", merged, tt.merged)
+			}
+			if !reflect.DeepEqual(conflicts, tt.conflicts) {
+				t.Errorf("ThreeWay() conflicts = %#v, want %#v", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestThreeWayTooLarge(t *testing.T) {
+	huge := strings.Repeat("line\n", 3000)
+	if _, _, err := ThreeWay(huge, huge+"more", huge); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("ThreeWay() error = %v, want %v", err, ErrTooLarge)
+	}
+}
@@ -2,84 +2,49 @@ package internal
 
 import (
 	"context"
-	"errors"
 
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/mangudaigb/conversation-service/internal/consumer"
+	"github.com/mangudaigb/conversation-service/internal/router"
+	"github.com/mangudaigb/conversation-service/internal/svc"
 	"github.com/mangudaigb/dhauli-base/consumer/messaging"
 	"github.com/mangudaigb/dhauli-base/logger"
 )
 
 type MessageHandler struct {
-	tr  trace.Tracer
-	log *logger.Logger
-	ih  *consumer.InteractionMsgHandler
-	ch  *consumer.ConversationMsgHandler
+	log    *logger.Logger
+	handle router.HandlerFunc
 }
 
+// HandlerFunc routes the envelope to the handler registered for its type, action and kind. An
+// envelope without a principal is anonymous and only reaches documents without a tenant. Nothing
+// verifies the principal of an envelope, so it is a claimed identity.
 func (mh *MessageHandler) HandlerFunc(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope {
-	_, span := mh.tr.Start(ctx, "Generic Handler")
-	defer span.End()
-
-	kind := envelope.Kind
-	//event := envelope.EventName
-	message := envelope.Message
-	mType := message.Type
-	mAction := message.Action
-
-	if kind != messaging.REQUEST {
-		return messaging.EnvelopeError(*envelope, "kind is not of type request", true)
+	principal := envelope.Principal
+	if principal == nil {
+		principal = &messaging.Principal{}
 	}
-	if mType == "interaction" {
-		inter, err := mh.ih.InteractionHandlerFunc(ctx, message, mAction)
-		if err != nil {
-			mh.log.Errorf("Error handling interaction: %v", err)
-			return messaging.MessageError(envelope, 500, errors.New("interaction handler error"), false)
-		}
-		responseMsg, err := messaging.NewMessageFromOld(message, "interaction", message.Action, inter)
-		if err != nil {
-			mh.log.Errorf("Error creating response message for interaction: %v", err)
-			return messaging.MessageError(envelope, 500, errors.New("error creating response message"), false)
-		}
-		responseEnv := messaging.NewEnvelope(
-			responseMsg,
-			messaging.WithCorrelationId(envelope.CorrelationId),
-			messaging.WithTraceId(envelope.TraceId),
-			messaging.WithIdempotencyKey(envelope.IdempotencyKey),
-			messaging.WithKind(messaging.RESPONSE),
-			messaging.WithEventName("success"),
-		)
-		return &responseEnv
-	} else if mType == "conversation" {
-		conv, err := mh.ch.ConversationHandlerFunc(ctx, message, mAction)
-		if err != nil {
-			mh.log.Errorf("Error handling conversation: %v", err)
-			return messaging.MessageError(envelope, 500, errors.New("interaction handler error"), false)
-		}
-		responseMsg, err := messaging.NewMessageFromOld(message, "interaction", message.Action, conv)
-		if err != nil {
-			mh.log.Errorf("Error creating response message for conversation: %v", err)
-			return messaging.MessageError(envelope, 500, errors.New("error creating response message"), false)
-		}
-		responseEnv := messaging.NewEnvelope(
-			responseMsg,
-			messaging.WithCorrelationId(envelope.CorrelationId),
-			messaging.WithTraceId(envelope.TraceId),
-			messaging.WithIdempotencyKey(envelope.IdempotencyKey),
-			messaging.WithKind(messaging.RESPONSE),
-			messaging.WithEventName("success"),
-		)
-		return &responseEnv
-	}
-	return messaging.MessageError(envelope, 500, errors.New("message type is not correct for handler"), true)
+	ctx = svc.WithClaimedIdentity(svc.WithPrincipal(ctx, principal))
+	ctx = svc.WithCorrelationId(ctx, envelope.CorrelationId)
+	return mh.handle(ctx, envelope)
 }
 
-func NewMessageHandler(tr trace.Tracer, log *logger.Logger, ih *consumer.InteractionMsgHandler, ch *consumer.ConversationMsgHandler) *MessageHandler {
+func NewMessageHandler(tr trace.Tracer, log *logger.Logger, ih *consumer.InteractionMsgHandler, ch *consumer.ConversationMsgHandler, idempotency svc.IdempotencyService) *MessageHandler {
+	r := router.NewRouter(log)
+	r.Use(
+		router.Tracing(tr),
+		router.Logging(log),
+		router.Validation(),
+		router.Idempotency(log, idempotency),
+	)
+	ch.Register(r)
+	ih.Register(r)
+	for _, route := range r.Routes() {
+		log.Infof("Registered message route %s", route)
+	}
 	return &MessageHandler{
-		tr:  tr,
-		log: log,
-		ih:  ih,
-		ch:  ch,
+		log:    log,
+		handle: r.HandlerFunc(),
 	}
 }
@@ -0,0 +1,58 @@
+package repo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// distinctStrings returns the distinct values of a string field over the documents matching
+// filter.
+func distinctStrings(ctx context.Context, col *mongo.Collection, field string, filter interface{}) ([]string, error) {
+	values, err := col.Distinct(ctx, field, filter)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// distinctAfter returns, in order, the distinct values of a string field among the next limit
+// documents matching filter whose field sorts after the value after. Walking a collection with
+// it from "" until it returns nothing visits every value, reading at most limit documents at a
+// time.
+func distinctAfter(ctx context.Context, col *mongo.Collection, field string, filter map[string]interface{}, after string, limit int64) ([]string, error) {
+	match := make(bson.M, len(filter)+1)
+	for k, v := range filter {
+		match[k] = v
+	}
+	match[field] = bson.M{"$gt": after}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.D{{Key: field, Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$group", Value: bson.M{"_id": "$" + field}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	cursor, err := col.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Value string `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, group.Value)
+	}
+	return result, nil
+}
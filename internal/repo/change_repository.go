@@ -0,0 +1,121 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ChangeRepository interface {
+	NextSeq(ctx context.Context, cid string) (int64, error)
+	Create(ctx context.Context, change *dhauli.ChangeEvent) (*dhauli.ChangeEvent, error)
+	Since(ctx context.Context, cid string, seq int64, limit int64) ([]*dhauli.ChangeEvent, error)
+	DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error)
+	DeleteSeq(ctx context.Context, cid string) error
+	Count(ctx context.Context, filter map[string]interface{}) (int64, error)
+	DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error)
+	Close()
+}
+
+type MongoChangeRepository struct {
+	log        *logger.Logger
+	collection *mongo.Collection
+	sequences  *mongo.Collection
+}
+
+func NewChangeRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string) *MongoChangeRepository {
+	database := client.Database(cfg.Mongo.Database)
+	return &MongoChangeRepository{
+		log:        log,
+		collection: database.Collection(collection),
+		sequences:  database.Collection(collection + "_sequences"),
+	}
+}
+
+// NextSeq allocates the next change sequence of a conversation. Inside a transaction the counter
+// document stays locked until commit, so sequences become visible in order.
+func (mcr *MongoChangeRepository) NextSeq(ctx context.Context, cid string) (int64, error) {
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := mcr.sequences.FindOneAndUpdate(ctx, bson.M{"_id": cid}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+	if err != nil {
+		mcr.log.Errorf("Error allocating change sequence for conversation: %s err: %v", cid, err)
+		return 0, err
+	}
+	return counter.Seq, nil
+}
+
+func (mcr *MongoChangeRepository) Create(ctx context.Context, change *dhauli.ChangeEvent) (*dhauli.ChangeEvent, error) {
+	if _, err := mcr.collection.InsertOne(ctx, change); err != nil {
+		mcr.log.Errorf("Error inserting change for conversation: %s err: %v", change.ConversationID, err)
+		return nil, err
+	}
+	return change, nil
+}
+
+func (mcr *MongoChangeRepository) Since(ctx context.Context, cid string, seq int64, limit int64) ([]*dhauli.ChangeEvent, error) {
+	filter := bson.M{"conversationId": cid, "seq": bson.M{"$gt": seq}}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}).SetLimit(limit)
+	cursor, err := mcr.collection.Find(ctx, filter, opts)
+	if err != nil {
+		mcr.log.Errorf("Error getting changes for conversation: %s err: %v", cid, err)
+		return nil, err
+	}
+	var changes []*dhauli.ChangeEvent
+	if err = cursor.All(ctx, &changes); err != nil {
+		mcr.log.Errorf("Error decoding changes: %v", err)
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (mcr *MongoChangeRepository) DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	result, err := mcr.collection.DeleteMany(ctx, filter)
+	if err != nil {
+		mcr.log.Errorf("Error deleting changes in mongo: %v", err)
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// DeleteSeq drops the sequence counter of a conversation, so nothing of it is left once its
+// changes are gone.
+func (mcr *MongoChangeRepository) DeleteSeq(ctx context.Context, cid string) error {
+	if _, err := mcr.sequences.DeleteOne(ctx, bson.M{"_id": cid}); err != nil {
+		mcr.log.Errorf("Error deleting change sequence for conversation: %s err: %v", cid, err)
+		return err
+	}
+	return nil
+}
+
+func (mcr *MongoChangeRepository) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	count, err := mcr.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		mcr.log.Errorf("Error counting changes: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+func (mcr *MongoChangeRepository) DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error) {
+	values, err := distinctAfter(ctx, mcr.collection, field, bson.M{}, after, limit)
+	if err != nil {
+		mcr.log.Errorf("Error getting distinct %s of changes after %q: %v", field, after, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+func (mcr *MongoChangeRepository) Close() {
+	err := mcr.collection.Database().Client().Disconnect(context.Background())
+	if err != nil {
+		mcr.log.Errorf("Error closing mongo client for changes: %v", err)
+	}
+}
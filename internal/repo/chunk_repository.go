@@ -0,0 +1,121 @@
+package repo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AnswerChunkRepository interface {
+	CreateMany(ctx context.Context, chunks []*dhauli.AnswerChunk) error
+	GetByAnswerId(ctx context.Context, answerId string, afterSeq int) ([]*dhauli.AnswerChunk, error)
+	GetLatestAnswerId(ctx context.Context, iid string) (string, error)
+	DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error)
+	Count(ctx context.Context, filter map[string]interface{}) (int64, error)
+	DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error)
+	Close()
+}
+
+type MongoAnswerChunkRepository struct {
+	log        *logger.Logger
+	collection *mongo.Collection
+}
+
+func NewAnswerChunkRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string) *MongoAnswerChunkRepository {
+	col := client.Database(cfg.Mongo.Database).Collection(collection)
+	return &MongoAnswerChunkRepository{
+		log:        log,
+		collection: col,
+	}
+}
+
+func (mcr *MongoAnswerChunkRepository) CreateMany(ctx context.Context, chunks []*dhauli.AnswerChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(chunks))
+	for _, chunk := range chunks {
+		if err := own(ctx, &chunk.Ownership); err != nil {
+			return err
+		}
+		docs = append(docs, chunk)
+	}
+	_, err := mcr.collection.InsertMany(ctx, docs)
+	if err != nil {
+		mcr.log.Errorf("Error inserting %d answer chunks: %v", len(chunks), err)
+		return err
+	}
+	return nil
+}
+
+func (mcr *MongoAnswerChunkRepository) GetByAnswerId(ctx context.Context, answerId string, afterSeq int) ([]*dhauli.AnswerChunk, error) {
+	filter := bson.M{"answerId": answerId, "seq": bson.M{"$gt": afterSeq}}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}})
+	cursor, err := mcr.collection.Find(ctx, scoped(ctx, filter), opts)
+	if err != nil {
+		mcr.log.Errorf("Error getting answer chunks for answer: %s err: %v", answerId, err)
+		return nil, err
+	}
+	var chunks []*dhauli.AnswerChunk
+	if err = cursor.All(ctx, &chunks); err != nil {
+		mcr.log.Errorf("Error decoding answer chunks: %v", err)
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// GetLatestAnswerId returns the answer most recently streamed for the interaction, or an empty
+// string when nothing was ever streamed.
+func (mcr *MongoAnswerChunkRepository) GetLatestAnswerId(ctx context.Context, iid string) (string, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	var chunk dhauli.AnswerChunk
+	err := mcr.collection.FindOne(ctx, scoped(ctx, bson.M{"interactionId": iid}), opts).Decode(&chunk)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil
+	}
+	if err != nil {
+		mcr.log.Errorf("Error getting latest answer chunk for interaction: %s err: %v", iid, err)
+		return "", err
+	}
+	return chunk.AnswerID, nil
+}
+
+func (mcr *MongoAnswerChunkRepository) DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	result, err := mcr.collection.DeleteMany(ctx, scoped(ctx, filter))
+	if err != nil {
+		mcr.log.Errorf("Error deleting answer chunks in mongo: %v", err)
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (mcr *MongoAnswerChunkRepository) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	count, err := mcr.collection.CountDocuments(ctx, scoped(ctx, filter))
+	if err != nil {
+		mcr.log.Errorf("Error counting answer chunks: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+func (mcr *MongoAnswerChunkRepository) DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error) {
+	values, err := distinctAfter(ctx, mcr.collection, field, scoped(ctx, bson.M{}), after, limit)
+	if err != nil {
+		mcr.log.Errorf("Error getting distinct %s of answer chunks after %q: %v", field, after, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+func (mcr *MongoAnswerChunkRepository) Close() {
+	err := mcr.collection.Database().Client().Disconnect(context.Background())
+	if err != nil {
+		mcr.log.Errorf("Error closing mongo client for answer chunks: %v", err)
+	}
+}
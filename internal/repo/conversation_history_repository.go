@@ -0,0 +1,145 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ConversationHistoryRepository interface {
+	GetById(ctx context.Context, id string) (*dhauli.ConversationHistory, error)
+	Create(ctx context.Context, history *dhauli.ConversationHistory) (*dhauli.ConversationHistory, error)
+	Page(ctx context.Context, filter map[string]interface{}, skip, limit int64) ([]*dhauli.ConversationHistory, int64, error)
+	DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error)
+	Count(ctx context.Context, filter map[string]interface{}) (int64, error)
+	DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error)
+	SetMany(ctx context.Context, filter map[string]interface{}, fields map[string]interface{}) (int64, error)
+	PullMany(ctx context.Context, filter map[string]interface{}, pull map[string]interface{}) (int64, error)
+	Close()
+}
+
+// historyTenant is where the history keeps the tenant, in the snapshot of the conversation.
+const historyTenant = "conversation.tenantId"
+
+type MongoConversationHistoryRepository struct {
+	log        *logger.Logger
+	collection *mongo.Collection
+}
+
+func NewConversationHistoryRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string) *MongoConversationHistoryRepository {
+	col := client.Database(cfg.Mongo.Database).Collection(collection)
+	return &MongoConversationHistoryRepository{
+		log:        log,
+		collection: col,
+	}
+}
+
+func (mhr *MongoConversationHistoryRepository) GetById(ctx context.Context, id string) (*dhauli.ConversationHistory, error) {
+	historyDoc := &dhauli.ConversationHistory{}
+	err := mhr.collection.FindOne(ctx, scopedAt(ctx, historyTenant, bson.M{"_id": id})).Decode(historyDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, apperr.Wrap(apperr.NotFound, err, "conversation history %s not found", id)
+	}
+	if err != nil {
+		mhr.log.Errorf("Error getting conversation history for id: %s err: %v", id, err)
+		return nil, err
+	}
+	return historyDoc, nil
+}
+
+func (mhr *MongoConversationHistoryRepository) Create(ctx context.Context, history *dhauli.ConversationHistory) (*dhauli.ConversationHistory, error) {
+	if history.ID == "" {
+		return nil, apperr.NewValidation("conversation history id cannot be empty")
+	}
+	if err := own(ctx, &history.Conversation.Ownership); err != nil {
+		return nil, err
+	}
+	history.CreatedAt = time.Now()
+	if _, err := mhr.collection.InsertOne(ctx, history); err != nil {
+		mhr.log.Errorf("Error inserting conversation history in mongo: %v", err)
+		return nil, err
+	}
+	return history, nil
+}
+
+// Page returns the entries matching filter oldest first, skipping skip and returning at most limit
+// of them, along with the number of all matching entries.
+func (mhr *MongoConversationHistoryRepository) Page(ctx context.Context, filter map[string]interface{}, skip, limit int64) ([]*dhauli.ConversationHistory, int64, error) {
+	total, err := mhr.collection.CountDocuments(ctx, scopedAt(ctx, historyTenant, filter))
+	if err != nil {
+		mhr.log.Errorf("Error counting conversation history: %v", err)
+		return nil, 0, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).SetSkip(skip).SetLimit(limit)
+	cursor, err := mhr.collection.Find(ctx, scopedAt(ctx, historyTenant, filter), opts)
+	if err != nil {
+		mhr.log.Errorf("Error finding conversation history: %v", err)
+		return nil, 0, err
+	}
+	history := []*dhauli.ConversationHistory{}
+	if err = cursor.All(ctx, &history); err != nil {
+		mhr.log.Errorf("Error decoding conversation history: %v", err)
+		return nil, 0, err
+	}
+	return history, total, nil
+}
+
+func (mhr *MongoConversationHistoryRepository) DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	result, err := mhr.collection.DeleteMany(ctx, scopedAt(ctx, historyTenant, filter))
+	if err != nil {
+		mhr.log.Errorf("Error deleting conversation history entries in mongo: %v", err)
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (mhr *MongoConversationHistoryRepository) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	count, err := mhr.collection.CountDocuments(ctx, scopedAt(ctx, historyTenant, filter))
+	if err != nil {
+		mhr.log.Errorf("Error counting conversation history: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+func (mhr *MongoConversationHistoryRepository) DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error) {
+	values, err := distinctAfter(ctx, mhr.collection, field, scopedAt(ctx, historyTenant, bson.M{}), after, limit)
+	if err != nil {
+		mhr.log.Errorf("Error getting distinct %s of conversation history after %q: %v", field, after, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+func (mhr *MongoConversationHistoryRepository) SetMany(ctx context.Context, filter map[string]interface{}, fields map[string]interface{}) (int64, error) {
+	result, err := mhr.collection.UpdateMany(ctx, scopedAt(ctx, historyTenant, filter), bson.M{"$set": fields})
+	if err != nil {
+		mhr.log.Errorf("Error updating conversation history entries in mongo: %v", err)
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (mhr *MongoConversationHistoryRepository) PullMany(ctx context.Context, filter map[string]interface{}, pull map[string]interface{}) (int64, error) {
+	result, err := mhr.collection.UpdateMany(ctx, scopedAt(ctx, historyTenant, filter), bson.M{"$pull": pull})
+	if err != nil {
+		mhr.log.Errorf("Error pulling from conversation history entries in mongo: %v", err)
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (mhr *MongoConversationHistoryRepository) Close() {
+	err := mhr.collection.Database().Client().Disconnect(context.Background())
+	if err != nil {
+		mhr.log.Errorf("Error closing mongo client for conversation history: %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/config"
 	"github.com/mangudaigb/dhauli-base/logger"
@@ -19,6 +20,9 @@ type ConversationRepository interface {
 	Update(ctx context.Context, conversation *dhauli.Conversation) (*dhauli.Conversation, error)
 	Delete(ctx context.Context, id string) error
 	Filter(ctx context.Context, filter map[string]interface{}) ([]*dhauli.Conversation, error)
+	Distinct(ctx context.Context, field string, filter map[string]interface{}) ([]string, error)
+	Scan(ctx context.Context, filter map[string]interface{}, afterId string, limit int64) ([]*dhauli.Conversation, error)
+	PullMany(ctx context.Context, filter map[string]interface{}, pull map[string]interface{}) (int64, error)
 	Close()
 }
 
@@ -29,7 +33,10 @@ type MongoConversationRepository struct {
 
 func (mcr *MongoConversationRepository) GetByID(ctx context.Context, id string) (*dhauli.Conversation, error) {
 	conversationDoc := &dhauli.Conversation{}
-	err := mcr.collection.FindOne(ctx, dhauli.Conversation{ID: id}).Decode(conversationDoc)
+	err := mcr.collection.FindOne(ctx, scoped(ctx, bson.M{"_id": id})).Decode(conversationDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, apperr.Wrap(apperr.NotFound, err, "conversation %s not found", id)
+	}
 	if err != nil {
 		mcr.log.Errorf("Error getting conversation for id: %s err: %v", id, err)
 		return nil, err
@@ -42,14 +49,26 @@ func (mcr *MongoConversationRepository) Create(ctx context.Context, conversation
 	conversation.CreatedAt = now
 	conversation.UpdatedAt = now
 	conversation.Version = 1
+	if err := own(ctx, &conversation.Ownership); err != nil {
+		return nil, err
+	}
 	result, err := mcr.collection.InsertOne(ctx, conversation)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, apperr.Wrap(apperr.Conflict, err, "conversation %s already exists", conversation.ID)
+	}
 	if err != nil {
 		mcr.log.Errorf("Error inserting conversation: %v", err)
+		return nil, err
 	}
 	return mcr.GetByID(ctx, result.InsertedID.(string))
 }
 
+// Update writes conversation if it is still at the version it was read with, and increments the
+// version.
 func (mcr *MongoConversationRepository) Update(ctx context.Context, conversation *dhauli.Conversation) (*dhauli.Conversation, error) {
+	if err := checkIfMatch(ctx, conversation.ID, conversation.Version); err != nil {
+		return nil, err
+	}
 	filter := bson.M{
 		"_id":     conversation.ID,
 		"version": conversation.Version,
@@ -60,7 +79,14 @@ func (mcr *MongoConversationRepository) Update(ctx context.Context, conversation
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
 
 	var updatedConversation dhauli.Conversation
-	err := mcr.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(updatedConversation)
+	err := mcr.collection.FindOneAndUpdate(ctx, scoped(ctx, filter), update, opts).Decode(&updatedConversation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// it was read just before, so another writer got in between
+		if _, ok := ifMatch(ctx, conversation.ID); ok {
+			return nil, apperr.Wrap(apperr.PreconditionFailed, err, "conversation %s was modified concurrently", conversation.ID)
+		}
+		return nil, apperr.Wrap(apperr.Conflict, err, "conversation %s was modified concurrently", conversation.ID)
+	}
 	if err != nil {
 		mcr.log.Errorf("Error updating conversation: %v", err)
 		return nil, err
@@ -69,17 +95,28 @@ func (mcr *MongoConversationRepository) Update(ctx context.Context, conversation
 }
 
 func (mcr *MongoConversationRepository) Delete(ctx context.Context, id string) error {
-	_, err := mcr.collection.DeleteOne(ctx, dhauli.Conversation{ID: id})
+	filter := bson.M{"_id": id}
+	version, conditional := ifMatch(ctx, id)
+	if conditional {
+		filter["version"] = version
+	}
+	result, err := mcr.collection.DeleteOne(ctx, scoped(ctx, filter))
 	if err != nil {
 		mcr.log.Errorf("Error deleting conversation in mongo: %v", err)
 		return err
 	}
+	if conditional && result.DeletedCount == 0 {
+		if _, err = mcr.GetByID(ctx, id); err != nil {
+			return err
+		}
+		return apperr.New(apperr.PreconditionFailed, "conversation %s is not at version %d", id, version)
+	}
 	return nil
 }
 
 func (mcr *MongoConversationRepository) Filter(ctx context.Context, filter map[string]interface{}) ([]*dhauli.Conversation, error) {
 	var list []*dhauli.Conversation
-	cursor, err := mcr.collection.Find(ctx, filter)
+	cursor, err := mcr.collection.Find(ctx, scoped(ctx, filter))
 	if err != nil {
 		mcr.log.Errorf("Error getting conversation for filter: %v", err)
 		return nil, err
@@ -95,6 +132,50 @@ func (mcr *MongoConversationRepository) Filter(ctx context.Context, filter map[s
 	return list, nil
 }
 
+func (mcr *MongoConversationRepository) Distinct(ctx context.Context, field string, filter map[string]interface{}) ([]string, error) {
+	values, err := distinctStrings(ctx, mcr.collection, field, scoped(ctx, filter))
+	if err != nil {
+		mcr.log.Errorf("Error getting distinct %s of conversations: %v", field, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+// Scan returns up to limit conversations matching filter whose id sorts after afterId, in id
+// order, so large result sets can be walked in batches.
+func (mcr *MongoConversationRepository) Scan(ctx context.Context, filter map[string]interface{}, afterId string, limit int64) ([]*dhauli.Conversation, error) {
+	scan := bson.M{}
+	for k, v := range filter {
+		scan[k] = v
+	}
+	if afterId != "" {
+		scan["_id"] = bson.M{"$gt": afterId}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit)
+	cursor, err := mcr.collection.Find(ctx, scoped(ctx, scan), opts)
+	if err != nil {
+		mcr.log.Errorf("Error scanning conversations: %v", err)
+		return nil, err
+	}
+	list := []*dhauli.Conversation{}
+	if err = cursor.All(ctx, &list); err != nil {
+		mcr.log.Errorf("Error decoding conversations: %v", err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// PullMany removes the array elements described by pull from every conversation matching filter,
+// leaving the version alone.
+func (mcr *MongoConversationRepository) PullMany(ctx context.Context, filter map[string]interface{}, pull map[string]interface{}) (int64, error) {
+	result, err := mcr.collection.UpdateMany(ctx, scoped(ctx, filter), bson.M{"$pull": pull})
+	if err != nil {
+		mcr.log.Errorf("Error pulling from conversations in mongo: %v", err)
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
 func (mcr *MongoConversationRepository) Close() {
 	err := mcr.collection.Database().Client().Disconnect(context.Background())
 	if err != nil {
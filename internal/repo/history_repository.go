@@ -3,21 +3,28 @@ package repo
 import (
 	"context"
 	"errors"
-	"fmt"
 	"time"
 
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/config"
 	"github.com/mangudaigb/dhauli-base/logger"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type InteractionHistoryRepository interface {
-	GetById(id string) (*dhauli.InteractionHistory, error)
+	GetById(ctx context.Context, id string) (*dhauli.InteractionHistory, error)
 	Create(ctx context.Context, conversation *dhauli.InteractionHistory) (*dhauli.InteractionHistory, error)
 	Delete(ctx context.Context, id string)
 	Filter(ctx context.Context, filter map[string]interface{}) ([]*dhauli.InteractionHistory, error)
+	Page(ctx context.Context, filter map[string]interface{}, skip, limit int64) ([]*dhauli.InteractionHistory, int64, error)
+	DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error)
+	Distinct(ctx context.Context, field string, filter map[string]interface{}) ([]string, error)
+	DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error)
+	Count(ctx context.Context, filter map[string]interface{}) (int64, error)
+	SetMany(ctx context.Context, filter map[string]interface{}, fields map[string]interface{}) (int64, error)
 	Close()
 }
 
@@ -34,10 +41,13 @@ func NewInteractionHistoryRepository(cfg *config.Config, log *logger.Logger, cli
 	}
 }
 
-func (msr MongoInteractionHistoryRepository) GetById(id string) (*dhauli.InteractionHistory, error) {
+func (msr MongoInteractionHistoryRepository) GetById(ctx context.Context, id string) (*dhauli.InteractionHistory, error) {
 	interactionDoc := &dhauli.InteractionHistory{}
 	filter := bson.M{"_id": id}
-	err := msr.collection.FindOne(context.Background(), filter).Decode(interactionDoc)
+	err := msr.collection.FindOne(ctx, scoped(ctx, filter)).Decode(interactionDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, apperr.Wrap(apperr.NotFound, err, "interaction history %s not found", id)
+	}
 	if err != nil {
 		msr.log.Errorf("Error getting conversation for id: %s err: %v", id, err)
 		return nil, err
@@ -47,7 +57,10 @@ func (msr MongoInteractionHistoryRepository) GetById(id string) (*dhauli.Interac
 
 func (msr MongoInteractionHistoryRepository) Create(ctx context.Context, interactionHistory *dhauli.InteractionHistory) (*dhauli.InteractionHistory, error) {
 	if interactionHistory.ID == "" {
-		return nil, fmt.Errorf("interaction History id cannot be empty")
+		return nil, apperr.NewValidation("interaction history id cannot be empty")
+	}
+	if err := own(ctx, &interactionHistory.Ownership); err != nil {
+		return nil, err
 	}
 	interactionHistory.CreatedAt = time.Now()
 	ch, err := msr.collection.InsertOne(ctx, interactionHistory)
@@ -55,11 +68,11 @@ func (msr MongoInteractionHistoryRepository) Create(ctx context.Context, interac
 		msr.log.Errorf("Error inserting conversation history in mongo: %v", err)
 		return nil, err
 	}
-	return msr.GetById(ch.InsertedID.(string))
+	return msr.GetById(ctx, ch.InsertedID.(string))
 }
 
 func (msr MongoInteractionHistoryRepository) Delete(ctx context.Context, id string) {
-	_, err := msr.collection.DeleteOne(ctx, dhauli.InteractionHistory{ID: id})
+	_, err := msr.collection.DeleteOne(ctx, scoped(ctx, bson.M{"_id": id}))
 	if err != nil {
 		msr.log.Errorf("Error deleting conversation in mongo: %v", err)
 		return
@@ -67,7 +80,7 @@ func (msr MongoInteractionHistoryRepository) Delete(ctx context.Context, id stri
 }
 
 func (msr MongoInteractionHistoryRepository) Filter(ctx context.Context, filter map[string]interface{}) ([]*dhauli.InteractionHistory, error) {
-	cursor, err := msr.collection.Find(ctx, filter)
+	cursor, err := msr.collection.Find(ctx, scoped(ctx, filter))
 	if err != nil {
 		msr.log.Errorf("Error finding interaction history: %v", err)
 		return nil, err
@@ -89,6 +102,28 @@ func (msr MongoInteractionHistoryRepository) Filter(ctx context.Context, filter
 
 }
 
+// Page returns the entries matching filter oldest first, skipping skip and returning at most limit
+// of them, along with the number of all matching entries.
+func (msr MongoInteractionHistoryRepository) Page(ctx context.Context, filter map[string]interface{}, skip, limit int64) ([]*dhauli.InteractionHistory, int64, error) {
+	total, err := msr.collection.CountDocuments(ctx, scoped(ctx, filter))
+	if err != nil {
+		msr.log.Errorf("Error counting interaction history: %v", err)
+		return nil, 0, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).SetSkip(skip).SetLimit(limit)
+	cursor, err := msr.collection.Find(ctx, scoped(ctx, filter), opts)
+	if err != nil {
+		msr.log.Errorf("Error finding interaction history: %v", err)
+		return nil, 0, err
+	}
+	history := []*dhauli.InteractionHistory{}
+	if err = cursor.All(ctx, &history); err != nil {
+		msr.log.Errorf("Error decoding interaction history: %v", err)
+		return nil, 0, err
+	}
+	return history, total, nil
+}
+
 func (msr MongoInteractionHistoryRepository) Close() {
 	err := msr.collection.Database().Client().Disconnect(context.Background())
 	if err != nil {
@@ -96,3 +131,49 @@ func (msr MongoInteractionHistoryRepository) Close() {
 		return
 	}
 }
+
+// DeleteMany removes every history entry matching filter and reports how many there were.
+func (msr MongoInteractionHistoryRepository) DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	result, err := msr.collection.DeleteMany(ctx, scoped(ctx, filter))
+	if err != nil {
+		msr.log.Errorf("Error deleting interaction history entries in mongo: %v", err)
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (msr MongoInteractionHistoryRepository) Distinct(ctx context.Context, field string, filter map[string]interface{}) ([]string, error) {
+	values, err := distinctStrings(ctx, msr.collection, field, scoped(ctx, filter))
+	if err != nil {
+		msr.log.Errorf("Error getting distinct %s of interaction history entries: %v", field, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+func (msr MongoInteractionHistoryRepository) DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error) {
+	values, err := distinctAfter(ctx, msr.collection, field, scoped(ctx, bson.M{}), after, limit)
+	if err != nil {
+		msr.log.Errorf("Error getting distinct %s of interaction history entries after %q: %v", field, after, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+func (msr MongoInteractionHistoryRepository) SetMany(ctx context.Context, filter map[string]interface{}, fields map[string]interface{}) (int64, error) {
+	result, err := msr.collection.UpdateMany(ctx, scoped(ctx, filter), bson.M{"$set": fields})
+	if err != nil {
+		msr.log.Errorf("Error updating interaction history entries in mongo: %v", err)
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (msr MongoInteractionHistoryRepository) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	count, err := msr.collection.CountDocuments(ctx, scoped(ctx, filter))
+	if err != nil {
+		msr.log.Errorf("Error counting interaction history: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
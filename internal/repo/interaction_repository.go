@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/config"
 	"github.com/mangudaigb/dhauli-base/logger"
@@ -22,6 +23,10 @@ type InteractionRepository interface {
 	Update(ctx context.Context, conversation *dhauli.Interaction) (*dhauli.Interaction, error)
 	Delete(ctx context.Context, id string) error
 	Filter(ctx context.Context, filter map[string]interface{}) ([]*dhauli.Interaction, error)
+	DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error)
+	SetMany(ctx context.Context, filter map[string]interface{}, fields map[string]interface{}) (int64, error)
+	Distinct(ctx context.Context, field string, filter map[string]interface{}) ([]string, error)
+	DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error)
 	Close()
 }
 
@@ -40,7 +45,10 @@ func NewMongoInteractionRepository(cfg *config.Config, log *logger.Logger, clien
 
 func (msr *MongoInteractionRepository) GetById(ctx context.Context, id string) (*dhauli.Interaction, error) {
 	conversationDoc := &dhauli.Interaction{}
-	err := msr.collection.FindOne(ctx, dhauli.Interaction{ID: id}).Decode(conversationDoc)
+	err := msr.collection.FindOne(ctx, scoped(ctx, bson.M{"_id": id})).Decode(conversationDoc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, apperr.Wrap(apperr.NotFound, err, "interaction %s not found", id)
+	}
 	if err != nil {
 		msr.log.Errorf("Error getting conversation for id: %s err: %v", id, err)
 		return nil, err
@@ -49,7 +57,13 @@ func (msr *MongoInteractionRepository) GetById(ctx context.Context, id string) (
 }
 
 func (msr *MongoInteractionRepository) Create(ctx context.Context, conversation *dhauli.Interaction) (*dhauli.Interaction, error) {
+	if err := own(ctx, &conversation.Ownership); err != nil {
+		return nil, err
+	}
 	result, err := msr.collection.InsertOne(ctx, conversation)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, apperr.Wrap(apperr.Conflict, err, "interaction %s already exists", conversation.ID)
+	}
 	if err != nil {
 		msr.log.Errorf("Error inserting conversation in mongo: %v", err)
 		return nil, err
@@ -57,7 +71,7 @@ func (msr *MongoInteractionRepository) Create(ctx context.Context, conversation
 
 	id := result.InsertedID.(string)
 	var interactionDoc dhauli.Interaction
-	err = msr.collection.FindOne(ctx, dhauli.Interaction{ID: id}).Decode(&interactionDoc)
+	err = msr.collection.FindOne(ctx, scoped(ctx, bson.M{"_id": id})).Decode(&interactionDoc)
 	if err != nil {
 		msr.log.Errorf("Was able to save the conversation but error getting conversation for id: %s err: %v", id, err)
 		return nil, err
@@ -65,21 +79,43 @@ func (msr *MongoInteractionRepository) Create(ctx context.Context, conversation
 	return &interactionDoc, nil
 }
 
+// Update writes interaction if it is still at the version it was read with, and increments the
+// version.
 func (msr *MongoInteractionRepository) Update(ctx context.Context, interaction *dhauli.Interaction) (*dhauli.Interaction, error) {
-	filter := bson.M{"_id": interaction.ID}
+	if err := checkIfMatch(ctx, interaction.ID, interaction.Version); err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		"_id":     interaction.ID,
+		"version": interaction.Version,
+	}
 	update := bson.M{
 		"$set": bson.M{
-			"context":   interaction.Context,
-			"query":     interaction.Query,
-			"Answer":    interaction.Answer,
-			"updatedAt": interaction.UpdatedAt,
+			"context":          interaction.Context,
+			"query":            interaction.Query,
+			"answer":           interaction.Answer,
+			"answers":          interaction.Answers,
+			"selectedAnswerId": interaction.SelectedAnswerID,
+			"undo":             interaction.Undo,
+			"redo":             interaction.Redo,
+			"updatedAt":        interaction.UpdatedAt,
 		},
+		"$inc": bson.M{"version": 1},
 	}
 
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
 	var updatedInteraction dhauli.Interaction
-	err := msr.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updatedInteraction)
+	err := msr.collection.FindOneAndUpdate(ctx, scoped(ctx, filter), update, opts).Decode(&updatedInteraction)
 	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err = msr.GetById(ctx, interaction.ID); err != nil {
+			return nil, err
+		}
+		if _, ok := ifMatch(ctx, interaction.ID); ok {
+			return nil, apperr.New(apperr.PreconditionFailed, "interaction %s was modified concurrently", interaction.ID)
+		}
+		return nil, apperr.NewConflict("interaction %s was modified concurrently", interaction.ID)
+	}
+	if err != nil {
 		msr.log.Errorf("Error updating interaction in mongo: %v", err)
 		return nil, err
 	}
@@ -87,17 +123,28 @@ func (msr *MongoInteractionRepository) Update(ctx context.Context, interaction *
 }
 
 func (msr *MongoInteractionRepository) Delete(ctx context.Context, id string) error {
-	_, err := msr.collection.DeleteOne(ctx, dhauli.Interaction{ID: id})
+	filter := bson.M{"_id": id}
+	version, conditional := ifMatch(ctx, id)
+	if conditional {
+		filter["version"] = version
+	}
+	result, err := msr.collection.DeleteOne(ctx, scoped(ctx, filter))
 	if err != nil {
 		msr.log.Errorf("Error deleting conversation in mongo: %v", err)
 		return err
 	}
+	if conditional && result.DeletedCount == 0 {
+		if _, err = msr.GetById(ctx, id); err != nil {
+			return err
+		}
+		return apperr.New(apperr.PreconditionFailed, "interaction %s is not at version %d", id, version)
+	}
 	return nil
 }
 
 func (msr *MongoInteractionRepository) Filter(ctx context.Context, filter map[string]interface{}) ([]*dhauli.Interaction, error) {
 	var list []*dhauli.Interaction
-	cursor, err := msr.collection.Find(ctx, filter)
+	cursor, err := msr.collection.Find(ctx, scoped(ctx, filter))
 	if err != nil {
 		msr.log.Errorf("Error getting conversation for filter: %v", err)
 		return nil, err
@@ -120,3 +167,41 @@ func (msr *MongoInteractionRepository) Close() {
 		return
 	}
 }
+
+// DeleteMany removes every interaction matching filter and reports how many there were.
+func (msr *MongoInteractionRepository) DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	result, err := msr.collection.DeleteMany(ctx, scoped(ctx, filter))
+	if err != nil {
+		msr.log.Errorf("Error deleting interactions in mongo: %v", err)
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (msr *MongoInteractionRepository) Distinct(ctx context.Context, field string, filter map[string]interface{}) ([]string, error) {
+	values, err := distinctStrings(ctx, msr.collection, field, scoped(ctx, filter))
+	if err != nil {
+		msr.log.Errorf("Error getting distinct %s of interactions: %v", field, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+func (msr *MongoInteractionRepository) DistinctAfter(ctx context.Context, field string, after string, limit int64) ([]string, error) {
+	values, err := distinctAfter(ctx, msr.collection, field, scoped(ctx, bson.M{}), after, limit)
+	if err != nil {
+		msr.log.Errorf("Error getting distinct %s of interactions after %q: %v", field, after, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+// SetMany sets fields on every interaction matching filter, leaving the version alone.
+func (msr *MongoInteractionRepository) SetMany(ctx context.Context, filter map[string]interface{}, fields map[string]interface{}) (int64, error) {
+	result, err := msr.collection.UpdateMany(ctx, scoped(ctx, filter), bson.M{"$set": fields})
+	if err != nil {
+		msr.log.Errorf("Error updating interactions in mongo: %v", err)
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
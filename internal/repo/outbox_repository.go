@@ -0,0 +1,119 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type OutboxRepository interface {
+	Create(ctx context.Context, entry *dhauli.OutboxEntry) (*dhauli.OutboxEntry, error)
+	GetPending(ctx context.Context, limit int64) ([]*dhauli.OutboxEntry, error)
+	MarkDelivered(ctx context.Context, ids []string, at time.Time) error
+	MarkFailed(ctx context.Context, ids []string, reason string) error
+	GetOldestPending(ctx context.Context) (*dhauli.OutboxEntry, int64, error)
+	DeleteDelivered(ctx context.Context, before time.Time) (int64, error)
+	Close()
+}
+
+type MongoOutboxRepository struct {
+	log        *logger.Logger
+	collection *mongo.Collection
+}
+
+func NewOutboxRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string) *MongoOutboxRepository {
+	col := client.Database(cfg.Mongo.Database).Collection(collection)
+	return &MongoOutboxRepository{
+		log:        log,
+		collection: col,
+	}
+}
+
+var pendingFilter = bson.M{"deliveredAt": nil}
+var pendingOrder = bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}
+
+func (mor *MongoOutboxRepository) Create(ctx context.Context, entry *dhauli.OutboxEntry) (*dhauli.OutboxEntry, error) {
+	if _, err := mor.collection.InsertOne(ctx, entry); err != nil {
+		mor.log.Errorf("Error inserting outbox entry %s: %v", entry.EventName, err)
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (mor *MongoOutboxRepository) GetPending(ctx context.Context, limit int64) ([]*dhauli.OutboxEntry, error) {
+	opts := options.Find().SetSort(pendingOrder).SetLimit(limit)
+	cursor, err := mor.collection.Find(ctx, pendingFilter, opts)
+	if err != nil {
+		mor.log.Errorf("Error getting pending outbox entries: %v", err)
+		return nil, err
+	}
+	var entries []*dhauli.OutboxEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		mor.log.Errorf("Error decoding outbox entries: %v", err)
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (mor *MongoOutboxRepository) MarkDelivered(ctx context.Context, ids []string, at time.Time) error {
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	update := bson.M{"$set": bson.M{"deliveredAt": at}, "$inc": bson.M{"attempts": 1}, "$unset": bson.M{"lastError": ""}}
+	if _, err := mor.collection.UpdateMany(ctx, filter, update); err != nil {
+		mor.log.Errorf("Error marking %d outbox entries delivered: %v", len(ids), err)
+		return err
+	}
+	return nil
+}
+
+func (mor *MongoOutboxRepository) MarkFailed(ctx context.Context, ids []string, reason string) error {
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	update := bson.M{"$set": bson.M{"lastError": reason}, "$inc": bson.M{"attempts": 1}}
+	if _, err := mor.collection.UpdateMany(ctx, filter, update); err != nil {
+		mor.log.Errorf("Error recording failed delivery of %d outbox entries: %v", len(ids), err)
+		return err
+	}
+	return nil
+}
+
+// GetOldestPending returns the entry the relay has to publish next, nil when there is none,
+// together with the number of pending entries.
+func (mor *MongoOutboxRepository) GetOldestPending(ctx context.Context) (*dhauli.OutboxEntry, int64, error) {
+	count, err := mor.collection.CountDocuments(ctx, pendingFilter)
+	if err != nil {
+		mor.log.Errorf("Error counting pending outbox entries: %v", err)
+		return nil, 0, err
+	}
+	var entry dhauli.OutboxEntry
+	err = mor.collection.FindOne(ctx, pendingFilter, options.FindOne().SetSort(pendingOrder)).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, count, nil
+	}
+	if err != nil {
+		mor.log.Errorf("Error getting oldest pending outbox entry: %v", err)
+		return nil, 0, err
+	}
+	return &entry, count, nil
+}
+
+func (mor *MongoOutboxRepository) DeleteDelivered(ctx context.Context, before time.Time) (int64, error) {
+	res, err := mor.collection.DeleteMany(ctx, bson.M{"deliveredAt": bson.M{"$ne": nil, "$lt": before}})
+	if err != nil {
+		mor.log.Errorf("Error deleting delivered outbox entries: %v", err)
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (mor *MongoOutboxRepository) Close() {
+	err := mor.collection.Database().Client().Disconnect(context.Background())
+	if err != nil {
+		mor.log.Errorf("Error closing mongo client for outbox: %v", err)
+	}
+}
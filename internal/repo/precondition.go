@@ -0,0 +1,42 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+)
+
+type ifMatchKey struct{}
+
+// IfMatch makes the writes of document id done with ctx conditional on the document still
+// being at version. The check is part of the write filter, so it holds even against writers
+// racing the caller; a write that finds another version fails with PreconditionFailed.
+func IfMatch(ctx context.Context, id string, version int) context.Context {
+	expected := map[string]int{}
+	if parent, ok := ctx.Value(ifMatchKey{}).(map[string]int); ok {
+		for k, v := range parent {
+			expected[k] = v
+		}
+	}
+	expected[id] = version
+	return context.WithValue(ctx, ifMatchKey{}, expected)
+}
+
+// ifMatch returns the version writes of id have to find in ctx, if they are conditional.
+func ifMatch(ctx context.Context, id string) (int, bool) {
+	expected, ok := ctx.Value(ifMatchKey{}).(map[string]int)
+	if !ok {
+		return 0, false
+	}
+	version, ok := expected[id]
+	return version, ok
+}
+
+// checkIfMatch fails when the caller read another version of id, current, than the one its
+// writes are conditional on. Failing early spares the write that would fail anyway.
+func checkIfMatch(ctx context.Context, id string, current int) error {
+	if version, ok := ifMatch(ctx, id); ok && version != current {
+		return apperr.New(apperr.PreconditionFailed, "%s is at version %d, not %d", id, current, version)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ProcessingStatus = "processing"
+	ProcessedStatus  = "processed"
+)
+
+type ProcessedMessageRepository interface {
+	Claim(ctx context.Context, key dhauli.ProcessedMessageKey, lockFor time.Duration, ttl time.Duration) (*dhauli.ProcessedMessage, bool, error)
+	Complete(ctx context.Context, key dhauli.ProcessedMessageKey, response []byte) error
+	Release(ctx context.Context, key dhauli.ProcessedMessageKey) error
+	Close()
+}
+
+type MongoProcessedMessageRepository struct {
+	log        *logger.Logger
+	collection *mongo.Collection
+}
+
+// NewProcessedMessageRepository makes sure records disappear once they expire, so the
+// collection does not grow with every message ever consumed.
+func NewProcessedMessageRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string) *MongoProcessedMessageRepository {
+	col := client.Database(cfg.Mongo.Database).Collection(collection)
+	ttlIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	if _, err := col.Indexes().CreateOne(context.Background(), ttlIndex); err != nil {
+		log.Errorf("Error creating expiry index on %s: %v", collection, err)
+	}
+	return &MongoProcessedMessageRepository{
+		log:        log,
+		collection: col,
+	}
+}
+
+// Claim reserves key for the caller, which then owns it until lockFor has passed. When the key
+// is taken it returns the current record and false: either a finished message with its response
+// or one still being processed by someone else. A lock left behind by a crashed consumer is
+// taken over once it expired.
+func (mpr *MongoProcessedMessageRepository) Claim(ctx context.Context, key dhauli.ProcessedMessageKey, lockFor time.Duration, ttl time.Duration) (*dhauli.ProcessedMessage, bool, error) {
+	now := time.Now()
+	record := dhauli.ProcessedMessage{
+		ID:          key,
+		Status:      ProcessingStatus,
+		LockedUntil: now.Add(lockFor),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	_, err := mpr.collection.InsertOne(ctx, record)
+	if err == nil {
+		return &record, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		mpr.log.Errorf("Error claiming message %v: %v", key, err)
+		return nil, false, err
+	}
+
+	filter := bson.M{"_id": key, "status": ProcessingStatus, "lockedUntil": bson.M{"$lt": now}}
+	update := bson.M{"$set": bson.M{"lockedUntil": record.LockedUntil, "expiresAt": record.ExpiresAt}}
+	var taken dhauli.ProcessedMessage
+	err = mpr.collection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&taken)
+	if err == nil {
+		return &taken, true, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		mpr.log.Errorf("Error taking over message %v: %v", key, err)
+		return nil, false, err
+	}
+
+	var existing dhauli.ProcessedMessage
+	err = mpr.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&existing)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return mpr.Claim(ctx, key, lockFor, ttl) // released or expired meanwhile
+	}
+	if err != nil {
+		mpr.log.Errorf("Error getting processed message %v: %v", key, err)
+		return nil, false, err
+	}
+	return &existing, false, nil
+}
+
+func (mpr *MongoProcessedMessageRepository) Complete(ctx context.Context, key dhauli.ProcessedMessageKey, response []byte) error {
+	update := bson.M{"$set": bson.M{"status": ProcessedStatus, "response": response}}
+	if _, err := mpr.collection.UpdateOne(ctx, bson.M{"_id": key}, update); err != nil {
+		mpr.log.Errorf("Error completing message %v: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+func (mpr *MongoProcessedMessageRepository) Release(ctx context.Context, key dhauli.ProcessedMessageKey) error {
+	if _, err := mpr.collection.DeleteOne(ctx, bson.M{"_id": key, "status": ProcessingStatus}); err != nil {
+		mpr.log.Errorf("Error releasing message %v: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+func (mpr *MongoProcessedMessageRepository) Close() {
+	err := mpr.collection.Database().Client().Disconnect(context.Background())
+	if err != nil {
+		mpr.log.Errorf("Error closing mongo client for processed messages: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type RetentionAuditRepository interface {
+	Create(ctx context.Context, audit *dhauli.RetentionAudit) (*dhauli.RetentionAudit, error)
+	Page(ctx context.Context, filter map[string]interface{}, skip, limit int64) ([]*dhauli.RetentionAudit, int64, error)
+	SetMany(ctx context.Context, filter map[string]interface{}, fields map[string]interface{}) (int64, error)
+	Close()
+}
+
+type MongoRetentionAuditRepository struct {
+	log        *logger.Logger
+	collection *mongo.Collection
+}
+
+func NewRetentionAuditRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string) *MongoRetentionAuditRepository {
+	col := client.Database(cfg.Mongo.Database).Collection(collection)
+	return &MongoRetentionAuditRepository{
+		log:        log,
+		collection: col,
+	}
+}
+
+func (mar *MongoRetentionAuditRepository) Create(ctx context.Context, audit *dhauli.RetentionAudit) (*dhauli.RetentionAudit, error) {
+	if audit.ID == "" {
+		return nil, apperr.NewValidation("retention audit id cannot be empty")
+	}
+	audit.CreatedAt = time.Now()
+	if _, err := mar.collection.InsertOne(ctx, audit); err != nil {
+		mar.log.Errorf("Error inserting retention audit in mongo: %v", err)
+		return nil, err
+	}
+	return audit, nil
+}
+
+// Page returns the audit records matching filter newest first, along with the number of all
+// matching records.
+func (mar *MongoRetentionAuditRepository) Page(ctx context.Context, filter map[string]interface{}, skip, limit int64) ([]*dhauli.RetentionAudit, int64, error) {
+	total, err := mar.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		mar.log.Errorf("Error counting retention audit records: %v", err)
+		return nil, 0, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).SetSkip(skip).SetLimit(limit)
+	cursor, err := mar.collection.Find(ctx, filter, opts)
+	if err != nil {
+		mar.log.Errorf("Error finding retention audit records: %v", err)
+		return nil, 0, err
+	}
+	audits := []*dhauli.RetentionAudit{}
+	if err = cursor.All(ctx, &audits); err != nil {
+		mar.log.Errorf("Error decoding retention audit records: %v", err)
+		return nil, 0, err
+	}
+	return audits, total, nil
+}
+
+func (mar *MongoRetentionAuditRepository) SetMany(ctx context.Context, filter map[string]interface{}, fields map[string]interface{}) (int64, error) {
+	result, err := mar.collection.UpdateMany(ctx, filter, bson.M{"$set": fields})
+	if err != nil {
+		mar.log.Errorf("Error updating retention audit records in mongo: %v", err)
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (mar *MongoRetentionAuditRepository) Close() {
+	err := mar.collection.Database().Client().Disconnect(context.Background())
+	if err != nil {
+		mar.log.Errorf("Error closing mongo client for retention audit: %v", err)
+	}
+}
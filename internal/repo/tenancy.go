@@ -0,0 +1,63 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+)
+
+type ownerKey struct{}
+
+// WithOwner scopes every read and write made with ctx to the documents of the tenant of owner,
+// and makes owner the owner of the documents created with it. A caller without a tenant only
+// reaches documents without one. Without an owner, as in background jobs, nothing is scoped.
+func WithOwner(ctx context.Context, owner dhauli.Ownership) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+func OwnerFromContext(ctx context.Context) (dhauli.Ownership, bool) {
+	owner, ok := ctx.Value(ownerKey{}).(dhauli.Ownership)
+	return owner, ok
+}
+
+// scoped returns a copy of filter limited to the tenant of ctx.
+func scoped(ctx context.Context, filter map[string]interface{}) map[string]interface{} {
+	return scopedAt(ctx, "tenantId", filter)
+}
+
+// scopedAt is scoped for documents keeping their tenant in field.
+func scopedAt(ctx context.Context, field string, filter map[string]interface{}) map[string]interface{} {
+	owner, ok := OwnerFromContext(ctx)
+	if !ok {
+		return filter
+	}
+	result := make(map[string]interface{}, len(filter)+1)
+	for k, v := range filter {
+		result[k] = v
+	}
+	if owner.TenantID == "" {
+		// matches documents whose tenant is missing as well
+		result[field] = nil
+	} else {
+		result[field] = owner.TenantID
+	}
+	return result
+}
+
+// own fills in the ownership of a document about to be created with ctx, and refuses a document
+// of another tenant.
+func own(ctx context.Context, o *dhauli.Ownership) error {
+	owner, ok := OwnerFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if *o == (dhauli.Ownership{}) {
+		*o = owner
+		return nil
+	}
+	if o.TenantID != owner.TenantID {
+		return apperr.NewForbidden("cannot create a document of tenant %q on behalf of tenant %q", o.TenantID, owner.TenantID)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package repo
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// UnitOfWork groups the repositories whose writes have to succeed or fail together.
+// Every repository call made with the context handed to the Execute callback takes
+// part in the same Mongo session transaction.
+type UnitOfWork interface {
+	Conversations() ConversationRepository
+	Interactions() InteractionRepository
+	InteractionHistory() InteractionHistoryRepository
+	Execute(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type MongoUnitOfWork struct {
+	log                    *logger.Logger
+	client                 *mongo.Client
+	conversationRepo       ConversationRepository
+	interactionRepo        InteractionRepository
+	interactionHistoryRepo InteractionHistoryRepository
+}
+
+func NewMongoUnitOfWork(log *logger.Logger, client *mongo.Client, cRepo ConversationRepository, iRepo InteractionRepository, hRepo InteractionHistoryRepository) *MongoUnitOfWork {
+	return &MongoUnitOfWork{
+		log:                    log,
+		client:                 client,
+		conversationRepo:       cRepo,
+		interactionRepo:        iRepo,
+		interactionHistoryRepo: hRepo,
+	}
+}
+
+func (uow *MongoUnitOfWork) Conversations() ConversationRepository {
+	return uow.conversationRepo
+}
+
+func (uow *MongoUnitOfWork) Interactions() InteractionRepository {
+	return uow.interactionRepo
+}
+
+func (uow *MongoUnitOfWork) InteractionHistory() InteractionHistoryRepository {
+	return uow.interactionHistoryRepo
+}
+
+// Execute runs fn inside a session transaction and commits it when fn returns nil.
+// A call made while a transaction is already open on ctx joins that transaction, so
+// services can compose each other without starting nested transactions.
+// fn may be invoked more than once when Mongo reports a transient transaction error; only the
+// AfterCommit hooks of the attempt that committed are run.
+func (uow *MongoUnitOfWork) Execute(ctx context.Context, fn func(ctx context.Context) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+	session, err := uow.client.StartSession()
+	if err != nil {
+		uow.log.Errorf("Error starting mongo session: %v", err)
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	var hooks *commitHooks
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		hooks = &commitHooks{}
+		return nil, fn(context.WithValue(sc, commitHooksKey{}, hooks))
+	})
+	if err != nil {
+		uow.log.Errorf("Transaction aborted: %v", err)
+		return err
+	}
+	hooks.run()
+	return nil
+}
+
+type commitHooksKey struct{}
+
+type commitHooks struct {
+	mu  sync.Mutex
+	fns []func()
+}
+
+func (h *commitHooks) run() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, fn := range h.fns {
+		fn()
+	}
+}
+
+// AfterCommit defers fn until the transaction open on ctx has committed, so side effects such
+// as notifications never announce writes that were rolled back. Outside a transaction fn runs
+// immediately.
+func AfterCommit(ctx context.Context, fn func()) {
+	hooks, ok := ctx.Value(commitHooksKey{}).(*commitHooks)
+	if !ok {
+		fn()
+		return
+	}
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	hooks.fns = append(hooks.fns, fn)
+}
@@ -0,0 +1,95 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing wraps handling in a span named after the route.
+func Tracing(tr trace.Tracer) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope {
+			ctx, span := tr.Start(ctx, fmt.Sprintf("%s.%s", envelope.Message.Type, envelope.Message.Action),
+				trace.WithAttributes(
+					attribute.String("message.type", string(envelope.Message.Type)),
+					attribute.String("message.action", string(envelope.Message.Action)),
+					attribute.String("envelope.kind", string(envelope.Kind)),
+				),
+			)
+			defer span.End()
+			response := next(ctx, envelope)
+			if response != nil && (response.Kind == messaging.ERROR || response.EventName == "error") {
+				span.SetStatus(codes.Error, string(response.EventName))
+			}
+			return response
+		}
+	}
+}
+
+// Logging logs every message with the outcome and how long it took.
+func Logging(log *logger.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope {
+			start := time.Now()
+			response := next(ctx, envelope)
+			outcome := "no response"
+			if response != nil {
+				outcome = string(response.EventName)
+			}
+			log.Infof("Handled %s %s.%s message %s (correlation %s): %s in %s", envelope.Kind, envelope.Message.Type,
+				envelope.Message.Action, envelope.Message.ID, envelope.CorrelationId, outcome, time.Since(start))
+			return response
+		}
+	}
+}
+
+// Validation rejects envelopes that cannot be routed before any work is done for them.
+func Validation() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope {
+			switch {
+			case envelope.Kind == "":
+				return messaging.EnvelopeError(*envelope, "missing kind", true)
+			case envelope.Message.Type == "" || envelope.Message.Action == "":
+				return Error(envelope, apperr.NewValidation("message type and action are required"))
+			}
+			return next(ctx, envelope)
+		}
+	}
+}
+
+// Idempotency processes every idempotency key once, for the kinds whose policy asks for it. A
+// redelivered message gets the response of its first processing, re-addressed to the
+// correlation id it arrived with.
+func Idempotency(log *logger.Logger, idempotency svc.IdempotencyService) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope {
+			if envelope.IdempotencyKey == "" || !PolicyFor(envelope.Kind).Idempotent {
+				return next(ctx, envelope)
+			}
+			response, replayed, err := idempotency.Process(ctx, envelope.IdempotencyKey, func(ctx context.Context) (*messaging.Envelope, bool) {
+				response := next(ctx, envelope)
+				return response, response != nil && response.Kind == messaging.RESPONSE && response.EventName == "success"
+			})
+			if err != nil {
+				log.Errorf("Error processing message with idempotency key %s: %v", envelope.IdempotencyKey, err)
+				return Error(envelope, err)
+			}
+			if replayed {
+				log.Infof("Replaying response for duplicate message with idempotency key %s", envelope.IdempotencyKey)
+				response.CorrelationId = envelope.CorrelationId
+				response.TraceId = envelope.TraceId
+			}
+			return response
+		}
+	}
+}
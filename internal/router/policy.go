@@ -0,0 +1,26 @@
+package router
+
+import "github.com/mangudaigb/dhauli-base/consumer/messaging"
+
+// Policy says how a message of some kind is processed and answered.
+type Policy struct {
+	// Respond sends the outcome back to the sender. Commands and events are fire-and-forget, a
+	// failure of theirs is only retried and dead-lettered.
+	Respond bool
+	// Idempotent processes every idempotency key once and replays the stored outcome. Queries
+	// skip it, they change nothing and may be answered as often as they are asked.
+	Idempotent bool
+}
+
+var policies = map[messaging.Kind]Policy{
+	messaging.REQUEST: {Respond: true, Idempotent: true},
+	messaging.QUERY:   {Respond: true},
+	messaging.COMMAND: {Idempotent: true},
+	messaging.EVENT:   {Idempotent: true},
+}
+
+// PolicyFor returns the policy of kind. Kinds this service does not consume, like responses,
+// are never answered so two services cannot bounce a message between them.
+func PolicyFor(kind messaging.Kind) Policy {
+	return policies[kind]
+}
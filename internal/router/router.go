@@ -0,0 +1,121 @@
+// Package router dispatches Kafka envelopes to the handler registered for their message type,
+// action and envelope kind.
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+type HandlerFunc func(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope
+
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type Route struct {
+	Type   messaging.Type
+	Action messaging.Action
+	Kind   messaging.Kind
+}
+
+func (r Route) String() string {
+	return fmt.Sprintf("%s %s.%s", r.Kind, r.Type, r.Action)
+}
+
+type Router struct {
+	log        *logger.Logger
+	routes     map[Route]HandlerFunc
+	middleware []Middleware
+}
+
+func NewRouter(log *logger.Logger) *Router {
+	return &Router{
+		log:    log,
+		routes: make(map[Route]HandlerFunc),
+	}
+}
+
+// Use adds middleware around every dispatch. The first one added is the outermost.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handle registers h for route. Registering a route twice is a programming error.
+func (r *Router) Handle(route Route, h HandlerFunc) {
+	if _, ok := r.routes[route]; ok {
+		panic("router: duplicate route " + route.String())
+	}
+	r.routes[route] = h
+}
+
+// Routes lists the registered routes, for logging at startup.
+func (r *Router) Routes() []Route {
+	routes := make([]Route, 0, len(r.routes))
+	for route := range r.routes {
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// HandlerFunc returns the dispatcher wrapped in all middleware.
+func (r *Router) HandlerFunc() HandlerFunc {
+	h := r.dispatch
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	return h
+}
+
+func (r *Router) dispatch(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope {
+	route := Route{Type: envelope.Message.Type, Action: envelope.Message.Action, Kind: envelope.Kind}
+	h, ok := r.routes[route]
+	if !ok {
+		r.log.Errorf("No handler for %s", route)
+		return Error(envelope, apperr.NewNotFound("no handler for %s", route))
+	}
+	return h(ctx, envelope)
+}
+
+// Typed decodes the message data into a T and answers with whatever handle returns, as a
+// success response of the same type and action.
+func Typed[T any](log *logger.Logger, handle func(ctx context.Context, msg messaging.Message, req T) (any, error)) HandlerFunc {
+	return func(ctx context.Context, envelope *messaging.Envelope) *messaging.Envelope {
+		var req T
+		if err := envelope.Message.DecodeData(&req); err != nil {
+			log.Errorf("Error decoding data of message %s: %v", envelope.Message.ID, err)
+			return Error(envelope, apperr.Wrap(apperr.Validation, err, "undecodable message data"))
+		}
+		out, err := handle(ctx, envelope.Message, req)
+		if err != nil {
+			return Error(envelope, err)
+		}
+		return Success(envelope, out)
+	}
+}
+
+// Success answers envelope with data.
+func Success(envelope *messaging.Envelope, data any) *messaging.Envelope {
+	message, err := messaging.NewMessageFromOld(envelope.Message, envelope.Message.Type, envelope.Message.Action, data)
+	if err != nil {
+		return messaging.MessageError(envelope, 500, errors.New("error creating response message"), false)
+	}
+	response := messaging.NewEnvelope(
+		message,
+		messaging.WithCorrelationId(envelope.CorrelationId),
+		messaging.WithTraceId(envelope.TraceId),
+		messaging.WithIdempotencyKey(envelope.IdempotencyKey),
+		messaging.WithKind(messaging.RESPONSE),
+		messaging.WithEventName("success"),
+	)
+	return &response
+}
+
+// Error answers envelope with err. The code is the HTTP status of its kind, and retries are
+// skipped for the kinds a retry cannot fix.
+func Error(envelope *messaging.Envelope, err error) *messaging.Envelope {
+	return messaging.MessageError(envelope, apperr.Status(err), errors.New(apperr.Detail(err)), !apperr.Retryable(err))
+}
@@ -0,0 +1,140 @@
+// Package settings holds the configuration specific to this service. It is read from the same
+// application.yaml as the shared dhauli-base config, which has to be loaded first.
+package settings
+
+import (
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/spf13/viper"
+)
+
+type Settings struct {
+	Events struct {
+		Topic string `mapstructure:"topic"`
+	} `mapstructure:"events"`
+	Idempotency struct {
+		TTL time.Duration `mapstructure:"ttl"`
+	} `mapstructure:"idempotency"`
+	Retry struct {
+		Topic           string        `mapstructure:"topic"`
+		DeadLetterTopic string        `mapstructure:"deadLetterTopic"`
+		MaxRetries      int           `mapstructure:"maxRetries"`
+		InitialDelay    time.Duration `mapstructure:"initialDelay"`
+		MaxDelay        time.Duration `mapstructure:"maxDelay"`
+	} `mapstructure:"retry"`
+	Consumer struct {
+		Workers    int `mapstructure:"workers"`
+		QueueDepth int `mapstructure:"queueDepth"`
+		// EventTopics are topics of other services whose events this service reacts to.
+		EventTopics []string `mapstructure:"eventTopics"`
+		// TrustedTopics are the topics only other services can write to, as the ACLs of the
+		// brokers enforce. Their messages skip the access control lists of conversations and are
+		// only confined to their tenant.
+		TrustedTopics []string `mapstructure:"trustedTopics"`
+	} `mapstructure:"consumer"`
+	Sweeper struct {
+		Interval time.Duration `mapstructure:"interval"`
+		// Remove deletes the orphans found; otherwise they are only reported.
+		Remove bool `mapstructure:"remove"`
+	} `mapstructure:"sweeper"`
+	Trash struct {
+		// PurgeAfter is how long a deleted conversation stays restorable.
+		PurgeAfter    time.Duration `mapstructure:"purgeAfter"`
+		PurgeInterval time.Duration `mapstructure:"purgeInterval"`
+	} `mapstructure:"trash"`
+	Retention struct {
+		Interval  time.Duration `mapstructure:"interval"`
+		BatchSize int64         `mapstructure:"batchSize"`
+		// DryRun only reports the conversations the rules would expire.
+		DryRun bool            `mapstructure:"dryRun"`
+		Rules  []RetentionRule `mapstructure:"rules"`
+	} `mapstructure:"retention"`
+	Privacy struct {
+		// SigningKey signs the reports of completed erasures. Reports stay unsigned without it.
+		SigningKey string `mapstructure:"signingKey"`
+	} `mapstructure:"privacy"`
+	Cluster struct {
+		// Secret is the bearer token instances present to each other on the internal routes.
+		// Without it the internal routes are not served and changes are not forwarded to peers.
+		Secret string `mapstructure:"secret"`
+	} `mapstructure:"cluster"`
+	Auth Auth `mapstructure:"auth"`
+}
+
+// Auth configures the bearer tokens of the REST API. Tokens are JWTs signed with RS256 or ES256
+// by one of the public keys in KeyFiles and JWKSFiles, or with HS256 by HMACSecret.
+type Auth struct {
+	// Enabled requires a token on every route but the internal ones. Otherwise the identity
+	// headers set by the gateway are trusted, and conversations cannot be shared.
+	Enabled    bool          `mapstructure:"enabled"`
+	Issuer     string        `mapstructure:"issuer"`
+	Audience   string        `mapstructure:"audience"`
+	Leeway     time.Duration `mapstructure:"leeway"`
+	HMACSecret string        `mapstructure:"hmacSecret"`
+	// KeyFiles are PEM encoded public keys or certificates.
+	KeyFiles  []string `mapstructure:"keyFiles"`
+	JWKSFiles []string `mapstructure:"jwksFiles"`
+	// AdminScope is the scope the admin routes require.
+	AdminScope string `mapstructure:"adminScope"`
+	// Origins are the origins of the pages, other than the service's own, allowed to open live
+	// connections, as in "https://app.example.com".
+	Origins []string `mapstructure:"origins"`
+	// AdminToken is the bearer token the admin routes require when Enabled is off. With neither
+	// set the admin routes are not served.
+	AdminToken string `mapstructure:"adminToken"`
+	// Claims name the claims holding the organization, tenant and group of the caller, the name
+	// of the caller and the space separated scopes. The caller itself is the subject.
+	Claims struct {
+		Organization string `mapstructure:"organization"`
+		Tenant       string `mapstructure:"tenant"`
+		Group        string `mapstructure:"group"`
+		Name         string `mapstructure:"name"`
+		Scope        string `mapstructure:"scope"`
+	} `mapstructure:"claims"`
+}
+
+// RetentionRule expires the conversations of a tenant, workflow or user, or any combination of
+// them, that saw no activity for MaxAge. A rule naming none of them applies to all conversations.
+// When several rules match a conversation the most specific one wins: a user over a workflow over
+// a tenant.
+type RetentionRule struct {
+	Name     string        `mapstructure:"name"`
+	Tenant   string        `mapstructure:"tenant"`
+	Workflow string        `mapstructure:"workflow"`
+	User     string        `mapstructure:"user"`
+	MaxAge   time.Duration `mapstructure:"maxAge"`
+}
+
+func Load(cfg *config.Config) (*Settings, error) {
+	viper.SetDefault("events.topic", "conversation-events")
+	viper.SetDefault("idempotency.ttl", 24*time.Hour)
+	viper.SetDefault("retry.topic", cfg.Kafka.Topic+".retry")
+	viper.SetDefault("retry.deadLetterTopic", cfg.Kafka.Topic+".dlq")
+	viper.SetDefault("retry.maxRetries", 3)
+	viper.SetDefault("retry.initialDelay", time.Second)
+	viper.SetDefault("retry.maxDelay", 5*time.Minute)
+	viper.SetDefault("consumer.workers", 8)
+	viper.SetDefault("consumer.queueDepth", 64)
+	viper.SetDefault("sweeper.interval", time.Hour)
+	viper.SetDefault("sweeper.remove", false)
+	viper.SetDefault("trash.purgeAfter", 30*24*time.Hour)
+	viper.SetDefault("trash.purgeInterval", time.Hour)
+	viper.SetDefault("retention.interval", 6*time.Hour)
+	viper.SetDefault("retention.batchSize", 100)
+	viper.SetDefault("retention.dryRun", false)
+	viper.SetDefault("auth.enabled", false)
+	viper.SetDefault("auth.leeway", 30*time.Second)
+	viper.SetDefault("auth.adminScope", "conversations:admin")
+	viper.SetDefault("auth.claims.organization", "org")
+	viper.SetDefault("auth.claims.tenant", "tenant")
+	viper.SetDefault("auth.claims.group", "group")
+	viper.SetDefault("auth.claims.name", "name")
+	viper.SetDefault("auth.claims.scope", "scope")
+
+	s := &Settings{}
+	if err := viper.Unmarshal(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,199 @@
+package svc
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	changeReplayLimit        = 500
+	changeSubscriptionBuffer = 256
+)
+
+// ChangeBroadcaster hands changes committed on this instance to the other instances of the service.
+type ChangeBroadcaster interface {
+	Broadcast(changes []dhauli.ChangeEvent)
+}
+
+// ChangeService records every mutation of a conversation as an event with a per-conversation
+// sequence and pushes it to live subscribers. Events, and the domain event put in the outbox for
+// them, are written in the transaction of the mutation and only published once it committed, so
+// nobody sees a rolled back change and a subscriber can always resume from the last sequence it
+// received.
+type ChangeService interface {
+	Record(ctx context.Context, cid, iid, changeType, actor string, data any) error
+	Since(ctx context.Context, cid string, seq int64) ([]*dhauli.ChangeEvent, error)
+	Subscribe() *ChangeSubscription
+	Deliver(changes []dhauli.ChangeEvent)
+}
+
+// ChangeSubscription receives the events of the conversations added to it. A subscriber that
+// does not keep up is dropped: Events is closed and Overflowed reports true, after which the
+// client is expected to resume from its last sequence.
+type ChangeSubscription struct {
+	mu            sync.Mutex
+	conversations map[string]bool
+	events        chan dhauli.ChangeEvent
+	closed        bool
+	overflowed    bool
+	hub           *changeService
+}
+
+func (s *ChangeSubscription) Add(cid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversations[cid] = true
+}
+
+func (s *ChangeSubscription) Remove(cid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conversations, cid)
+}
+
+func (s *ChangeSubscription) Events() <-chan dhauli.ChangeEvent {
+	return s.events
+}
+
+func (s *ChangeSubscription) Overflowed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.overflowed
+}
+
+func (s *ChangeSubscription) Close() {
+	s.hub.unsubscribe(s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
+
+func (s *ChangeSubscription) offer(change dhauli.ChangeEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || !s.conversations[change.ConversationID] {
+		return true
+	}
+	select {
+	case s.events <- change:
+		return true
+	default:
+		s.overflowed = true
+		s.closed = true
+		close(s.events)
+		return false
+	}
+}
+
+type changeService struct {
+	log         *logger.Logger
+	repo        repo.ChangeRepository
+	broadcaster ChangeBroadcaster
+	outbox      OutboxService
+	mu          sync.RWMutex
+	subscribers map[*ChangeSubscription]struct{}
+}
+
+func NewChangeService(log *logger.Logger, repo repo.ChangeRepository, broadcaster ChangeBroadcaster, outbox OutboxService) ChangeService {
+	return &changeService{
+		log:         log,
+		repo:        repo,
+		broadcaster: broadcaster,
+		outbox:      outbox,
+		subscribers: make(map[*ChangeSubscription]struct{}),
+	}
+}
+
+func (cs *changeService) Record(ctx context.Context, cid, iid, changeType, actor string, data any) error {
+	var payload json.RawMessage
+	if data != nil {
+		var err error
+		if payload, err = json.Marshal(data); err != nil {
+			cs.log.Errorf("Error encoding %s change of conversation %s: %v", changeType, cid, err)
+			return err
+		}
+	}
+	seq, err := cs.repo.NextSeq(ctx, cid)
+	if err != nil {
+		return err
+	}
+	change := dhauli.ChangeEvent{
+		ID:             primitive.NewObjectID().Hex(),
+		ConversationID: cid,
+		Seq:            seq,
+		Type:           changeType,
+		InteractionID:  iid,
+		Actor:          actor,
+		Data:           payload,
+		CreatedAt:      time.Now(),
+	}
+	if _, err = cs.repo.Create(ctx, &change); err != nil {
+		return err
+	}
+	if envelope, ok := domainEvent(ctx, change, data); ok && cs.outbox != nil {
+		if err = cs.outbox.Enqueue(ctx, envelope); err != nil {
+			return err
+		}
+	}
+	repo.AfterCommit(ctx, func() {
+		cs.publish(change)
+		if cs.broadcaster != nil {
+			cs.broadcaster.Broadcast([]dhauli.ChangeEvent{change})
+		}
+	})
+	return nil
+}
+
+func (cs *changeService) Since(ctx context.Context, cid string, seq int64) ([]*dhauli.ChangeEvent, error) {
+	return cs.repo.Since(ctx, cid, seq, changeReplayLimit)
+}
+
+func (cs *changeService) Subscribe() *ChangeSubscription {
+	sub := &ChangeSubscription{
+		conversations: make(map[string]bool),
+		events:        make(chan dhauli.ChangeEvent, changeSubscriptionBuffer),
+		hub:           cs,
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Deliver publishes changes committed on another instance to the local subscribers.
+func (cs *changeService) Deliver(changes []dhauli.ChangeEvent) {
+	for _, change := range changes {
+		cs.publish(change)
+	}
+}
+
+func (cs *changeService) publish(change dhauli.ChangeEvent) {
+	cs.mu.RLock()
+	var dropped []*ChangeSubscription
+	for sub := range cs.subscribers {
+		if !sub.offer(change) {
+			dropped = append(dropped, sub)
+		}
+	}
+	cs.mu.RUnlock()
+	for _, sub := range dropped {
+		cs.log.Infof("Dropping change subscriber that fell behind on conversation %s", change.ConversationID)
+		cs.unsubscribe(sub)
+	}
+}
+
+func (cs *changeService) unsubscribe(sub *ChangeSubscription) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.subscribers, sub)
+}
@@ -0,0 +1,93 @@
+package svc
+
+import (
+	"context"
+
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+)
+
+type principalKey struct{}
+type correlationIdKey struct{}
+type actorKey struct{}
+type authInfoKey struct{}
+type claimedKey struct{}
+
+// WithPrincipal records on whose behalf the mutations made with ctx are performed, so the domain
+// events they produce can carry it. It also confines ctx to the tenant of the principal.
+func WithPrincipal(ctx context.Context, principal *messaging.Principal) context.Context {
+	if principal != nil {
+		ctx = repo.WithOwner(ctx, OwnershipOf(principal))
+	}
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// OwnershipOf returns the ownership of the documents created on behalf of principal.
+func OwnershipOf(principal *messaging.Principal) dhauli.Ownership {
+	return dhauli.Ownership{
+		OrganizationID: principal.Organization.ID,
+		TenantID:       principal.Tenant.ID,
+		GroupID:        principal.Group.ID,
+	}
+}
+
+func PrincipalFromContext(ctx context.Context) *messaging.Principal {
+	principal, _ := ctx.Value(principalKey{}).(*messaging.Principal)
+	return principal
+}
+
+// WithAuthInfo records how the principal of ctx was authenticated, for the domain events.
+func WithAuthInfo(ctx context.Context, info *messaging.AuthInfo) context.Context {
+	return context.WithValue(ctx, authInfoKey{}, info)
+}
+
+func AuthInfoFromContext(ctx context.Context) *messaging.AuthInfo {
+	info, _ := ctx.Value(authInfoKey{}).(*messaging.AuthInfo)
+	return info
+}
+
+// WithClaimedIdentity marks the principal of ctx as claimed by the caller instead of verified, as
+// with the identity headers of the gateway. A claimed identity reaches only the conversations it
+// owns: anyone could claim to be the user a conversation is shared with.
+func WithClaimedIdentity(ctx context.Context) context.Context {
+	return context.WithValue(ctx, claimedKey{}, true)
+}
+
+func identityClaimed(ctx context.Context) bool {
+	claimed, _ := ctx.Value(claimedKey{}).(bool)
+	return claimed
+}
+
+// WithCorrelationId ties the domain events produced with ctx to the request that caused them.
+func WithCorrelationId(ctx context.Context, correlationId string) context.Context {
+	return context.WithValue(ctx, correlationIdKey{}, correlationId)
+}
+
+func CorrelationIdFromContext(ctx context.Context) string {
+	correlationId, _ := ctx.Value(correlationIdKey{}).(string)
+	return correlationId
+}
+
+// WithActor names who performs the mutations made with ctx, for the writes whose calls do not
+// say so themselves.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorOf returns the actor set with WithActor, falling back to the user of the principal.
+func actorOf(ctx context.Context) string {
+	if actor, _ := ctx.Value(actorKey{}).(string); actor != "" {
+		return actor
+	}
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		return principal.User.ID
+	}
+	return ""
+}
+
+// WithIfMatch makes the writes of entity id done with ctx conditional on it still being at
+// version, failing them with PreconditionFailed otherwise.
+func WithIfMatch(ctx context.Context, id string, version int) context.Context {
+	return repo.IfMatch(ctx, id, version)
+}
@@ -0,0 +1,89 @@
+package svc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/merge"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+)
+
+// MergeAction is the history action of a context edit that was merged into newer changes.
+const MergeAction = "merge"
+
+// MergeConflictError reports a context edit based on BaseVersion that could not be merged into
+// the changes made up to CurrentVersion. It is a Conflict.
+type MergeConflictError struct {
+	InteractionID  string           `json:"interactionId"`
+	BaseVersion    int              `json:"baseVersion"`
+	CurrentVersion int              `json:"currentVersion"`
+	Conflicts      []merge.Conflict `json:"conflicts"`
+}
+
+func (e *MergeConflictError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e *MergeConflictError) Unwrap() error {
+	lines := make([]int, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		lines[i] = c.Line
+	}
+	return apperr.NewConflict("context of interaction %s based on version %d conflicts with version %d at lines %v",
+		e.InteractionID, e.BaseVersion, e.CurrentVersion, lines)
+}
+
+// MergeContextInInteraction updates the context like UpdateContextInInteraction but, when version
+// is stale, merges the edit line by line into what changed since instead of failing. The base is
+// the context at version as kept in the history. A clean merge is applied as a change of its own
+// with the action MergeAction; otherwise nothing is written and a *MergeConflictError is returned.
+func (cs interactionService) MergeContextInInteraction(ctx context.Context, iid, edited, actor, action string, version int) (*dhauli.Interaction, error) {
+	var updated *dhauli.Interaction
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		current, err := cs.GetInteractionById(ctx, iid)
+		if err != nil {
+			cs.log.Errorf("Error getting interaction for id: %s err: %v", iid, err)
+			return err
+		}
+		if version <= 0 || version == current.Version {
+			updated, err = cs.UpdateContextInInteraction(ctx, iid, edited, actor, action, current.Version)
+			return err
+		}
+		if version > current.Version {
+			return apperr.New(apperr.PreconditionFailed, "interaction version mismatch: expected %d, actual %d", version, current.Version)
+		}
+		base, err := cs.historySvc.GetSnapshotAtVersion(ctx, iid, version)
+		if err != nil {
+			if apperr.KindOf(err) == apperr.NotFound {
+				return apperr.Wrap(apperr.PreconditionFailed, err, "version %d of interaction %s cannot be merged: %s", version, iid, apperr.Detail(err))
+			}
+			return err
+		}
+		merged, conflicts, err := merge.ThreeWay(base.Context, edited, current.Context)
+		if errors.Is(err, merge.ErrTooLarge) {
+			return apperr.Wrap(apperr.Conflict, err, "context of interaction %s is too large to merge", iid)
+		}
+		if len(conflicts) > 0 {
+			cs.log.Infof("Context edit of interaction %s based on version %d conflicts with version %d in %d places", iid, version, current.Version, len(conflicts))
+			return &MergeConflictError{InteractionID: iid, BaseVersion: version, CurrentVersion: current.Version, Conflicts: conflicts}
+		}
+		updated, err = cs.applyChange(ctx, iid, interactionChange{
+			field:      "context",
+			changeType: contracts.InteractionChangeContextUpdated,
+			actor:      actor,
+			action:     MergeAction,
+			version:    current.Version,
+			mutate: func(in *dhauli.Interaction) error {
+				in.Context = merged
+				return nil
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
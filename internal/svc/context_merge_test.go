@@ -0,0 +1,219 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+// The fakes embed the interfaces they stand in for and implement only what merging a context
+// edit uses; anything else panics.
+
+type fakeUnitOfWork struct {
+	repo.UnitOfWork
+	interactions *fakeInteractions
+}
+
+func (u fakeUnitOfWork) Interactions() repo.InteractionRepository {
+	return u.interactions
+}
+
+func (u fakeUnitOfWork) Execute(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+type fakeInteractions struct {
+	repo.InteractionRepository
+	interaction dhauli.Interaction
+}
+
+func (r *fakeInteractions) GetById(ctx context.Context, id string) (*dhauli.Interaction, error) {
+	if id != r.interaction.ID {
+		return nil, apperr.NewNotFound("interaction %s not found", id)
+	}
+	in := r.interaction
+	return &in, nil
+}
+
+func (r *fakeInteractions) Update(ctx context.Context, in *dhauli.Interaction) (*dhauli.Interaction, error) {
+	in.Version++
+	r.interaction = *in
+	updated := *in
+	return &updated, nil
+}
+
+type fakeHistory struct {
+	InteractionHistoryService
+	contexts map[int]string
+	actions  []string
+}
+
+func (h *fakeHistory) GetSnapshotAtVersion(ctx context.Context, iid string, version int) (*dhauli.InteractionHistory, error) {
+	c, ok := h.contexts[version]
+	if !ok {
+		return nil, apperr.NewNotFound("version %d of interaction %s not found", version, iid)
+	}
+	return &dhauli.InteractionHistory{InteractionID: iid, Context: c}, nil
+}
+
+func (h *fakeHistory) AddHistoryForAnswer(ctx context.Context, in *dhauli.Interaction, actor, action, answerId string) (*dhauli.InteractionHistory, error) {
+	h.actions = append(h.actions, action)
+	return &dhauli.InteractionHistory{InteractionID: in.ID, Action: action, Actor: actor, Context: in.Context}, nil
+}
+
+type fakeChanges struct {
+	ChangeService
+}
+
+func (fakeChanges) Record(ctx context.Context, cid, iid, changeType, actor string, data any) error {
+	return nil
+}
+
+func TestMergeContextInInteraction(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logger.Level = "fatal"
+	log, err := logger.NewLogger(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version 1 had the context "a\nb\nc", version 2 changed its last line
+	history := map[int]string{1: "a\nb\nc", 2: "a\nb\nC"}
+
+	tests := []struct {
+		name          string
+		edited        string
+		version       int
+		context       string
+		action        string
+		kind          apperr.Kind
+		conflictLines []int
+	}{
+		{
+			name:    "edit of the current version",
+			edited:  "a\nb\nC\nd",
+			version: 2,
+			context: "a\nb\nC\nd",
+			action:  "edit",
+		},
+		{
+			name:    "edit without a version",
+			edited:  "x",
+			version: 0,
+			context: "x",
+			action:  "edit",
+		},
+		{
+			name:    "stale edit of another line",
+			edited:  "A\nb\nc",
+			version: 1,
+			context: "A\nb\nC",
+			action:  MergeAction,
+		},
+		{
+			name:    "stale edit inserting at the start",
+			edited:  "z\na\nb\nc",
+			version: 1,
+			context: "z\na\nb\nC",
+			action:  MergeAction,
+		},
+		{
+			name:    "stale edit making the same change",
+			edited:  "a\nb\nC",
+			version: 1,
+			context: "a\nb\nC",
+			action:  MergeAction,
+		},
+		{
+			name:          "stale edit of the changed line",
+			edited:        "a\nb\nc2",
+			version:       1,
+			kind:          apperr.Conflict,
+			conflictLines: []int{3},
+		},
+		{
+			name:          "stale edit deleting the changed line",
+			edited:        "a\nb",
+			version:       1,
+			kind:          apperr.Conflict,
+			conflictLines: []int{3},
+		},
+		{
+			name:    "version from the future",
+			edited:  "x",
+			version: 5,
+			kind:    apperr.PreconditionFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interactions := &fakeInteractions{interaction: dhauli.Interaction{ID: "i1", ConversationID: "c1", Context: "a\nb\nC", Version: 2}}
+			hist := &fakeHistory{contexts: history}
+			is := interactionService{
+				log:                   log,
+				uow:                   fakeUnitOfWork{interactions: interactions},
+				interactionRepository: interactions,
+				historySvc:            hist,
+				changeSvc:             fakeChanges{},
+			}
+
+			updated, err := is.MergeContextInInteraction(context.Background(), "i1", tt.edited, "u1", "edit", tt.version)
+			if tt.kind != "" {
+				if apperr.KindOf(err) != tt.kind {
+					t.Fatalf("MergeContextInInteraction() error = %v, want kind %s", err, tt.kind)
+				}
+				var conflict *MergeConflictError
+				if errors.As(err, &conflict) != (tt.conflictLines != nil) {
+					t.Fatalf("MergeContextInInteraction() error = %v, want merge conflict %v", err, tt.conflictLines != nil)
+				}
+				for i, line := range tt.conflictLines {
+					if i >= len(conflict.Conflicts) || conflict.Conflicts[i].Line != line {
+						t.Errorf("conflicts = %+v, want lines %v", conflict.Conflicts, tt.conflictLines)
+					}
+				}
+				if interactions.interaction.Context != "a\nb\nC" || interactions.interaction.Version != 2 {
+					t.Errorf("interaction changed to version %d with context %q", interactions.interaction.Version, interactions.interaction.Context)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeContextInInteraction() error = %v", err)
+			}
+			if updated.Context != tt.context {
+				t.Errorf("context = %q, want %q", updated.Context, tt.context)
+			}
+			if updated.Version != 3 {
+				t.Errorf("version = %d, want 3", updated.Version)
+			}
+			if len(hist.actions) != 1 || hist.actions[0] != tt.action {
+				t.Errorf("history actions = %v, want [%s]", hist.actions, tt.action)
+			}
+		})
+	}
+}
+
+func TestMergeContextInInteractionWithoutBase(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Logger.Level = "fatal"
+	log, err := logger.NewLogger(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interactions := &fakeInteractions{interaction: dhauli.Interaction{ID: "i1", Context: "b", Version: 3}}
+	is := interactionService{
+		log:                   log,
+		uow:                   fakeUnitOfWork{interactions: interactions},
+		interactionRepository: interactions,
+		historySvc:            &fakeHistory{},
+		changeSvc:             fakeChanges{},
+	}
+	_, err = is.MergeContextInInteraction(context.Background(), "i1", "a", "u1", "edit", 1)
+	if apperr.KindOf(err) != apperr.PreconditionFailed {
+		t.Errorf("MergeContextInInteraction() error = %v, want kind %s", err, apperr.PreconditionFailed)
+	}
+}
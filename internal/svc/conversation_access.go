@@ -0,0 +1,130 @@
+package svc
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+)
+
+// Authorize checks that the acting user holds at least role on conversation cid, which may be in
+// the trash. A user without any role on it is told it does not exist. Grants only count for
+// verified identities, a claimed one is at most the owner.
+func (cs conversationService) Authorize(ctx context.Context, cid string, role string) error {
+	uid := actorOf(ctx)
+	if uid == "" {
+		return apperr.New(apperr.Unauthorized, "the user acting on conversation %s is unknown", cid)
+	}
+	c, err := cs.repo.GetByID(ctx, cid)
+	if err != nil {
+		return err
+	}
+	gid, tid := membershipOf(ctx)
+	held := c.RoleOf(uid, gid, tid)
+	if identityClaimed(ctx) && held != dhauli.RoleOwner {
+		held = ""
+	}
+	if held == "" {
+		return apperr.NewNotFound("conversation %s not found", cid)
+	}
+	if !dhauli.Allows(held, role) {
+		return apperr.NewForbidden("user %s is %s of conversation %s, not %s", uid, held, cid, role)
+	}
+	return nil
+}
+
+// AuthorizeInteraction is Authorize for the conversation interaction iid belongs to, which it
+// returns.
+func (cs conversationService) AuthorizeInteraction(ctx context.Context, iid string, role string) (string, error) {
+	in, err := cs.uow.Interactions().GetById(ctx, iid)
+	if err != nil {
+		return "", err
+	}
+	if err = cs.Authorize(ctx, in.ConversationID, role); err != nil {
+		return "", err
+	}
+	return in.ConversationID, nil
+}
+
+// ShareConversation grants grant.Role to the user, group or tenant of grant, replacing what it was
+// granted before. Conversations are only shared within their own tenant, and only by verified
+// identities.
+func (cs conversationService) ShareConversation(ctx context.Context, cid string, grant dhauli.Grant) (*dhauli.Conversation, error) {
+	if identityClaimed(ctx) {
+		return nil, apperr.NewForbidden("conversations can only be shared with authentication enabled")
+	}
+	if !dhauli.ValidRole(grant.Role) {
+		return nil, apperr.NewValidation("role must be %s, %s or %s", dhauli.RoleViewer, dhauli.RoleEditor, dhauli.RoleOwner)
+	}
+	if err := validGrantee(grant); err != nil {
+		return nil, err
+	}
+	grant.GrantedBy = actorOf(ctx)
+	grant.GrantedAt = time.Now()
+	return cs.updateConversation(ctx, cid, ConversationActionShare, func(c *dhauli.Conversation) error {
+		if grant.User != nil && grant.User.ID == c.UserID {
+			return apperr.NewValidation("user %s already owns conversation %s", c.UserID, cid)
+		}
+		if grant.Tenant != nil && grant.Tenant.ID != c.TenantID {
+			return apperr.NewValidation("conversation %s cannot be shared outside its tenant", cid)
+		}
+		c.ACL = slices.DeleteFunc(c.ACL, func(g dhauli.Grant) bool { return g.Grantee() == grant.Grantee() })
+		c.ACL = append(c.ACL, grant)
+		return nil
+	})
+}
+
+// UnshareConversation revokes what was granted to the user, group or tenant of grant.
+func (cs conversationService) UnshareConversation(ctx context.Context, cid string, grant dhauli.Grant) (*dhauli.Conversation, error) {
+	if identityClaimed(ctx) {
+		return nil, apperr.NewForbidden("conversations can only be shared with authentication enabled")
+	}
+	if err := validGrantee(grant); err != nil {
+		return nil, err
+	}
+	return cs.updateConversation(ctx, cid, ConversationActionUnshare, func(c *dhauli.Conversation) error {
+		n := len(c.ACL)
+		c.ACL = slices.DeleteFunc(c.ACL, func(g dhauli.Grant) bool { return g.Grantee() == grant.Grantee() })
+		if len(c.ACL) == n {
+			return apperr.NewNotFound("conversation %s is not shared with %s", cid, grant.Grantee())
+		}
+		return nil
+	})
+}
+
+func validGrantee(grant dhauli.Grant) error {
+	grantees := 0
+	if grant.User != nil {
+		grantees++
+		if grant.User.ID == "" {
+			return apperr.NewValidation("user ID is required")
+		}
+	}
+	if grant.Group != nil {
+		grantees++
+		if grant.Group.ID == "" {
+			return apperr.NewValidation("group ID is required")
+		}
+	}
+	if grant.Tenant != nil {
+		grantees++
+		if grant.Tenant.ID == "" {
+			return apperr.NewValidation("tenant ID is required")
+		}
+	}
+	if grantees != 1 {
+		return apperr.NewValidation("a grant is for exactly one user, group or tenant")
+	}
+	return nil
+}
+
+// membershipOf returns the group and tenant of the principal of ctx.
+func membershipOf(ctx context.Context) (string, string) {
+	principal := PrincipalFromContext(ctx)
+	if principal == nil {
+		return "", ""
+	}
+	return principal.Group.ID, principal.Tenant.ID
+}
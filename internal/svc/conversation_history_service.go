@@ -0,0 +1,123 @@
+package svc
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Actions recorded in the history of a conversation.
+const (
+	ConversationActionAddInteraction    = "add_interaction"
+	ConversationActionUpdateStub        = "update_stub"
+	ConversationActionAddBranch         = "add_branch"
+	ConversationActionSwitchBranch      = "switch_branch"
+	ConversationActionRemoveInteraction = "remove_interaction"
+	ConversationActionClose             = "close"
+	ConversationActionTrash             = "trash"
+	ConversationActionRestore           = "restore"
+	ConversationActionHold              = "hold"
+	ConversationActionRelease           = "release"
+	ConversationActionShare             = "share"
+	ConversationActionUnshare           = "unshare"
+)
+
+type ConversationHistoryService interface {
+	GetConversationHistoryById(ctx context.Context, id string) (*dhauli.ConversationHistory, error)
+	AddHistoryForConversation(ctx context.Context, conversation *dhauli.Conversation, actor string, action string) (*dhauli.ConversationHistory, error)
+	ListHistory(ctx context.Context, cid string, query HistoryQuery) ([]*dhauli.ConversationHistory, int64, error)
+	GetSnapshotAtVersion(ctx context.Context, cid string, version int) (*dhauli.ConversationHistory, error)
+	GetSnapshotAfter(ctx context.Context, cid string, t time.Time) (*dhauli.ConversationHistory, error)
+}
+
+type conversationHistoryService struct {
+	log  *logger.Logger
+	repo repo.ConversationHistoryRepository
+}
+
+func (chs conversationHistoryService) GetConversationHistoryById(ctx context.Context, id string) (*dhauli.ConversationHistory, error) {
+	return chs.repo.GetById(ctx, id)
+}
+
+// AddHistoryForConversation records the conversation as it was before the action.
+func (chs conversationHistoryService) AddHistoryForConversation(ctx context.Context, conversation *dhauli.Conversation, actor string, action string) (*dhauli.ConversationHistory, error) {
+	h := &dhauli.ConversationHistory{
+		ID:             primitive.NewObjectID().Hex(),
+		ConversationID: conversation.ID,
+		Action:         action,
+		Actor:          actor,
+		Conversation:   *conversation,
+		Version:        conversation.Version,
+	}
+	created, err := chs.repo.Create(ctx, h)
+	if err != nil {
+		chs.log.Errorf("Error creating conversation history: %v for id: %s", err, conversation.ID)
+		return nil, err
+	}
+	return created, nil
+}
+
+func (chs conversationHistoryService) ListHistory(ctx context.Context, cid string, query HistoryQuery) ([]*dhauli.ConversationHistory, int64, error) {
+	filter := bson.M{"conversationId": cid}
+	if query.Actor != "" {
+		filter["actor"] = query.Actor
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+	createdAt := bson.M{}
+	if !query.From.IsZero() {
+		createdAt["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		createdAt["$lt"] = query.To
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+	list, total, err := chs.repo.Page(ctx, filter, query.Offset, query.Limit)
+	if err != nil {
+		chs.log.Errorf("Error listing history of conversation %s: %v", cid, err)
+		return nil, 0, err
+	}
+	return list, total, nil
+}
+
+func (chs conversationHistoryService) GetSnapshotAtVersion(ctx context.Context, cid string, version int) (*dhauli.ConversationHistory, error) {
+	list, _, err := chs.repo.Page(ctx, bson.M{"conversationId": cid, "version": version}, 0, 1)
+	if err != nil {
+		chs.log.Errorf("Error getting version %d of conversation %s from history: %v", version, cid, err)
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, apperr.NewNotFound("version %d of conversation %s is not in the history", version, cid)
+	}
+	return list[0], nil
+}
+
+// GetSnapshotAfter returns the snapshot taken by the first change after t, or nil when nothing
+// changed since.
+func (chs conversationHistoryService) GetSnapshotAfter(ctx context.Context, cid string, t time.Time) (*dhauli.ConversationHistory, error) {
+	list, _, err := chs.repo.Page(ctx, bson.M{"conversationId": cid, "createdAt": bson.M{"$gt": t}}, 0, 1)
+	if err != nil {
+		chs.log.Errorf("Error getting history of conversation %s after %v: %v", cid, t, err)
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return list[0], nil
+}
+
+func NewConversationHistoryService(log *logger.Logger, repo repo.ConversationHistoryRepository) ConversationHistoryService {
+	return &conversationHistoryService{
+		log:  log,
+		repo: repo,
+	}
+}
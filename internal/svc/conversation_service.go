@@ -2,10 +2,15 @@ package svc
 
 import (
 	"context"
+	"slices"
+	"time"
 
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -13,52 +18,122 @@ type ConversationService interface {
 	CreateConversation(ctx context.Context, conversation *dhauli.Conversation) (*dhauli.Conversation, error)
 	GetConversationById(ctx context.Context, cid string) (*dhauli.Conversation, error)
 	GetConversationList(ctx context.Context, userId string) ([]*dhauli.Conversation, error)
+	GetConversationPath(ctx context.Context, cid string, leafId string) (*dhauli.Conversation, error)
+	ListBranches(ctx context.Context, cid string) ([]dhauli.Branch, error)
+	SwitchBranch(ctx context.Context, cid string, iid string) (*dhauli.Conversation, error)
 	AddInteractionByConversationId(ctx context.Context, cid string, stub dhauli.InteractionStub) (*dhauli.Conversation, error)
+	AddBranchByConversationId(ctx context.Context, cid string, stub dhauli.InteractionStub) (*dhauli.Conversation, error)
 	UpdateInteractionAnswer(ctx context.Context, cid string, stub dhauli.InteractionStub) (*dhauli.Conversation, error)
+	RemoveInteractionByConversationId(ctx context.Context, cid string, iid string, cascade bool) ([]string, error)
 	DeleteConversation(ctx context.Context, cid string) error
+	ListTrash(ctx context.Context, userId string) ([]*dhauli.Conversation, error)
+	RestoreConversation(ctx context.Context, cid string) (*dhauli.Conversation, error)
+	PurgeConversation(ctx context.Context, cid string) error
+	PurgeTrash(ctx context.Context, before time.Time) (int, []string, error)
+	CloseSessionConversations(ctx context.Context, sid string) (int, error)
+	SetLegalHold(ctx context.Context, cid string, hold bool) (*dhauli.Conversation, error)
+	Authorize(ctx context.Context, cid string, role string) error
+	AuthorizeInteraction(ctx context.Context, iid string, role string) (string, error)
+	ShareConversation(ctx context.Context, cid string, grant dhauli.Grant) (*dhauli.Conversation, error)
+	UnshareConversation(ctx context.Context, cid string, grant dhauli.Grant) (*dhauli.Conversation, error)
+	GetConversationAsOf(ctx context.Context, cid string, asOf time.Time) (*dhauli.Conversation, error)
+	GetConversationAtVersion(ctx context.Context, cid string, version int) (*dhauli.Conversation, error)
 }
 
+var ErrConversationClosed = apperr.NewConflict("conversation is closed")
+
 type conversationService struct {
-	log  *logger.Logger
-	repo repo.ConversationRepository
-	iSvc InteractionService
+	log         *logger.Logger
+	repo        repo.ConversationRepository
+	uow         repo.UnitOfWork
+	historySvc  ConversationHistoryService
+	historyRepo repo.ConversationHistoryRepository
+	chunkRepo   repo.AnswerChunkRepository
+	changeRepo  repo.ChangeRepository
+	changeSvc   ChangeService
 }
 
+// GetConversationList returns the conversations of the user along with those shared with them,
+// directly or through their group or tenant. The shared ones are flagged as such. A claimed
+// identity only gets its own.
 func (cs conversationService) GetConversationList(ctx context.Context, userId string) ([]*dhauli.Conversation, error) {
+	gid, tid := membershipOf(ctx)
+	reachable := bson.A{bson.M{"userId": userId}}
+	if !identityClaimed(ctx) {
+		reachable = append(reachable, bson.M{"acl.user._id": userId})
+		if gid != "" {
+			reachable = append(reachable, bson.M{"acl.group._id": gid})
+		}
+		if tid != "" {
+			reachable = append(reachable, bson.M{"acl.tenant._id": tid})
+		}
+	}
 	convs, err := cs.repo.Filter(ctx, map[string]interface{}{
-		"userId": userId,
+		"$or":       reachable,
+		"deletedAt": nil,
 	})
 	if err != nil {
 		cs.log.Errorf("Error getting conversation list for user: %s err: %v", userId, err)
 		return nil, err
 	}
+	for _, c := range convs {
+		c.Role = c.RoleOf(userId, gid, tid)
+		c.Shared = c.UserID != userId
+	}
 	return convs, nil
 }
 
-// TODO Convert to single transaction
+// CreateConversation stores the conversation together with an interaction for every stub it
+// was created with, all inside a single transaction. The stubs become a single branch in order.
 func (cs conversationService) CreateConversation(ctx context.Context, conversation *dhauli.Conversation) (*dhauli.Conversation, error) {
-	cid := primitive.NewObjectID().Hex()
-	if len(conversation.Interactions) != 0 {
-		inter := dhauli.Interaction{
-			ID:             primitive.NewObjectID().Hex(),
-			WorkflowID:     conversation.WorkflowID,
-			SessionID:      conversation.SessionID,
-			ConversationID: cid,
-			Query:          conversation.Interactions[0].Query,
+	if conversation.ID == "" {
+		conversation.ID = primitive.NewObjectID().Hex()
+	}
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		conversation.Ownership = OwnershipOf(principal)
+	}
+	stubs := conversation.Interactions
+	var created *dhauli.Conversation
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		c := *conversation
+		c.Interactions = make([]dhauli.InteractionStub, 0, len(stubs))
+		c.HeadID = ""
+		for _, stub := range stubs {
+			now := time.Now()
+			inter := dhauli.Interaction{
+				ID:             primitive.NewObjectID().Hex(),
+				WorkflowID:     c.WorkflowID,
+				SessionID:      c.SessionID,
+				ConversationID: c.ID,
+				ParentID:       c.HeadID,
+				Ownership:      c.Ownership,
+				Query:          stub.Query,
+				Answer:         stub.Answer,
+				CreatedAt:      now,
+				UpdatedAt:      now,
+				Version:        1,
+			}
+			seedAnswerCandidate(&inter, c.UserID)
+			createdInteraction, err := cs.uow.Interactions().Create(ctx, &inter)
+			if err != nil {
+				cs.log.Errorf("Error creating interaction for conversation: %v", err)
+				return err
+			}
+			c.Interactions = append(c.Interactions, stubFor(createdInteraction))
+			c.HeadID = createdInteraction.ID
 		}
-		createdInteraction, err := cs.iSvc.CreateInteraction(ctx, &inter)
+		var err error
+		created, err = cs.repo.Create(ctx, &c)
 		if err != nil {
-			cs.log.Errorf("Error creating interaction for conversation: %v", err)
-			return nil, err
-		}
-		conversation.Interactions = []dhauli.InteractionStub{
-			{
-				ID:    createdInteraction.ID,
-				Query: createdInteraction.Query,
-			},
+			cs.log.Errorf("Error creating conversation: %v", err)
+			return err
 		}
+		return cs.changeSvc.Record(ctx, created.ID, "", contracts.ConversationChangeCreated, created.UserID, created)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return cs.repo.Create(ctx, conversation)
+	return created, nil
 }
 
 func (cs conversationService) GetConversationById(ctx context.Context, cid string) (*dhauli.Conversation, error) {
@@ -67,47 +142,280 @@ func (cs conversationService) GetConversationById(ctx context.Context, cid strin
 		cs.log.Errorf("Error getting conversation for id: %s err: %v", cid, err)
 		return nil, err
 	}
+	if c.DeletedAt != nil {
+		return nil, apperr.NewNotFound("conversation %s not found", cid)
+	}
+	c.EnsureTree()
 	return c, nil
 }
 
+// GetConversationPath returns the conversation with only the interactions on the path from the
+// root to leafId. An empty leafId selects the active branch.
+func (cs conversationService) GetConversationPath(ctx context.Context, cid string, leafId string) (*dhauli.Conversation, error) {
+	c, err := cs.GetConversationById(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if leafId == "" {
+		leafId = c.HeadID
+	} else if _, ok := c.Stub(leafId); !ok {
+		cs.log.Errorf("Interaction %s is not part of conversation %s", leafId, cid)
+		return nil, apperr.NewNotFound("interaction %s not found in conversation %s", leafId, cid)
+	}
+	c.Interactions = c.PathTo(leafId)
+	return c, nil
+}
+
+func (cs conversationService) ListBranches(ctx context.Context, cid string) ([]dhauli.Branch, error) {
+	c, err := cs.GetConversationById(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	return c.Branches(), nil
+}
+
+// SwitchBranch makes the branch containing iid the active one. When iid is not a leaf the most
+// recent branch below it is selected.
+func (cs conversationService) SwitchBranch(ctx context.Context, cid string, iid string) (*dhauli.Conversation, error) {
+	return cs.updateConversation(ctx, cid, ConversationActionSwitchBranch, func(c *dhauli.Conversation) error {
+		if _, ok := c.Stub(iid); !ok {
+			cs.log.Errorf("Interaction %s is not part of conversation %s", iid, cid)
+			return apperr.NewNotFound("interaction %s not found in conversation %s", iid, cid)
+		}
+		c.HeadID = c.LatestLeaf(iid)
+		return nil
+	})
+}
+
+// AddInteractionByConversationId refreshes the stub when it already exists. Otherwise the stub is
+// appended below the current head, unless it names its parent, and becomes the new head.
 func (cs conversationService) AddInteractionByConversationId(ctx context.Context, cid string, stub dhauli.InteractionStub) (*dhauli.Conversation, error) {
-	c, err := cs.repo.GetByID(ctx, cid)
+	c, err := cs.GetConversationById(ctx, cid)
 	if err != nil {
-		cs.log.Errorf("Error getting conversation for id: %s err: %v", cid, err)
 		return nil, err
 	}
-	for _, in := range c.Interactions {
-		if in.ID == stub.ID {
-			in.Answer = stub.Answer
-			return cs.repo.Update(ctx, c)
+	if c.ClosedAt != nil {
+		return nil, ErrConversationClosed
+	}
+	if _, ok := c.Stub(stub.ID); ok {
+		return cs.saveConversation(ctx, c, ConversationActionUpdateStub, func(c *dhauli.Conversation) error {
+			for i, in := range c.Interactions {
+				if in.ID == stub.ID {
+					c.Interactions[i].Query = stub.Query
+					c.Interactions[i].Answer = stub.Answer
+				}
+			}
+			return nil
+		})
+	}
+	return cs.saveConversation(ctx, c, ConversationActionAddInteraction, func(c *dhauli.Conversation) error {
+		if stub.ParentID == "" {
+			stub.ParentID = c.HeadID
 		}
+		c.Interactions = append(c.Interactions, stub)
+		c.HeadID = stub.ID
+		return nil
+	})
+}
+
+// AddBranchByConversationId appends the stub exactly where its ParentID places it, an empty
+// parent making it a new root, and switches the active branch to it.
+func (cs conversationService) AddBranchByConversationId(ctx context.Context, cid string, stub dhauli.InteractionStub) (*dhauli.Conversation, error) {
+	c, err := cs.GetConversationById(ctx, cid)
+	if err != nil {
+		return nil, err
 	}
-	c.Interactions = append(c.Interactions, stub)
-	return cs.repo.Update(ctx, c)
+	if c.ClosedAt != nil {
+		return nil, ErrConversationClosed
+	}
+	if _, ok := c.Stub(stub.ParentID); stub.ParentID != "" && !ok {
+		cs.log.Errorf("Parent interaction %s is not part of conversation %s", stub.ParentID, cid)
+		return nil, apperr.NewValidation("parent interaction %s not found in conversation %s", stub.ParentID, cid)
+	}
+	return cs.saveConversation(ctx, c, ConversationActionAddBranch, func(c *dhauli.Conversation) error {
+		c.Interactions = append(c.Interactions, stub)
+		c.HeadID = stub.ID
+		return nil
+	})
 }
 
 func (cs conversationService) UpdateInteractionAnswer(ctx context.Context, cid string, stub dhauli.InteractionStub) (*dhauli.Conversation, error) {
-	c, err := cs.repo.GetByID(ctx, cid)
+	return cs.updateConversation(ctx, cid, ConversationActionUpdateStub, func(c *dhauli.Conversation) error {
+		for i, in := range c.Interactions {
+			if in.ID == stub.ID {
+				c.Interactions[i].Answer = stub.Answer
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveInteractionByConversationId removes the stub of iid, and with cascade those of the
+// interactions following it, and returns the ids of all stubs removed. Without cascade the
+// stubs following iid move up to its parent.
+func (cs conversationService) RemoveInteractionByConversationId(ctx context.Context, cid string, iid string, cascade bool) ([]string, error) {
+	c, err := cs.GetConversationById(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.Stub(iid); !ok {
+		return nil, apperr.NewNotFound("interaction %s not found in conversation %s", iid, cid)
+	}
+	var removed []string
+	_, err = cs.saveConversation(ctx, c, ConversationActionRemoveInteraction, func(c *dhauli.Conversation) error {
+		if cascade {
+			removed = c.RemoveSubtree(iid)
+		} else if c.RemoveStub(iid) {
+			removed = []string{iid}
+		}
+		return nil
+	})
 	if err != nil {
-		cs.log.Errorf("Error getting conversation for id: %s err: %v", cid, err)
 		return nil, err
 	}
-	for i, in := range c.Interactions {
-		if in.ID == stub.ID {
-			c.Interactions[i].Answer = stub.Answer
-			break
+	return removed, nil
+}
+
+// CloseSessionConversations closes the open conversations of session sid in one transaction
+// and reports how many it closed.
+func (cs conversationService) CloseSessionConversations(ctx context.Context, sid string) (int, error) {
+	closed := 0
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		closed = 0
+		open, err := cs.repo.Filter(ctx, bson.M{"sessionId": sid, "closedAt": bson.M{"$exists": false}, "deletedAt": nil})
+		if err != nil {
+			cs.log.Errorf("Error getting open conversations of session %s: %v", sid, err)
+			return err
+		}
+		now := time.Now()
+		for _, c := range open {
+			_, err = cs.updateConversation(ctx, c.ID, ConversationActionClose, func(c *dhauli.Conversation) error {
+				c.ClosedAt = &now
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			closed++
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return closed, nil
+}
+
+// SetLegalHold places the conversation under legal hold or releases it. A held conversation is
+// neither expired by retention nor purged from the trash.
+func (cs conversationService) SetLegalHold(ctx context.Context, cid string, hold bool) (*dhauli.Conversation, error) {
+	action := ConversationActionHold
+	if !hold {
+		action = ConversationActionRelease
 	}
-	return cs.repo.Update(ctx, c)
+	return cs.updateConversation(ctx, cid, action, func(c *dhauli.Conversation) error {
+		c.LegalHold = hold
+		return nil
+	})
 }
 
-func (cs conversationService) DeleteConversation(ctx context.Context, cid string) error {
-	return cs.repo.Delete(ctx, cid)
+// updateConversation applies a change made directly to the conversation, as opposed to one of
+// its interactions, and announces it to live subscribers.
+func (cs conversationService) updateConversation(ctx context.Context, cid string, action string, mutate func(c *dhauli.Conversation) error) (*dhauli.Conversation, error) {
+	var updated *dhauli.Conversation
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		c, err := cs.GetConversationById(ctx, cid)
+		if err != nil {
+			return err
+		}
+		if updated, err = cs.saveConversation(ctx, c, action, mutate); err != nil {
+			return err
+		}
+		return cs.changeSvc.Record(ctx, cid, "", contracts.ConversationChangeUpdated, "", updated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// saveConversation snapshots c into the history, then applies the mutation and writes it, both
+// in one transaction.
+func (cs conversationService) saveConversation(ctx context.Context, c *dhauli.Conversation, action string, mutate func(c *dhauli.Conversation) error) (*dhauli.Conversation, error) {
+	var updated *dhauli.Conversation
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		before := *c
+		before.Interactions = slices.Clone(c.Interactions)
+		if err := mutate(c); err != nil {
+			return err
+		}
+		if _, err := cs.historySvc.AddHistoryForConversation(ctx, &before, actorOf(ctx), action); err != nil {
+			return err
+		}
+		var err error
+		if updated, err = cs.repo.Update(ctx, c); err != nil {
+			cs.log.Errorf("Error updating conversation %s: %v", c.ID, err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// GetConversationAsOf reconstructs the conversation as it was at asOf from the snapshot taken by
+// the first change after it.
+func (cs conversationService) GetConversationAsOf(ctx context.Context, cid string, asOf time.Time) (*dhauli.Conversation, error) {
+	current, err := cs.GetConversationById(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if asOf.Before(current.CreatedAt) {
+		return nil, apperr.NewNotFound("conversation %s did not exist at %s", cid, asOf.Format(time.RFC3339))
+	}
+	snapshot, err := cs.historySvc.GetSnapshotAfter(ctx, cid, asOf)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return current, nil
+	}
+	snapshot.Conversation.EnsureTree()
+	return &snapshot.Conversation, nil
+}
+
+func (cs conversationService) GetConversationAtVersion(ctx context.Context, cid string, version int) (*dhauli.Conversation, error) {
+	current, err := cs.GetConversationById(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if version == current.Version {
+		return current, nil
+	}
+	if version <= 0 || version > current.Version {
+		return nil, apperr.NewNotFound("conversation %s has no version %d", cid, version)
+	}
+	snapshot, err := cs.historySvc.GetSnapshotAtVersion(ctx, cid, version)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Conversation.EnsureTree()
+	return &snapshot.Conversation, nil
 }
 
-func NewConversationService(log *logger.Logger, repo repo.ConversationRepository) ConversationService {
+func NewConversationService(log *logger.Logger, uow repo.UnitOfWork, hSvc ConversationHistoryService, historyRepo repo.ConversationHistoryRepository,
+	chunkRepo repo.AnswerChunkRepository, changeRepo repo.ChangeRepository, changeSvc ChangeService) ConversationService {
 	return &conversationService{
-		log:  log,
-		repo: repo,
+		log:         log,
+		repo:        uow.Conversations(),
+		uow:         uow,
+		historySvc:  hSvc,
+		historyRepo: historyRepo,
+		chunkRepo:   chunkRepo,
+		changeRepo:  changeRepo,
+		changeSvc:   changeSvc,
 	}
 }
@@ -0,0 +1,159 @@
+package svc
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DeleteConversation moves the conversation and its interactions into the trash, where they are
+// hidden until restored or purged.
+func (cs conversationService) DeleteConversation(ctx context.Context, cid string) error {
+	return cs.uow.Execute(ctx, func(ctx context.Context) error {
+		c, err := cs.GetConversationById(ctx, cid)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		actor := actorOf(ctx)
+		trashed, err := cs.saveConversation(ctx, c, ConversationActionTrash, func(c *dhauli.Conversation) error {
+			c.DeletedAt = &now
+			c.DeletedBy = actor
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = cs.uow.Interactions().SetMany(ctx, bson.M{"conversationId": cid}, bson.M{"deletedAt": now}); err != nil {
+			cs.log.Errorf("Error trashing interactions of conversation %s: %v", cid, err)
+			return err
+		}
+		return cs.changeSvc.Record(ctx, cid, "", contracts.ConversationChangeTrashed, actor, trashed)
+	})
+}
+
+func (cs conversationService) ListTrash(ctx context.Context, userId string) ([]*dhauli.Conversation, error) {
+	convs, err := cs.repo.Filter(ctx, bson.M{"userId": userId, "deletedAt": bson.M{"$ne": nil}})
+	if err != nil {
+		cs.log.Errorf("Error getting trash of user: %s err: %v", userId, err)
+		return nil, err
+	}
+	return convs, nil
+}
+
+func (cs conversationService) RestoreConversation(ctx context.Context, cid string) (*dhauli.Conversation, error) {
+	var restored *dhauli.Conversation
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		c, err := cs.trashed(ctx, cid)
+		if err != nil {
+			return err
+		}
+		restored, err = cs.saveConversation(ctx, c, ConversationActionRestore, func(c *dhauli.Conversation) error {
+			c.DeletedAt = nil
+			c.DeletedBy = ""
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = cs.uow.Interactions().SetMany(ctx, bson.M{"conversationId": cid}, bson.M{"deletedAt": nil}); err != nil {
+			cs.log.Errorf("Error restoring interactions of conversation %s: %v", cid, err)
+			return err
+		}
+		restored.EnsureTree()
+		return cs.changeSvc.Record(ctx, cid, "", contracts.ConversationChangeRestored, actorOf(ctx), restored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// PurgeConversation deletes a trashed conversation for good, together with its interactions,
+// their answer chunks, the history of both and its changes, in one transaction.
+func (cs conversationService) PurgeConversation(ctx context.Context, cid string) error {
+	return cs.uow.Execute(ctx, func(ctx context.Context) error {
+		c, err := cs.trashed(ctx, cid)
+		if err != nil {
+			return err
+		}
+		if c.LegalHold {
+			return apperr.NewConflict("conversation %s is under legal hold", cid)
+		}
+		byConversation := bson.M{"conversationId": cid}
+		iids, err := cs.uow.Interactions().Distinct(ctx, "_id", byConversation)
+		if err != nil {
+			cs.log.Errorf("Error getting interactions of conversation %s: %v", cid, err)
+			return err
+		}
+		if _, err = cs.chunkRepo.DeleteMany(ctx, bson.M{"interactionId": bson.M{"$in": iids}}); err != nil {
+			cs.log.Errorf("Error deleting answer chunks of conversation %s: %v", cid, err)
+			return err
+		}
+		if err = cs.repo.Delete(ctx, cid); err != nil {
+			cs.log.Errorf("Error deleting conversation %s: %v", cid, err)
+			return err
+		}
+		if _, err = cs.uow.Interactions().DeleteMany(ctx, byConversation); err != nil {
+			cs.log.Errorf("Error deleting interactions of conversation %s: %v", cid, err)
+			return err
+		}
+		if _, err = cs.uow.InteractionHistory().DeleteMany(ctx, byConversation); err != nil {
+			cs.log.Errorf("Error deleting interaction history of conversation %s: %v", cid, err)
+			return err
+		}
+		if _, err = cs.historyRepo.DeleteMany(ctx, byConversation); err != nil {
+			cs.log.Errorf("Error deleting history of conversation %s: %v", cid, err)
+			return err
+		}
+		// live subscribers and the outbox still get the deletion, the change log keeps nothing
+		if err = cs.changeSvc.Record(ctx, cid, "", contracts.ConversationChangeDeleted, actorOf(ctx), nil); err != nil {
+			return err
+		}
+		if _, err = cs.changeRepo.DeleteMany(ctx, byConversation); err != nil {
+			cs.log.Errorf("Error deleting changes of conversation %s: %v", cid, err)
+			return err
+		}
+		return cs.changeRepo.DeleteSeq(ctx, cid)
+	})
+}
+
+// PurgeTrash purges the conversations trashed before the given time, each in a transaction of
+// its own, and reports how many it purged and the ids of those it failed to purge. A conversation
+// that fails is left for the next run and does not hold up the others.
+func (cs conversationService) PurgeTrash(ctx context.Context, before time.Time) (int, []string, error) {
+	expired, err := cs.repo.Filter(ctx, bson.M{"deletedAt": bson.M{"$ne": nil, "$lt": before}, "legalHold": bson.M{"$ne": true}})
+	if err != nil {
+		cs.log.Errorf("Error getting conversations trashed before %v: %v", before, err)
+		return 0, nil, err
+	}
+	purged := 0
+	var failed []string
+	for _, c := range expired {
+		if ctx.Err() != nil {
+			return purged, failed, ctx.Err()
+		}
+		if err = cs.PurgeConversation(ctx, c.ID); err != nil {
+			cs.log.Errorf("Error purging conversation %s: %v", c.ID, err)
+			failed = append(failed, c.ID)
+			continue
+		}
+		purged++
+	}
+	return purged, failed, nil
+}
+
+func (cs conversationService) trashed(ctx context.Context, cid string) (*dhauli.Conversation, error) {
+	c, err := cs.repo.GetByID(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if c.DeletedAt == nil {
+		return nil, apperr.NewConflict("conversation %s is not in the trash", cid)
+	}
+	return c, nil
+}
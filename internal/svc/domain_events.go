@@ -0,0 +1,83 @@
+package svc
+
+import (
+	"context"
+
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+)
+
+// EventPublisher delivers domain events to downstream consumers. A batch is published in order.
+type EventPublisher interface {
+	Publish(ctx context.Context, envelopes ...messaging.Envelope) error
+}
+
+type domainEventType struct {
+	name    messaging.EventName
+	msgType messaging.Type
+	action  messaging.Action
+}
+
+var domainEventTypes = map[string]domainEventType{
+	contracts.ConversationChangeCreated:       {contracts.ConversationCreated, contracts.Conversation, messaging.CREATE},
+	contracts.ConversationChangeUpdated:       {contracts.ConversationUpdated, contracts.Conversation, messaging.UPDATE},
+	contracts.ConversationChangeDeleted:       {contracts.ConversationDeleted, contracts.Conversation, messaging.DELETE},
+	contracts.ConversationChangeTrashed:       {contracts.ConversationTrashed, contracts.Conversation, messaging.DELETE},
+	contracts.ConversationChangeRestored:      {contracts.ConversationRestored, contracts.Conversation, messaging.UPDATE},
+	contracts.InteractionChangeCreated:        {contracts.InteractionCreated, contracts.Interaction, messaging.CREATE},
+	contracts.InteractionChangeQueryUpdated:   {contracts.InteractionUpdated, contracts.Interaction, messaging.UPDATE},
+	contracts.InteractionChangeContextUpdated: {contracts.InteractionUpdated, contracts.Interaction, messaging.UPDATE},
+	contracts.InteractionChangeAnswerUpdated:  {contracts.InteractionUpdated, contracts.Interaction, messaging.UPDATE},
+	contracts.InteractionChangeReverted:       {contracts.InteractionUpdated, contracts.Interaction, messaging.UPDATE},
+	contracts.InteractionChangeDeleted:        {contracts.InteractionDeleted, contracts.Interaction, messaging.DELETE},
+}
+
+// domainEvent turns a recorded change into the event published for it. The message carries the
+// resulting entity and its version; the change id doubles as idempotency key so consumers can
+// drop redeliveries.
+func domainEvent(ctx context.Context, change dhauli.ChangeEvent, entity any) (messaging.Envelope, bool) {
+	eventType, ok := domainEventTypes[change.Type]
+	if !ok {
+		return messaging.Envelope{}, false
+	}
+	message := messaging.Message{
+		ID:             change.ID,
+		ConversationId: change.ConversationID,
+		InteractionId:  change.InteractionID,
+		Type:           eventType.msgType,
+		Action:         eventType.action,
+		Data:           change.Data,
+		Metadata: map[string]any{
+			"actor":      change.Actor,
+			"changeType": change.Type,
+			"seq":        change.Seq,
+		},
+	}
+	switch e := entity.(type) {
+	case *dhauli.Conversation:
+		message.WorkflowId = e.WorkflowID
+		message.SessionId = e.SessionID
+		message.Version = e.Version
+	case *dhauli.Interaction:
+		message.WorkflowId = e.WorkflowID
+		message.SessionId = e.SessionID
+		message.Version = e.Version
+	}
+
+	opts := []messaging.EnvelopeOption{
+		messaging.WithKind(messaging.EVENT),
+		messaging.WithEventName(eventType.name),
+		messaging.WithIdempotencyKey(change.ID),
+		messaging.WithPrincipal(PrincipalFromContext(ctx)),
+	}
+	if correlationId := CorrelationIdFromContext(ctx); correlationId != "" {
+		opts = append(opts, messaging.WithCorrelationId(correlationId))
+	}
+	if info := AuthInfoFromContext(ctx); info != nil {
+		opts = append(opts, messaging.WithAuthInfo(info))
+	}
+	envelope := messaging.NewEnvelope(message, opts...)
+	envelope.CreatedAt = change.CreatedAt
+	return envelope, true
+}
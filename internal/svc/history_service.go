@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/internal/repo"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/logger"
@@ -12,9 +13,24 @@ import (
 )
 
 type InteractionHistoryService interface {
-	GetInteractionHistoryById(id string) (*dhauli.InteractionHistory, error)
+	GetInteractionHistoryById(ctx context.Context, id string) (*dhauli.InteractionHistory, error)
 	AddHistoryForInteraction(ctx context.Context, interaction *dhauli.Interaction, actor string, action string) (*dhauli.InteractionHistory, error)
+	AddHistoryForAnswer(ctx context.Context, interaction *dhauli.Interaction, actor string, action string, answerId string) (*dhauli.InteractionHistory, error)
 	GetHistoryForInteractionId(ctx context.Context, iid string) ([]*dhauli.InteractionHistory, error)
+	GetSnapshotAtVersion(ctx context.Context, iid string, version int) (*dhauli.InteractionHistory, error)
+	GetSnapshotAfter(ctx context.Context, iid string, t time.Time) (*dhauli.InteractionHistory, error)
+	ListHistory(ctx context.Context, iid string, query HistoryQuery) ([]*dhauli.InteractionHistory, int64, error)
+}
+
+// HistoryQuery selects a page of the history of an interaction. Empty fields do not filter;
+// From is inclusive and To exclusive.
+type HistoryQuery struct {
+	Actor  string
+	Action string
+	From   time.Time
+	To     time.Time
+	Offset int64
+	Limit  int64
 }
 
 type interactionHistoryService struct {
@@ -22,23 +38,32 @@ type interactionHistoryService struct {
 	interactionHistoryRepository repo.InteractionHistoryRepository
 }
 
-func (i interactionHistoryService) GetInteractionHistoryById(id string) (*dhauli.InteractionHistory, error) {
-	return i.interactionHistoryRepository.GetById(id)
+func (i interactionHistoryService) GetInteractionHistoryById(ctx context.Context, id string) (*dhauli.InteractionHistory, error) {
+	return i.interactionHistoryRepository.GetById(ctx, id)
 }
 
 func (i interactionHistoryService) AddHistoryForInteraction(ctx context.Context, interaction *dhauli.Interaction, actor string, action string) (*dhauli.InteractionHistory, error) {
+	return i.AddHistoryForAnswer(ctx, interaction, actor, action, "")
+}
+
+// AddHistoryForAnswer records the interaction as it was before the action, together with the answer
+// candidate the action appended or selected.
+func (i interactionHistoryService) AddHistoryForAnswer(ctx context.Context, interaction *dhauli.Interaction, actor string, action string, answerId string) (*dhauli.InteractionHistory, error) {
 	ih := &dhauli.InteractionHistory{
 		ID:             primitive.NewObjectID().Hex(),
 		WorkflowID:     interaction.WorkflowID,
 		SessionID:      interaction.SessionID,
 		ConversationID: interaction.ConversationID,
 		InteractionID:  interaction.ID,
+		Ownership:      interaction.Ownership,
 		Action:         action,
 		Actor:          actor,
+		AnswerID:       answerId,
 		Context:        interaction.Context,
 		Query:          interaction.Query,
 		Answer:         interaction.Answer,
 		CreatedAt:      time.Now(),
+		Version:        interaction.Version,
 	}
 	ihDoc, err := i.interactionHistoryRepository.Create(ctx, ih)
 	if err != nil {
@@ -58,6 +83,68 @@ func (i interactionHistoryService) GetHistoryForInteractionId(ctx context.Contex
 	return list, nil
 }
 
+// GetSnapshotAtVersion returns the interaction as it was at version, which is the snapshot taken
+// by the first change made to that version.
+func (i interactionHistoryService) GetSnapshotAtVersion(ctx context.Context, iid string, version int) (*dhauli.InteractionHistory, error) {
+	filter := bson.M{"interactionId": iid, "version": version}
+	list, err := i.interactionHistoryRepository.Filter(ctx, filter)
+	if err != nil {
+		i.log.Errorf("Error getting version %d of interaction %s from history: %v", version, iid, err)
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, apperr.NewNotFound("version %d of interaction %s is not in the history", version, iid)
+	}
+	first := list[0]
+	for _, h := range list[1:] {
+		if h.CreatedAt.Before(first.CreatedAt) {
+			first = h
+		}
+	}
+	return first, nil
+}
+
+// GetSnapshotAfter returns the snapshot taken by the first change after t, which holds the
+// interaction as it was at t. It returns nil when nothing changed since.
+func (i interactionHistoryService) GetSnapshotAfter(ctx context.Context, iid string, t time.Time) (*dhauli.InteractionHistory, error) {
+	filter := bson.M{"interactionId": iid, "createdAt": bson.M{"$gt": t}}
+	list, _, err := i.interactionHistoryRepository.Page(ctx, filter, 0, 1)
+	if err != nil {
+		i.log.Errorf("Error getting history of interaction %s after %v: %v", iid, t, err)
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return list[0], nil
+}
+
+func (i interactionHistoryService) ListHistory(ctx context.Context, iid string, query HistoryQuery) ([]*dhauli.InteractionHistory, int64, error) {
+	filter := bson.M{"interactionId": iid}
+	if query.Actor != "" {
+		filter["actor"] = query.Actor
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+	createdAt := bson.M{}
+	if !query.From.IsZero() {
+		createdAt["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		createdAt["$lt"] = query.To
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+	list, total, err := i.interactionHistoryRepository.Page(ctx, filter, query.Offset, query.Limit)
+	if err != nil {
+		i.log.Errorf("Error listing history of interaction %s: %v", iid, err)
+		return nil, 0, err
+	}
+	return list, total, nil
+}
+
 func NewInteractionHistoryService(log *logger.Logger, repo repo.InteractionHistoryRepository) InteractionHistoryService {
 	return &interactionHistoryService{
 		log:                          log,
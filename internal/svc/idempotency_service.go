@@ -0,0 +1,109 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+const (
+	idempotencyLockDuration = 30 * time.Second
+	idempotencyWaitInterval = 100 * time.Millisecond
+	idempotencyMaxWait      = 10 * time.Second
+)
+
+// ErrMessageInProgress is retryable: the first delivery will finish, one way or the other.
+var ErrMessageInProgress = apperr.New(apperr.Unavailable, "message with the same idempotency key is still being processed")
+
+// errProcessingFailed rolls back the transaction of a message whose handling did not succeed.
+var errProcessingFailed = errors.New("message processing failed")
+
+// IdempotencyService makes sure a message is acted on once per idempotency key, however often it
+// is delivered. The response of the first successful processing is stored with the writes it
+// caused, in the same transaction, and replayed for every duplicate until the record expires.
+type IdempotencyService interface {
+	Process(ctx context.Context, key string, handle func(ctx context.Context) (*messaging.Envelope, bool)) (*messaging.Envelope, bool, error)
+}
+
+type idempotencyService struct {
+	log  *logger.Logger
+	repo repo.ProcessedMessageRepository
+	uow  repo.UnitOfWork
+	ttl  time.Duration
+}
+
+func NewIdempotencyService(log *logger.Logger, repo repo.ProcessedMessageRepository, uow repo.UnitOfWork, ttl time.Duration) IdempotencyService {
+	return &idempotencyService{
+		log:  log,
+		repo: repo,
+		uow:  uow,
+		ttl:  ttl,
+	}
+}
+
+// Process runs handle unless key was processed before, in which case the stored response is
+// returned with replayed set. handle reports whether its response is a success; only then are
+// its writes committed and the response kept, otherwise the key is released for a retry.
+// A duplicate arriving while the first delivery is in flight waits for it to finish. Keys are
+// kept apart per tenant and user of the principal of ctx, so nobody replays the response of another.
+func (is *idempotencyService) Process(ctx context.Context, idempotencyKey string, handle func(ctx context.Context) (*messaging.Envelope, bool)) (*messaging.Envelope, bool, error) {
+	key := dhauli.ProcessedMessageKey{Key: idempotencyKey}
+	if principal := PrincipalFromContext(ctx); principal != nil {
+		key.TenantID, key.UserID = principal.Tenant.ID, principal.User.ID
+	}
+	deadline := time.Now().Add(idempotencyMaxWait)
+	for {
+		record, claimed, err := is.repo.Claim(ctx, key, idempotencyLockDuration, is.ttl)
+		if err != nil {
+			return nil, false, err
+		}
+		if claimed {
+			break
+		}
+		if record.Status == repo.ProcessedStatus {
+			response, err := messaging.FromJSON(record.Response)
+			if err != nil {
+				is.log.Errorf("Error decoding stored response of message %v: %v", key, err)
+				return nil, false, err
+			}
+			return &response, true, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, false, ErrMessageInProgress
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-time.After(idempotencyWaitInterval):
+		}
+	}
+
+	var response *messaging.Envelope
+	err := is.uow.Execute(ctx, func(ctx context.Context) error {
+		var ok bool
+		response, ok = handle(ctx)
+		if !ok {
+			return errProcessingFailed
+		}
+		data, err := response.ToJSON()
+		if err != nil {
+			return err
+		}
+		return is.repo.Complete(ctx, key, data)
+	})
+	if err != nil {
+		if releaseErr := is.repo.Release(context.WithoutCancel(ctx), key); releaseErr != nil {
+			is.log.Errorf("Error releasing message %v after failed processing: %v", key, releaseErr)
+		}
+		if !errors.Is(err, errProcessingFailed) {
+			return nil, false, err
+		}
+	}
+	return response, false, nil
+}
@@ -0,0 +1,137 @@
+package svc
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+)
+
+const (
+	RevertAction = "revert"
+	UndoAction   = "undo"
+	RedoAction   = "redo"
+)
+
+// maxMementos bounds the undo and redo stacks of an interaction; the oldest states fall off.
+const maxMementos = 20
+
+// interactionState is what a Memento saves of an interaction.
+type interactionState struct {
+	Context          string `json:"context"`
+	Query            string `json:"query"`
+	Answer           string `json:"answer"`
+	SelectedAnswerID string `json:"selectedAnswerId,omitempty"`
+}
+
+// RevertInteraction restores the context, query and answer of the interaction from history entry
+// hid. The revert is a change like any other: it is recorded in the history and can be undone.
+func (cs interactionService) RevertInteraction(ctx context.Context, iid, hid, actor string, version int) (*dhauli.Interaction, error) {
+	snapshot, err := cs.historySvc.GetInteractionHistoryById(ctx, hid)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.InteractionID != iid {
+		return nil, apperr.NewNotFound("interaction history %s not found for interaction %s", hid, iid)
+	}
+	return cs.applyChange(ctx, iid, interactionChange{
+		field:      "revert",
+		changeType: contracts.InteractionChangeReverted,
+		actor:      actor,
+		action:     RevertAction,
+		version:    version,
+		syncStub:   true,
+		mutate: func(in *dhauli.Interaction) error {
+			restoreState(in, interactionState{Context: snapshot.Context, Query: snapshot.Query, Answer: snapshot.Answer}, actor)
+			return nil
+		},
+	})
+}
+
+// UndoInteraction goes back to the state before the last change, or the last redo.
+func (cs interactionService) UndoInteraction(ctx context.Context, iid, actor string, version int) (*dhauli.Interaction, error) {
+	return cs.restoreMemento(ctx, iid, actor, version, UndoAction, func(in *dhauli.Interaction) (*[]dhauli.Memento, *[]dhauli.Memento) {
+		return &in.Undo, &in.Redo
+	})
+}
+
+// RedoInteraction reapplies the last undone change, as long as nothing else changed since.
+func (cs interactionService) RedoInteraction(ctx context.Context, iid, actor string, version int) (*dhauli.Interaction, error) {
+	return cs.restoreMemento(ctx, iid, actor, version, RedoAction, func(in *dhauli.Interaction) (*[]dhauli.Memento, *[]dhauli.Memento) {
+		return &in.Redo, &in.Undo
+	})
+}
+
+// restoreMemento pops the state to go back to from one stack and saves the current state on the
+// other, so the step can be reversed.
+func (cs interactionService) restoreMemento(ctx context.Context, iid, actor string, version int, action string, stacks func(in *dhauli.Interaction) (from, to *[]dhauli.Memento)) (*dhauli.Interaction, error) {
+	return cs.applyChange(ctx, iid, interactionChange{
+		field:      action,
+		changeType: contracts.InteractionChangeReverted,
+		actor:      actor,
+		action:     action,
+		version:    version,
+		syncStub:   true,
+		restoring:  true,
+		mutate: func(in *dhauli.Interaction) error {
+			from, to := stacks(in)
+			if len(*from) == 0 {
+				return apperr.NewConflict("interaction %s has nothing to %s", iid, action)
+			}
+			m := (*from)[len(*from)-1]
+			var state interactionState
+			if err := json.Unmarshal([]byte(m.State), &state); err != nil {
+				cs.log.Errorf("Error decoding memento %d of interaction %s: %v", m.Index, iid, err)
+				return err
+			}
+			*from = (*from)[:len(*from)-1]
+			pushMemento(to, mementoOf(in, actor))
+			restoreState(in, state, actor)
+			return nil
+		},
+	})
+}
+
+func mementoOf(in *dhauli.Interaction, actor string) dhauli.Memento {
+	state, _ := json.Marshal(interactionState{
+		Context:          in.Context,
+		Query:            in.Query,
+		Answer:           in.Answer,
+		SelectedAnswerID: in.SelectedAnswerID,
+	})
+	return dhauli.Memento{Index: in.Version, State: string(state), Actor: actor}
+}
+
+func pushMemento(stack *[]dhauli.Memento, m dhauli.Memento) {
+	*stack = append(*stack, m)
+	if len(*stack) > maxMementos {
+		*stack = (*stack)[len(*stack)-maxMementos:]
+	}
+}
+
+// restoreState puts state back into the interaction. The answer goes back to its candidate when
+// there still is one with that text, otherwise it becomes a new candidate.
+func restoreState(in *dhauli.Interaction, state interactionState, actor string) {
+	in.Context = state.Context
+	in.Query = state.Query
+	seedAnswerCandidate(in, "")
+	if state.SelectedAnswerID != "" && in.SelectAnswer(state.SelectedAnswerID) && in.Answer == state.Answer {
+		return
+	}
+	if state.Answer == "" {
+		in.Answer = ""
+		in.SelectedAnswerID = ""
+		return
+	}
+	for i := len(in.Answers) - 1; i >= 0; i-- {
+		if in.Answers[i].Text == state.Answer {
+			in.SelectAnswer(in.Answers[i].ID)
+			return
+		}
+	}
+	candidate := newAnswerCandidate(state.Answer, actor)
+	in.Answers = append(in.Answers, candidate)
+	in.SelectAnswer(candidate.ID)
+}
@@ -2,134 +2,423 @@ package svc
 
 import (
 	"context"
-	"errors"
 	"time"
 
+	"github.com/mangudaigb/conversation-service/internal/apperr"
 	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
 	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/logger"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Actions recorded in the history of an interaction a branch is forked from.
+const (
+	ForkAction       = "fork"
+	RegenerateAction = "regenerate"
+)
+
+// InteractionService edits interactions. The Update methods take the version the caller based
+// the edit on and fail with PreconditionFailed when the interaction has moved on since; a zero
+// version updates unconditionally.
 type InteractionService interface {
 	CreateInteraction(ctx context.Context, interaction *dhauli.Interaction) (*dhauli.Interaction, error)
 	GetInteractionById(ctx context.Context, iid string) (*dhauli.Interaction, error)
 	GetInteractionByConversationId(ctx context.Context, cid string) ([]*dhauli.Interaction, error)
+	GetInteractionAsOf(ctx context.Context, iid string, asOf time.Time) (*dhauli.Interaction, error)
+	GetInteractionAtVersion(ctx context.Context, iid string, version int) (*dhauli.Interaction, error)
+	DiffInteractionVersions(ctx context.Context, iid string, from, to int) (*dhauli.InteractionDiff, error)
 	UpdateContextInInteraction(ctx context.Context, iid string, context string, actor, action string, version int) (*dhauli.Interaction, error)
+	MergeContextInInteraction(ctx context.Context, iid string, context string, actor, action string, version int) (*dhauli.Interaction, error)
 	UpdateQueryInInteraction(ctx context.Context, iid string, context string, actor, action string, version int) (*dhauli.Interaction, error)
 	UpdateAnswerInInteraction(ctx context.Context, iid string, response string, actor, action string, version int) (*dhauli.Interaction, error)
-	DeleteInteraction(ctx context.Context, iid string) error
+	AddAnswerToInteraction(ctx context.Context, iid string, candidate dhauli.AnswerCandidate, selectAnswer bool) (*dhauli.Interaction, error)
+	SelectAnswerInInteraction(ctx context.Context, iid string, aid string, actor string) (*dhauli.Interaction, error)
+	RevertInteraction(ctx context.Context, iid string, hid string, actor string, version int) (*dhauli.Interaction, error)
+	UndoInteraction(ctx context.Context, iid string, actor string, version int) (*dhauli.Interaction, error)
+	RedoInteraction(ctx context.Context, iid string, actor string, version int) (*dhauli.Interaction, error)
+	ForkInteraction(ctx context.Context, iid string, query string, actor, action string) (*dhauli.Interaction, error)
+	DeleteInteraction(ctx context.Context, iid string, cascade bool) error
 }
 
 type interactionService struct {
 	log                   *logger.Logger
+	uow                   repo.UnitOfWork
 	interactionRepository repo.InteractionRepository
 	historySvc            InteractionHistoryService
 	conversationSvc       ConversationService
+	changeSvc             ChangeService
 }
 
-func NewInteractionService(log *logger.Logger, repo repo.InteractionRepository, hSvc InteractionHistoryService, cSvc ConversationService) InteractionService {
+func NewInteractionService(log *logger.Logger, uow repo.UnitOfWork, hSvc InteractionHistoryService, cSvc ConversationService, changeSvc ChangeService) InteractionService {
 	return &interactionService{
 		log:                   log,
-		interactionRepository: repo,
+		uow:                   uow,
+		interactionRepository: uow.Interactions(),
 		historySvc:            hSvc,
 		conversationSvc:       cSvc,
+		changeSvc:             changeSvc,
 	}
 }
 
-// TODO Convert this to a single transaction
+// CreateInteraction stores the interaction and appends its stub to the conversation within one transaction.
+// Without an explicit parent the interaction continues the active branch.
 func (cs interactionService) CreateInteraction(ctx context.Context, interaction *dhauli.Interaction) (*dhauli.Interaction, error) {
-	interaction.ID = primitive.NewObjectID().Hex()
-	now := time.Now()
-	interaction.CreatedAt = now
-	interaction.UpdatedAt = now
-	interaction.Version = 1
-	cid := interaction.ConversationID
-	if interaction.Query == "" {
-		_, _ = cs.conversationSvc.AddInteractionByConversationId(ctx, cid, dhauli.InteractionStub{
-			ID:    interaction.ID,
-			Query: interaction.Query,
-		})
-	} else {
-		_, _ = cs.conversationSvc.AddInteractionByConversationId(ctx, cid, dhauli.InteractionStub{
-			ID:     interaction.ID,
-			Query:  interaction.Query,
-			Answer: interaction.Answer,
-		})
+	var created *dhauli.Interaction
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		in := *interaction
+		in.ID = primitive.NewObjectID().Hex()
+		now := time.Now()
+		in.CreatedAt = now
+		in.UpdatedAt = now
+		in.Version = 1
+		seedAnswerCandidate(&in, "")
+		conversation, err := cs.conversationSvc.AddInteractionByConversationId(ctx, in.ConversationID, stubFor(&in))
+		if err != nil {
+			cs.log.Errorf("Error adding interaction %s to conversation %s: %v", in.ID, in.ConversationID, err)
+			return err
+		}
+		stub, _ := conversation.Stub(in.ID)
+		in.ParentID = stub.ParentID
+		in.Ownership = conversation.Ownership
+		created, err = cs.interactionRepository.Create(ctx, &in)
+		if err != nil {
+			cs.log.Errorf("Error creating interaction: %v", err)
+			return err
+		}
+		return cs.changeSvc.Record(ctx, created.ConversationID, created.ID, contracts.InteractionChangeCreated, "", created)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return cs.interactionRepository.Create(ctx, interaction)
+	return created, nil
 }
 
+// GetInteractionById hides interactions of conversations in the trash.
 func (cs interactionService) GetInteractionById(ctx context.Context, id string) (*dhauli.Interaction, error) {
-	return cs.interactionRepository.GetById(ctx, id)
+	interaction, err := cs.interactionRepository.GetById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if interaction.DeletedAt != nil {
+		return nil, apperr.NewNotFound("interaction %s not found", id)
+	}
+	return interaction, nil
 }
 
 func (cs interactionService) GetInteractionByConversationId(ctx context.Context, cid string) ([]*dhauli.Interaction, error) {
-	filter := bson.M{"conversationId": cid}
+	filter := bson.M{"conversationId": cid, "deletedAt": nil}
 	return cs.interactionRepository.Filter(ctx, filter)
 }
 
 func (cs interactionService) UpdateContextInInteraction(ctx context.Context, iid, context, actor, action string, version int) (*dhauli.Interaction, error) {
-	interaction, err := cs.interactionRepository.GetById(ctx, iid)
+	return cs.applyChange(ctx, iid, interactionChange{
+		field:      "context",
+		changeType: contracts.InteractionChangeContextUpdated,
+		actor:      actor,
+		action:     action,
+		version:    version,
+		mutate: func(in *dhauli.Interaction) error {
+			in.Context = context
+			return nil
+		},
+	})
+}
+
+// UpdateQueryInInteraction edits the query in place only while nothing depends on it. Once the
+// interaction has an answer or follow-ups, the edit forks a new branch so the old one stays consistent.
+// The version check and the choice between the two are made in the transaction of the edit.
+func (cs interactionService) UpdateQueryInInteraction(ctx context.Context, iid, query, actor, action string, version int) (*dhauli.Interaction, error) {
+	var updated *dhauli.Interaction
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		interaction, err := cs.GetInteractionById(ctx, iid)
+		if err != nil {
+			cs.log.Errorf("Error getting interaction for id: %s err: %v", iid, err)
+			return err
+		}
+		if version > 0 && interaction.Version != version {
+			cs.log.Errorf("Error updating query for interaction %s. Version mismatch. Expected: %d, Actual: %d", iid, version, interaction.Version)
+			return apperr.New(apperr.PreconditionFailed, "interaction version mismatch: expected %d, actual %d", version, interaction.Version)
+		}
+		conversation, err := cs.conversationSvc.GetConversationById(ctx, interaction.ConversationID)
+		if err != nil {
+			return err
+		}
+		if interaction.Answer != "" || len(conversation.Children(iid)) > 0 {
+			updated, err = cs.ForkInteraction(ctx, iid, query, actor, action)
+			return err
+		}
+		updated, err = cs.applyChange(ctx, iid, interactionChange{
+			field:      "query",
+			changeType: contracts.InteractionChangeQueryUpdated,
+			actor:      actor,
+			action:     action,
+			version:    version,
+			syncStub:   true,
+			mutate: func(in *dhauli.Interaction) error {
+				in.Query = query
+				return nil
+			},
+		})
+		return err
+	})
 	if err != nil {
-		cs.log.Errorf("Error getting conversation for id: %s err: %v", iid, err)
 		return nil, err
 	}
-	if interaction.Version != version {
-		cs.log.Errorf("Error updating context for interaction %s. Version mismatch. Expected: %d, Actual: %d", iid, version, interaction.Version)
-		return nil, errors.New("interaction version mismatch")
+	return updated, nil
+}
+
+// UpdateAnswerInInteraction keeps the whole-string API: the response becomes a new candidate
+// which is selected straight away, so earlier answers are preserved.
+func (cs interactionService) UpdateAnswerInInteraction(ctx context.Context, iid, response, actor, action string, version int) (*dhauli.Interaction, error) {
+	candidate := newAnswerCandidate(response, actor)
+	return cs.applyChange(ctx, iid, interactionChange{
+		field:      "answer",
+		changeType: contracts.InteractionChangeAnswerUpdated,
+		actor:      actor,
+		action:     action,
+		answerId:   candidate.ID,
+		version:    version,
+		syncStub:   true,
+		mutate: func(in *dhauli.Interaction) error {
+			seedAnswerCandidate(in, "")
+			in.Answers = append(in.Answers, candidate)
+			in.SelectAnswer(candidate.ID)
+			return nil
+		},
+	})
+}
+
+// AddAnswerToInteraction appends a candidate. The first candidate of an interaction is always
+// selected; later ones only when selectAnswer is set.
+func (cs interactionService) AddAnswerToInteraction(ctx context.Context, iid string, candidate dhauli.AnswerCandidate, selectAnswer bool) (*dhauli.Interaction, error) {
+	if candidate.ID == "" {
+		candidate.ID = primitive.NewObjectID().Hex()
 	}
-	_, err = cs.historySvc.AddHistoryForInteraction(ctx, interaction, actor, action)
+	candidate.CreatedAt = time.Now()
+	return cs.applyChange(ctx, iid, interactionChange{
+		field:      "answer",
+		changeType: contracts.InteractionChangeAnswerUpdated,
+		actor:      candidate.Actor,
+		action:     "answer",
+		answerId:   candidate.ID,
+		syncStub:   true,
+		mutate: func(in *dhauli.Interaction) error {
+			seedAnswerCandidate(in, "")
+			in.Answers = append(in.Answers, candidate)
+			if selectAnswer || in.SelectedAnswerID == "" {
+				in.SelectAnswer(candidate.ID)
+			}
+			return nil
+		},
+	})
+}
+
+func (cs interactionService) SelectAnswerInInteraction(ctx context.Context, iid, aid, actor string) (*dhauli.Interaction, error) {
+	return cs.applyChange(ctx, iid, interactionChange{
+		field:      "answer",
+		changeType: contracts.InteractionChangeAnswerUpdated,
+		actor:      actor,
+		action:     "select",
+		answerId:   aid,
+		syncStub:   true,
+		mutate: func(in *dhauli.Interaction) error {
+			seedAnswerCandidate(in, "")
+			if !in.SelectAnswer(aid) {
+				cs.log.Errorf("Answer %s is not a candidate of interaction %s", aid, iid)
+				return apperr.NewNotFound("answer candidate %s not found in interaction %s", aid, iid)
+			}
+			return nil
+		},
+	})
+}
+
+type interactionChange struct {
+	field      string
+	changeType string
+	actor      string
+	action     string
+	answerId   string
+	version    int
+	syncStub   bool
+	// restoring marks undo and redo, which manage the memento stacks themselves
+	restoring bool
+	mutate    func(in *dhauli.Interaction) error
+}
+
+// applyChange snapshots the current interaction into the history, applies the mutation and, when
+// the change is visible in the conversation, refreshes the stub. All writes share one transaction.
+func (cs interactionService) applyChange(ctx context.Context, iid string, change interactionChange) (*dhauli.Interaction, error) {
+	var updated *dhauli.Interaction
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		interaction, err := cs.GetInteractionById(ctx, iid)
+		if err != nil {
+			cs.log.Errorf("Error getting interaction for id: %s err: %v", iid, err)
+			return err
+		}
+		if change.version > 0 && interaction.Version != change.version {
+			cs.log.Errorf("Error updating %s for interaction %s. Version mismatch. Expected: %d, Actual: %d", change.field, iid, change.version, interaction.Version)
+			return apperr.New(apperr.PreconditionFailed, "interaction version mismatch: expected %d, actual %d", change.version, interaction.Version)
+		}
+		if _, err = cs.historySvc.AddHistoryForAnswer(ctx, interaction, change.actor, change.action, change.answerId); err != nil {
+			cs.log.Errorf("Error adding history for interaction while updating %s: %v", change.field, err)
+			return err
+		}
+		before := mementoOf(interaction, change.actor)
+		if err = change.mutate(interaction); err != nil {
+			return err
+		}
+		if !change.restoring {
+			pushMemento(&interaction.Undo, before)
+			interaction.Redo = nil
+		}
+		interaction.UpdatedAt = time.Now()
+		updated, err = cs.interactionRepository.Update(ctx, interaction)
+		if err != nil {
+			cs.log.Errorf("Error updating %s for interaction %s: %v", change.field, iid, err)
+			return err
+		}
+		if change.syncStub {
+			if _, err = cs.conversationSvc.AddInteractionByConversationId(WithActor(ctx, change.actor), updated.ConversationID, stubFor(updated)); err != nil {
+				cs.log.Errorf("Error updating stub of interaction %s in conversation %s: %v", iid, updated.ConversationID, err)
+				return err
+			}
+		}
+		return cs.changeSvc.Record(ctx, updated.ConversationID, iid, change.changeType, change.actor, updated)
+	})
 	if err != nil {
-		cs.log.Errorf("Error adding history for interaction while updating context: %v", err)
 		return nil, err
 	}
-	interaction.Context = context
-	interaction.UpdatedAt = time.Now()
-	return cs.interactionRepository.Update(ctx, interaction)
+	return updated, nil
 }
 
-func (cs interactionService) UpdateQueryInInteraction(ctx context.Context, iid, query, actor, action string, version int) (*dhauli.Interaction, error) {
-	interaction, err := cs.interactionRepository.GetById(ctx, iid)
-	if err != nil {
-		cs.log.Errorf("Error getting conversation for id: %s err: %v", iid, err)
-		return nil, err
+// ForkInteraction adds a sibling of iid that asks query, or the same query again when query is
+// empty, and makes the new branch the active one. The history of iid records the fork.
+func (cs interactionService) ForkInteraction(ctx context.Context, iid string, query string, actor, action string) (*dhauli.Interaction, error) {
+	if actor == "" {
+		actor = actorOf(ctx)
 	}
-	if interaction.Version != version {
-		cs.log.Errorf("Error updating query for interaction %s. Version mismatch. Expected: %d, Actual: %d", iid, version, interaction.Version)
-		return nil, errors.New("interaction version mismatch")
+	if action == "" {
+		action = ForkAction
 	}
-	_, err = cs.historySvc.AddHistoryForInteraction(ctx, interaction, actor, action)
+	var created *dhauli.Interaction
+	err := cs.uow.Execute(ctx, func(ctx context.Context) error {
+		source, err := cs.GetInteractionById(ctx, iid)
+		if err != nil {
+			cs.log.Errorf("Error getting interaction for id: %s err: %v", iid, err)
+			return err
+		}
+		if _, err = cs.historySvc.AddHistoryForInteraction(ctx, source, actor, action); err != nil {
+			cs.log.Errorf("Error adding history for interaction %s while forking it: %v", iid, err)
+			return err
+		}
+		if query == "" {
+			query = source.Query
+		}
+		now := time.Now()
+		in := dhauli.Interaction{
+			ID:             primitive.NewObjectID().Hex(),
+			WorkflowID:     source.WorkflowID,
+			SessionID:      source.SessionID,
+			ConversationID: source.ConversationID,
+			ParentID:       source.ParentID,
+			Ownership:      source.Ownership,
+			Context:        source.Context,
+			Query:          query,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+			Version:        1,
+		}
+		created, err = cs.interactionRepository.Create(ctx, &in)
+		if err != nil {
+			cs.log.Errorf("Error creating fork of interaction %s: %v", iid, err)
+			return err
+		}
+		if _, err = cs.conversationSvc.AddBranchByConversationId(WithActor(ctx, actor), in.ConversationID, stubFor(created)); err != nil {
+			cs.log.Errorf("Error adding fork of interaction %s to conversation %s: %v", iid, in.ConversationID, err)
+			return err
+		}
+		return cs.changeSvc.Record(ctx, created.ConversationID, created.ID, contracts.InteractionChangeCreated, actor, created)
+	})
 	if err != nil {
-		cs.log.Errorf("Error adding history for interaction while updating query: %v", err)
 		return nil, err
 	}
-	interaction.Query = query
-	interaction.UpdatedAt = time.Now()
-	return cs.interactionRepository.Update(ctx, interaction)
+	return created, nil
 }
 
-func (cs interactionService) UpdateAnswerInInteraction(ctx context.Context, iid, response, actor, action string, version int) (*dhauli.Interaction, error) {
-	interaction, err := cs.interactionRepository.GetById(ctx, iid)
-	if err != nil {
-		cs.log.Errorf("Error getting conversation for id: %s err: %v", iid, err)
-		return nil, err
-	}
-	if interaction.Version != version {
-		cs.log.Errorf("Error updating answer for interaction %s. Version mismatch. Expected: %d, Actual: %d", iid, version, interaction.Version)
-		return nil, errors.New("interaction version mismatch")
+// DeleteInteraction deletes the interaction and its history and removes its stub, all in one
+// transaction. The interactions following it move up to its parent, unless cascade asks for them
+// to be deleted as well.
+func (cs interactionService) DeleteInteraction(ctx context.Context, id string, cascade bool) error {
+	return cs.uow.Execute(ctx, func(ctx context.Context) error {
+		interaction, err := cs.GetInteractionById(ctx, id)
+		if err != nil {
+			cs.log.Errorf("Error getting interaction for id: %s err: %v", id, err)
+			return err
+		}
+		// deleted first so the version given by If-Match is checked by the delete itself
+		if err = cs.interactionRepository.Delete(ctx, id); err != nil {
+			return err
+		}
+		ids, err := cs.conversationSvc.RemoveInteractionByConversationId(ctx, interaction.ConversationID, id, cascade)
+		if apperr.KindOf(err) == apperr.NotFound {
+			// the stub or the whole conversation is gone already, the interaction is an orphan
+			ids, err = []string{id}, nil
+		}
+		if err != nil {
+			cs.log.Errorf("Error removing interaction %s from conversation %s: %v", id, interaction.ConversationID, err)
+			return err
+		}
+		if !cascade {
+			following := bson.M{"conversationId": interaction.ConversationID, "parentId": id}
+			if _, err = cs.interactionRepository.SetMany(ctx, following, bson.M{"parentId": interaction.ParentID}); err != nil {
+				cs.log.Errorf("Error moving the interactions following %s up to its parent: %v", id, err)
+				return err
+			}
+		}
+		filter := bson.M{"_id": bson.M{"$in": ids}}
+		if _, err = cs.interactionRepository.DeleteMany(ctx, filter); err != nil {
+			cs.log.Errorf("Error deleting interaction %s: %v", id, err)
+			return err
+		}
+		if _, err = cs.uow.InteractionHistory().DeleteMany(ctx, bson.M{"interactionId": bson.M{"$in": ids}}); err != nil {
+			cs.log.Errorf("Error deleting history of interaction %s: %v", id, err)
+			return err
+		}
+		for _, iid := range ids {
+			if err = cs.changeSvc.Record(ctx, interaction.ConversationID, iid, contracts.InteractionChangeDeleted, "", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func stubFor(interaction *dhauli.Interaction) dhauli.InteractionStub {
+	return dhauli.InteractionStub{
+		ID:       interaction.ID,
+		ParentID: interaction.ParentID,
+		Query:    interaction.Query,
+		Answer:   interaction.Answer,
 	}
-	_, err = cs.historySvc.AddHistoryForInteraction(ctx, interaction, actor, action)
-	if err != nil {
-		cs.log.Errorf("Error adding history for interaction while updating answer: %v", err)
-		return nil, err
+}
+
+func newAnswerCandidate(text, actor string) dhauli.AnswerCandidate {
+	return dhauli.AnswerCandidate{
+		ID:        primitive.NewObjectID().Hex(),
+		Text:      text,
+		Actor:     actor,
+		CreatedAt: time.Now(),
 	}
-	interaction.Answer = response
-	interaction.UpdatedAt = time.Now()
-	return cs.interactionRepository.Update(ctx, interaction)
 }
 
-func (cs interactionService) DeleteInteraction(ctx context.Context, id string) error {
-	return cs.interactionRepository.Delete(ctx, id)
+// seedAnswerCandidate turns an answer written before candidates existed into the first candidate.
+func seedAnswerCandidate(in *dhauli.Interaction, actor string) {
+	if in.Answer == "" || len(in.Answers) > 0 {
+		return
+	}
+	candidate := newAnswerCandidate(in.Answer, actor)
+	in.Answers = []dhauli.AnswerCandidate{candidate}
+	in.SelectedAnswerID = candidate.ID
 }
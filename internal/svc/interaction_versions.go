@@ -0,0 +1,95 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/merge"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+)
+
+// GetInteractionAsOf reconstructs the interaction as it was at asOf from the snapshot taken by the
+// first change after it. Answer candidates added later are left out.
+func (cs interactionService) GetInteractionAsOf(ctx context.Context, iid string, asOf time.Time) (*dhauli.Interaction, error) {
+	current, err := cs.GetInteractionById(ctx, iid)
+	if err != nil {
+		return nil, err
+	}
+	if asOf.Before(current.CreatedAt) {
+		return nil, apperr.NewNotFound("interaction %s did not exist at %s", iid, asOf.Format(time.RFC3339))
+	}
+	snapshot, err := cs.historySvc.GetSnapshotAfter(ctx, iid, asOf)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return current, nil
+	}
+	in := fromSnapshot(current, snapshot)
+	in.Answers = nil
+	for _, candidate := range current.Answers {
+		if !candidate.CreatedAt.After(asOf) {
+			in.Answers = append(in.Answers, candidate)
+		}
+	}
+	return in, nil
+}
+
+// GetInteractionAtVersion returns the interaction with its context, query and answer as they were
+// at version.
+func (cs interactionService) GetInteractionAtVersion(ctx context.Context, iid string, version int) (*dhauli.Interaction, error) {
+	current, err := cs.GetInteractionById(ctx, iid)
+	if err != nil {
+		return nil, err
+	}
+	if version == current.Version {
+		return current, nil
+	}
+	if version <= 0 || version > current.Version {
+		return nil, apperr.NewNotFound("interaction %s has no version %d", iid, version)
+	}
+	snapshot, err := cs.historySvc.GetSnapshotAtVersion(ctx, iid, version)
+	if err != nil {
+		return nil, err
+	}
+	return fromSnapshot(current, snapshot), nil
+}
+
+func (cs interactionService) DiffInteractionVersions(ctx context.Context, iid string, from, to int) (*dhauli.InteractionDiff, error) {
+	a, err := cs.GetInteractionAtVersion(ctx, iid, from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := cs.GetInteractionAtVersion(ctx, iid, to)
+	if err != nil {
+		return nil, err
+	}
+	diff := &dhauli.InteractionDiff{InteractionID: iid, From: from, To: to}
+	fields := []struct {
+		name   string
+		a, b   string
+		target *string
+	}{
+		{"context", a.Context, b.Context, &diff.Context},
+		{"query", a.Query, b.Query, &diff.Query},
+		{"answer", a.Answer, b.Answer, &diff.Answer},
+	}
+	for _, f := range fields {
+		*f.target, err = merge.Unified(f.a, f.b, fmt.Sprintf("%s@%d", f.name, from), fmt.Sprintf("%s@%d", f.name, to))
+		if err != nil {
+			return nil, apperr.Wrap(apperr.Validation, err, "%s of interaction %s is too large to diff", f.name, iid)
+		}
+	}
+	return diff, nil
+}
+
+func fromSnapshot(current *dhauli.Interaction, snapshot *dhauli.InteractionHistory) *dhauli.Interaction {
+	in := *current
+	in.Context = snapshot.Context
+	in.Query = snapshot.Query
+	in.Answer = snapshot.Answer
+	in.Version = snapshot.Version
+	return &in
+}
@@ -0,0 +1,223 @@
+package svc
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// sweepBatchSize bounds how many documents of a collection one step of a sweep reads, and with it
+// the ids one query names.
+const sweepBatchSize = 500
+
+// OrphanSweeper finds interactions, conversation history and changes whose conversation is gone,
+// and interaction history and answer chunks whose interaction is gone, which deletes made before
+// they cascaded left behind.
+type OrphanSweeper interface {
+	Sweep(ctx context.Context, remove bool) (*dhauli.OrphanReport, error)
+	Run(ctx context.Context)
+}
+
+type orphanSweeper struct {
+	log         *logger.Logger
+	uow         repo.UnitOfWork
+	historyRepo repo.ConversationHistoryRepository
+	chunkRepo   repo.AnswerChunkRepository
+	changeRepo  repo.ChangeRepository
+	interval    time.Duration
+	remove      bool
+}
+
+func NewOrphanSweeper(log *logger.Logger, uow repo.UnitOfWork, historyRepo repo.ConversationHistoryRepository, chunkRepo repo.AnswerChunkRepository,
+	changeRepo repo.ChangeRepository, interval time.Duration, remove bool) OrphanSweeper {
+	return &orphanSweeper{
+		log:         log,
+		uow:         uow,
+		historyRepo: historyRepo,
+		chunkRepo:   chunkRepo,
+		changeRepo:  changeRepo,
+		interval:    interval,
+		remove:      remove,
+	}
+}
+
+// Run sweeps every interval until ctx is done. Only one instance should run it at a time.
+func (sw *orphanSweeper) Run(ctx context.Context) {
+	sw.log.Infof("Orphan sweeper started, removing orphans: %v", sw.remove)
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+	for {
+		report, err := sw.Sweep(ctx, sw.remove)
+		if err != nil {
+			sw.log.Errorf("Error sweeping orphans: %v", err)
+		} else if report.Interactions > 0 || report.ConversationHistory > 0 || report.Changes > 0 ||
+			report.HistoryEntries > 0 || report.AnswerChunks > 0 {
+			sw.log.Infof("Orphans: %d interactions, %d conversation history entries and %d changes of %d missing conversations, "+
+				"%d history entries and %d answer chunks of %d missing interactions, removed: %v",
+				report.Interactions, report.ConversationHistory, report.Changes, len(report.ConversationIDs),
+				report.HistoryEntries, report.AnswerChunks, len(report.InteractionIDs), report.Removed)
+		}
+		select {
+		case <-ctx.Done():
+			sw.log.Infof("Orphan sweeper stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep reports the orphans and, when remove is set, deletes them. Every collection is walked in
+// batches of sweepBatchSize documents. Interactions are swept first so what depends on those
+// removed is swept in the same pass.
+func (sw *orphanSweeper) Sweep(ctx context.Context, remove bool) (*dhauli.OrphanReport, error) {
+	report := &dhauli.OrphanReport{Removed: remove}
+	conversations := func(ctx context.Context, ids []string) ([]string, error) {
+		return sw.uow.Conversations().Distinct(ctx, "_id", bson.M{"_id": bson.M{"$in": ids}})
+	}
+	interactions := func(ctx context.Context, ids []string) ([]string, error) {
+		return sw.uow.Interactions().Distinct(ctx, "_id", bson.M{"_id": bson.M{"$in": ids}})
+	}
+	missingConversations := make(map[string]bool)
+	missingInteractions := make(map[string]bool)
+	noteMissing := func(found map[string]bool, cids []string) {
+		for _, cid := range cids {
+			found[cid] = true
+		}
+	}
+
+	err := sw.walk(ctx, sw.uow.Interactions().DistinctAfter, "conversationId", conversations, func(cids []string) error {
+		noteMissing(missingConversations, cids)
+		filter := bson.M{"conversationId": bson.M{"$in": cids}}
+		ids, err := sw.uow.Interactions().Distinct(ctx, "_id", filter)
+		if err != nil {
+			return err
+		}
+		report.Interactions += len(ids)
+		if remove {
+			_, err = sw.uow.Interactions().DeleteMany(ctx, filter)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = sw.walk(ctx, sw.historyRepo.DistinctAfter, "conversationId", conversations, func(cids []string) error {
+		noteMissing(missingConversations, cids)
+		n, err := sw.purge(ctx, sw.historyRepo.Count, sw.historyRepo.DeleteMany, bson.M{"conversationId": bson.M{"$in": cids}}, remove)
+		report.ConversationHistory += n
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = sw.walk(ctx, sw.changeRepo.DistinctAfter, "conversationId", conversations, func(cids []string) error {
+		noteMissing(missingConversations, cids)
+		n, err := sw.purge(ctx, sw.changeRepo.Count, sw.changeRepo.DeleteMany, bson.M{"conversationId": bson.M{"$in": cids}}, remove)
+		report.Changes += n
+		if err != nil || !remove {
+			return err
+		}
+		for _, cid := range cids {
+			if err = sw.changeRepo.DeleteSeq(ctx, cid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = sw.walk(ctx, sw.uow.InteractionHistory().DistinctAfter, "interactionId", interactions, func(iids []string) error {
+		noteMissing(missingInteractions, iids)
+		n, err := sw.purge(ctx, sw.uow.InteractionHistory().Count, sw.uow.InteractionHistory().DeleteMany,
+			bson.M{"interactionId": bson.M{"$in": iids}}, remove)
+		report.HistoryEntries += n
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = sw.walk(ctx, sw.chunkRepo.DistinctAfter, "interactionId", interactions, func(iids []string) error {
+		noteMissing(missingInteractions, iids)
+		n, err := sw.purge(ctx, sw.chunkRepo.Count, sw.chunkRepo.DeleteMany, bson.M{"interactionId": bson.M{"$in": iids}}, remove)
+		report.AnswerChunks += n
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.ConversationIDs = sortedKeys(missingConversations)
+	report.InteractionIDs = sortedKeys(missingInteractions)
+	return report, nil
+}
+
+// walk pages through the distinct values of field in a collection and hands orphans the values of
+// each page naming no parent left.
+func (sw *orphanSweeper) walk(ctx context.Context, distinctAfter func(ctx context.Context, field string, after string, limit int64) ([]string, error),
+	field string, parents func(ctx context.Context, ids []string) ([]string, error), orphans func(ids []string) error) error {
+	after := ""
+	for {
+		ids, err := distinctAfter(ctx, field, after, sweepBatchSize)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		existing, err := parents(ctx, ids)
+		if err != nil {
+			return err
+		}
+		if gone := missing(ids, existing); len(gone) > 0 {
+			if err = orphans(gone); err != nil {
+				return err
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+// purge deletes what filter matches when remove is set and counts it otherwise.
+func (sw *orphanSweeper) purge(ctx context.Context, count, deleteMany func(ctx context.Context, filter map[string]interface{}) (int64, error),
+	filter map[string]interface{}, remove bool) (int64, error) {
+	if remove {
+		return deleteMany(ctx, filter)
+	}
+	return count(ctx, filter)
+}
+
+func missing(ids, existing []string) []string {
+	found := make(map[string]bool, len(existing))
+	for _, id := range existing {
+		found[id] = true
+	}
+	var result []string
+	for _, id := range ids {
+		if !found[id] {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func sortedKeys(set map[string]bool) []string {
+	if len(set) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,197 @@
+package svc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	outboxBatchSize       = 100
+	outboxPollInterval    = time.Second
+	outboxMinBackoff      = 500 * time.Millisecond
+	outboxMaxBackoff      = 30 * time.Second
+	outboxRetention       = 24 * time.Hour
+	outboxCleanupInterval = time.Hour
+)
+
+// OutboxService makes publishing domain events as reliable as the Mongo write that caused them.
+// Enqueue stores the event in the transaction of the change; Relay publishes stored events in
+// order and marks them delivered. Delivery is at least once, consumers deduplicate on the
+// envelope's IdempotencyKey.
+type OutboxService interface {
+	Enqueue(ctx context.Context, envelope messaging.Envelope) error
+	Relay(ctx context.Context)
+	Stats(ctx context.Context) (*dhauli.OutboxStats, error)
+}
+
+type outboxService struct {
+	log       *logger.Logger
+	repo      repo.OutboxRepository
+	publisher EventPublisher
+	wake      chan struct{}
+
+	mu              sync.Mutex
+	relaying        bool
+	lastDeliveredAt *time.Time
+	lastError       string
+}
+
+func NewOutboxService(log *logger.Logger, repo repo.OutboxRepository, publisher EventPublisher) OutboxService {
+	return &outboxService{
+		log:       log,
+		repo:      repo,
+		publisher: publisher,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (obs *outboxService) Enqueue(ctx context.Context, envelope messaging.Envelope) error {
+	payload, err := envelope.ToJSON()
+	if err != nil {
+		obs.log.Errorf("Error marshalling event %s for the outbox: %v", envelope.EventName, err)
+		return err
+	}
+	entry := dhauli.OutboxEntry{
+		ID:        primitive.NewObjectID().Hex(),
+		EventName: string(envelope.EventName),
+		Key:       envelope.Message.ConversationId,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	}
+	if _, err = obs.repo.Create(ctx, &entry); err != nil {
+		return err
+	}
+	repo.AfterCommit(ctx, func() {
+		select {
+		case obs.wake <- struct{}{}:
+		default:
+		}
+	})
+	return nil
+}
+
+// Relay publishes pending entries until ctx is done. Only one relay may run across all
+// instances, the caller is responsible for holding that lock. A failed batch is retried with
+// exponential backoff before anything behind it is published, keeping events in order.
+func (obs *outboxService) Relay(ctx context.Context) {
+	obs.setRelaying(true)
+	defer obs.setRelaying(false)
+	obs.log.Infof("Outbox relay started")
+
+	backoff := time.Duration(0)
+	lastCleanup := time.Time{}
+	for {
+		wait := outboxPollInterval
+		published, err := obs.relayBatch(ctx)
+		switch {
+		case err != nil:
+			backoff = min(max(2*backoff, outboxMinBackoff), outboxMaxBackoff)
+			wait = backoff
+		case published == outboxBatchSize:
+			backoff = 0
+			wait = 0
+		default:
+			backoff = 0
+		}
+
+		if time.Since(lastCleanup) > outboxCleanupInterval {
+			lastCleanup = time.Now()
+			if _, err = obs.repo.DeleteDelivered(ctx, lastCleanup.Add(-outboxRetention)); err != nil {
+				obs.log.Errorf("Error cleaning up delivered outbox entries: %v", err)
+			}
+		}
+
+		wake := obs.wake
+		if backoff > 0 {
+			wake = nil // keep backing off, a new event does not fix the broker
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			obs.log.Infof("Outbox relay stopped")
+			return
+		case <-wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (obs *outboxService) relayBatch(ctx context.Context) (int, error) {
+	entries, err := obs.repo.GetPending(ctx, outboxBatchSize)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	envelopes := make([]messaging.Envelope, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+		envelope, err := messaging.FromJSON(entry.Payload)
+		if err != nil {
+			// An entry that can never be decoded must not block the ones behind it.
+			obs.log.Errorf("Dropping undecodable outbox entry %s: %v", entry.ID, err)
+			continue
+		}
+		envelopes = append(envelopes, envelope)
+	}
+
+	if err = obs.publisher.Publish(ctx, envelopes...); err != nil {
+		obs.setLastError(err)
+		if markErr := obs.repo.MarkFailed(ctx, ids, err.Error()); markErr != nil {
+			obs.log.Errorf("Error recording failed outbox delivery: %v", markErr)
+		}
+		return 0, err
+	}
+	now := time.Now()
+	if err = obs.repo.MarkDelivered(ctx, ids, now); err != nil {
+		obs.setLastError(err)
+		return 0, err
+	}
+	obs.mu.Lock()
+	obs.lastDeliveredAt = &now
+	obs.lastError = ""
+	obs.mu.Unlock()
+	return len(entries), nil
+}
+
+// Stats reports the relay lag as the age of the oldest event that is not delivered yet.
+func (obs *outboxService) Stats(ctx context.Context) (*dhauli.OutboxStats, error) {
+	oldest, pending, err := obs.repo.GetOldestPending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	obs.mu.Lock()
+	stats := &dhauli.OutboxStats{
+		Pending:         pending,
+		Relaying:        obs.relaying,
+		LastDeliveredAt: obs.lastDeliveredAt,
+		LastError:       obs.lastError,
+	}
+	obs.mu.Unlock()
+	if oldest != nil {
+		stats.OldestPendingAt = &oldest.CreatedAt
+		stats.LagSeconds = time.Since(oldest.CreatedAt).Seconds()
+	}
+	return stats, nil
+}
+
+func (obs *outboxService) setRelaying(relaying bool) {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	obs.relaying = relaying
+}
+
+func (obs *outboxService) setLastError(err error) {
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	obs.lastError = err.Error()
+}
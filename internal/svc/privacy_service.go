@@ -0,0 +1,370 @@
+package svc
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Ways of erasing the data of a user.
+const (
+	// ErasureDelete deletes the conversations of the user with everything depending on them.
+	ErasureDelete = "delete"
+	// ErasureAnonymize keeps the shape of the conversations, but clears their text and replaces
+	// the user with a random pseudonym.
+	ErasureAnonymize = "anonymize"
+)
+
+const exportBatchSize = 100
+
+// PrivacyService answers data subject requests. The data of a user are the conversations whose
+// UserID is theirs, together with their interactions and the history of both.
+type PrivacyService interface {
+	Export(ctx context.Context, uid string, w io.Writer) (*dhauli.ExportManifest, error)
+	Erase(ctx context.Context, uid string, mode string) (*dhauli.ErasureReport, error)
+}
+
+type privacyService struct {
+	log         *logger.Logger
+	uow         repo.UnitOfWork
+	historyRepo repo.ConversationHistoryRepository
+	chunkRepo   repo.AnswerChunkRepository
+	changeRepo  repo.ChangeRepository
+	auditRepo   repo.RetentionAuditRepository
+	changeSvc   ChangeService
+	signingKey  []byte
+}
+
+func NewPrivacyService(log *logger.Logger, uow repo.UnitOfWork, historyRepo repo.ConversationHistoryRepository, chunkRepo repo.AnswerChunkRepository,
+	changeRepo repo.ChangeRepository, auditRepo repo.RetentionAuditRepository, changeSvc ChangeService, signingKey string) PrivacyService {
+	if signingKey == "" {
+		log.Infof("No privacy signing key configured, erasure reports are not signed")
+	}
+	return &privacyService{
+		log:         log,
+		uow:         uow,
+		historyRepo: historyRepo,
+		chunkRepo:   chunkRepo,
+		changeRepo:  changeRepo,
+		auditRepo:   auditRepo,
+		changeSvc:   changeSvc,
+		signingKey:  []byte(signingKey),
+	}
+}
+
+// Export writes a zip archive to w holding a JSON file per conversation, interaction and history
+// entry of the user, followed by the manifest. The archive is streamed, so on error w holds a
+// truncated archive.
+func (ps *privacyService) Export(ctx context.Context, uid string, w io.Writer) (*dhauli.ExportManifest, error) {
+	zw := zip.NewWriter(w)
+	manifest := &dhauli.ExportManifest{UserID: uid, CreatedAt: time.Now(), Files: []dhauli.ExportFile{}}
+	write := func(path string, v any) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		f, err := zw.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(data); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		manifest.Files = append(manifest.Files, dhauli.ExportFile{Path: path, Size: len(data), SHA256: hex.EncodeToString(sum[:])})
+		return nil
+	}
+
+	err := ps.eachConversation(ctx, uid, func(c *dhauli.Conversation) error {
+		if err := write("conversations/"+c.ID+".json", c); err != nil {
+			return err
+		}
+		manifest.Conversations++
+		byConversation := bson.M{"conversationId": c.ID}
+		interactions, err := ps.uow.Interactions().Filter(ctx, byConversation)
+		if err != nil {
+			return err
+		}
+		for _, in := range interactions {
+			if err = write("interactions/"+in.ID+".json", in); err != nil {
+				return err
+			}
+		}
+		manifest.Interactions += len(interactions)
+		history, _, err := ps.uow.InteractionHistory().Page(ctx, byConversation, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, h := range history {
+			if err = write("interactions_history/"+h.ID+".json", h); err != nil {
+				return err
+			}
+		}
+		manifest.InteractionHistory += len(history)
+		conversationHistory, _, err := ps.historyRepo.Page(ctx, byConversation, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, h := range conversationHistory {
+			if err = write("conversations_history/"+h.ID+".json", h); err != nil {
+				return err
+			}
+		}
+		manifest.ConversationHistory += len(conversationHistory)
+		return nil
+	})
+	if err != nil {
+		ps.log.Errorf("Error exporting data of user %s: %v", uid, err)
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	f, err := zw.Create("manifest.json")
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		ps.log.Errorf("Error writing export manifest of user %s: %v", uid, err)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Erase deletes or anonymizes the conversations of the user, each in a transaction of its own,
+// drops their change log and answer chunks, and replaces the user with a pseudonym wherever else
+// they appear as an actor. Conversations under legal hold are left untouched and listed in the
+// report.
+func (ps *privacyService) Erase(ctx context.Context, uid string, mode string) (*dhauli.ErasureReport, error) {
+	if uid == "" {
+		return nil, apperr.NewValidation("user ID is required")
+	}
+	if mode == "" {
+		mode = ErasureDelete
+	}
+	if mode != ErasureDelete && mode != ErasureAnonymize {
+		return nil, apperr.NewValidation("erasure mode must be %s or %s", ErasureDelete, ErasureAnonymize)
+	}
+	pseudonym, err := newPseudonym()
+	if err != nil {
+		return nil, err
+	}
+	report := &dhauli.ErasureReport{
+		ID:        primitive.NewObjectID().Hex(),
+		UserID:    uid,
+		Mode:      mode,
+		StartedAt: time.Now(),
+	}
+
+	err = ps.eachConversation(ctx, uid, func(c *dhauli.Conversation) error {
+		if c.LegalHold {
+			report.Held = append(report.Held, c.ID)
+			return nil
+		}
+		var counts *dhauli.ErasureReport
+		err := ps.uow.Execute(ctx, func(ctx context.Context) error {
+			var err error
+			if mode == ErasureDelete {
+				counts, err = ps.deleteConversation(ctx, c.ID)
+			} else {
+				counts, err = ps.anonymizeConversation(ctx, c.ID, uid, pseudonym)
+			}
+			return err
+		})
+		if err != nil {
+			ps.log.Errorf("Error erasing conversation %s of user %s: %v", c.ID, uid, err)
+			return err
+		}
+		addCounts(report, counts)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	renamed, err := ps.uow.InteractionHistory().SetMany(ctx, bson.M{"actor": uid}, bson.M{"actor": pseudonym})
+	if err != nil {
+		return nil, err
+	}
+	report.InteractionHistory += renamed
+	if renamed, err = ps.historyRepo.SetMany(ctx, bson.M{"actor": uid}, bson.M{"actor": pseudonym}); err != nil {
+		return nil, err
+	}
+	report.ConversationHistory += renamed
+	if _, err = ps.historyRepo.SetMany(ctx, bson.M{"conversation.deletedBy": uid}, bson.M{"conversation.deletedBy": pseudonym}); err != nil {
+		return nil, err
+	}
+	if _, err = ps.auditRepo.SetMany(ctx, bson.M{"userId": uid}, bson.M{"userId": pseudonym}); err != nil {
+		return nil, err
+	}
+	// what was shared with the user is no longer, and past shares no longer name them
+	if _, err = ps.uow.Conversations().PullMany(ctx, bson.M{"acl.user._id": uid}, bson.M{"acl": bson.M{"user._id": uid}}); err != nil {
+		return nil, err
+	}
+	if _, err = ps.historyRepo.PullMany(ctx, bson.M{"conversation.acl.user._id": uid}, bson.M{"conversation.acl": bson.M{"user._id": uid}}); err != nil {
+		return nil, err
+	}
+
+	report.CompletedAt = time.Now()
+	if err = ps.sign(report); err != nil {
+		ps.log.Errorf("Error signing erasure report %s: %v", report.ID, err)
+		return nil, err
+	}
+	ps.log.Infof("Erased data of user %s: report %s, %d conversations, %d held", uid, report.ID, report.Conversations, len(report.Held))
+	return report, nil
+}
+
+func (ps *privacyService) deleteConversation(ctx context.Context, cid string) (*dhauli.ErasureReport, error) {
+	counts := &dhauli.ErasureReport{Conversations: 1}
+	byConversation := bson.M{"conversationId": cid}
+	iids, err := ps.uow.Interactions().Distinct(ctx, "_id", byConversation)
+	if err != nil {
+		return nil, err
+	}
+	if counts.AnswerChunks, err = ps.chunkRepo.DeleteMany(ctx, bson.M{"interactionId": bson.M{"$in": iids}}); err != nil {
+		return nil, err
+	}
+	if counts.Interactions, err = ps.uow.Interactions().DeleteMany(ctx, byConversation); err != nil {
+		return nil, err
+	}
+	if counts.InteractionHistory, err = ps.uow.InteractionHistory().DeleteMany(ctx, byConversation); err != nil {
+		return nil, err
+	}
+	if counts.ConversationHistory, err = ps.historyRepo.DeleteMany(ctx, byConversation); err != nil {
+		return nil, err
+	}
+	if counts.Changes, err = ps.changeRepo.DeleteMany(ctx, byConversation); err != nil {
+		return nil, err
+	}
+	if err = ps.uow.Conversations().Delete(ctx, cid); err != nil {
+		return nil, err
+	}
+	return counts, ps.changeSvc.Record(ctx, cid, "", contracts.ConversationChangeDeleted, "", nil)
+}
+
+// anonymizeConversation clears every text of the conversation, its interactions and their
+// history. The change log holds copies of them and goes as a whole.
+func (ps *privacyService) anonymizeConversation(ctx context.Context, cid, uid, pseudonym string) (*dhauli.ErasureReport, error) {
+	counts := &dhauli.ErasureReport{Conversations: 1}
+	byConversation := bson.M{"conversationId": cid}
+	c, err := ps.uow.Conversations().GetByID(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	c.UserID = pseudonym
+	if c.DeletedBy == uid {
+		c.DeletedBy = pseudonym
+	}
+	for i := range c.Interactions {
+		c.Interactions[i].Query = ""
+		c.Interactions[i].Answer = ""
+	}
+	updated, err := ps.uow.Conversations().Update(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	iids, err := ps.uow.Interactions().Distinct(ctx, "_id", byConversation)
+	if err != nil {
+		return nil, err
+	}
+	if counts.AnswerChunks, err = ps.chunkRepo.DeleteMany(ctx, bson.M{"interactionId": bson.M{"$in": iids}}); err != nil {
+		return nil, err
+	}
+	counts.Interactions, err = ps.uow.Interactions().SetMany(ctx, byConversation, bson.M{
+		"context": "", "query": "", "answer": "",
+		"answers": []dhauli.AnswerCandidate{}, "undo": []dhauli.Memento{}, "redo": []dhauli.Memento{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if counts.InteractionHistory, err = ps.uow.InteractionHistory().SetMany(ctx, byConversation, bson.M{"context": "", "query": "", "answer": ""}); err != nil {
+		return nil, err
+	}
+	if counts.ConversationHistory, err = ps.historyRepo.SetMany(ctx, byConversation, bson.M{"conversation.userId": pseudonym}); err != nil {
+		return nil, err
+	}
+	// the all positional operator fails on snapshots without stubs
+	withStubs := bson.M{"conversationId": cid, "conversation.interactions.0": bson.M{"$exists": true}}
+	if _, err = ps.historyRepo.SetMany(ctx, withStubs, bson.M{"conversation.interactions.$[].query": "", "conversation.interactions.$[].answer": ""}); err != nil {
+		return nil, err
+	}
+	if counts.Changes, err = ps.changeRepo.DeleteMany(ctx, byConversation); err != nil {
+		return nil, err
+	}
+	updated.EnsureTree()
+	return counts, ps.changeSvc.Record(ctx, cid, "", contracts.ConversationChangeUpdated, "", updated)
+}
+
+// eachConversation calls fn for every conversation of the user, trashed ones included, in
+// batches.
+func (ps *privacyService) eachConversation(ctx context.Context, uid string, fn func(c *dhauli.Conversation) error) error {
+	afterId := ""
+	for {
+		batch, err := ps.uow.Conversations().Scan(ctx, bson.M{"userId": uid}, afterId, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, c := range batch {
+			if err = fn(c); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportBatchSize {
+			return nil
+		}
+		afterId = batch[len(batch)-1].ID
+	}
+}
+
+func (ps *privacyService) sign(report *dhauli.ErasureReport) error {
+	report.Signature = ""
+	if len(ps.signingKey) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, ps.signingKey)
+	mac.Write(data)
+	report.Signature = hex.EncodeToString(mac.Sum(nil))
+	return nil
+}
+
+func addCounts(report, counts *dhauli.ErasureReport) {
+	report.Conversations += counts.Conversations
+	report.Interactions += counts.Interactions
+	report.InteractionHistory += counts.InteractionHistory
+	report.ConversationHistory += counts.ConversationHistory
+	report.AnswerChunks += counts.AnswerChunks
+	report.Changes += counts.Changes
+}
+
+// newPseudonym returns a random name for an erased user. Nothing links it back to them.
+func newPseudonym() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "erased-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,283 @@
+package svc
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/internal/settings"
+	"github.com/mangudaigb/conversation-service/pkg/contracts"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RetentionService expires conversations that outlived the retention rule governing them,
+// together with their interactions, answer chunks, changes and the history of both.
+// Conversations under legal hold are kept.
+type RetentionService interface {
+	Apply(ctx context.Context, dryRun bool) (*dhauli.RetentionReport, error)
+	ListAudit(ctx context.Context, query RetentionAuditQuery) ([]*dhauli.RetentionAudit, int64, error)
+	Run(ctx context.Context)
+}
+
+type RetentionAuditQuery struct {
+	ConversationID string
+	TenantID       string
+	UserID         string
+	Rule           string
+	Offset         int64
+	Limit          int64
+}
+
+type retentionService struct {
+	log         *logger.Logger
+	uow         repo.UnitOfWork
+	historyRepo repo.ConversationHistoryRepository
+	chunkRepo   repo.AnswerChunkRepository
+	changeRepo  repo.ChangeRepository
+	auditRepo   repo.RetentionAuditRepository
+	changeSvc   ChangeService
+	rules       []settings.RetentionRule
+	batchSize   int64
+	interval    time.Duration
+	dryRun      bool
+}
+
+func NewRetentionService(log *logger.Logger, uow repo.UnitOfWork, historyRepo repo.ConversationHistoryRepository, chunkRepo repo.AnswerChunkRepository,
+	changeRepo repo.ChangeRepository, auditRepo repo.RetentionAuditRepository, changeSvc ChangeService, rules []settings.RetentionRule, batchSize int64, interval time.Duration, dryRun bool) RetentionService {
+	var valid []settings.RetentionRule
+	for _, rule := range rules {
+		if rule.MaxAge <= 0 {
+			log.Errorf("Ignoring retention rule %q without a positive max age", rule.Name)
+			continue
+		}
+		valid = append(valid, rule)
+	}
+	return &retentionService{
+		log:         log,
+		uow:         uow,
+		historyRepo: historyRepo,
+		chunkRepo:   chunkRepo,
+		changeRepo:  changeRepo,
+		auditRepo:   auditRepo,
+		changeSvc:   changeSvc,
+		rules:       valid,
+		batchSize:   batchSize,
+		interval:    interval,
+		dryRun:      dryRun,
+	}
+}
+
+// Run applies the rules every interval until ctx is done. Only one instance should run it at a
+// time.
+func (rs *retentionService) Run(ctx context.Context) {
+	if len(rs.rules) == 0 {
+		rs.log.Infof("No retention rules configured, conversations are kept forever")
+		<-ctx.Done()
+		return
+	}
+	rs.log.Infof("Retention started with %d rules, dry run: %v", len(rs.rules), rs.dryRun)
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+	for {
+		report, err := rs.Apply(ctx, rs.dryRun)
+		if err != nil {
+			rs.log.Errorf("Error applying retention rules: %v", err)
+		}
+		if report != nil && (len(report.Expired) > 0 || report.Held > 0) {
+			rs.log.Infof("Retention expired %d conversations and kept %d under legal hold, dry run: %v",
+				len(report.Expired), report.Held, report.DryRun)
+		}
+		select {
+		case <-ctx.Done():
+			rs.log.Infof("Retention stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Apply walks the conversations past the max age of each rule in batches and expires those the
+// rule governs, each in a transaction of its own. A dry run only reports them. On error the
+// report holds what was expired until then.
+func (rs *retentionService) Apply(ctx context.Context, dryRun bool) (*dhauli.RetentionReport, error) {
+	report := &dhauli.RetentionReport{DryRun: dryRun, Expired: []*dhauli.RetentionAudit{}}
+	now := time.Now()
+	for i, rule := range rs.rules {
+		filter := bson.M{"updatedAt": bson.M{"$lt": now.Add(-rule.MaxAge)}}
+		if rule.Tenant != "" {
+			filter["tenantId"] = rule.Tenant
+		}
+		if rule.Workflow != "" {
+			filter["workflowId"] = rule.Workflow
+		}
+		if rule.User != "" {
+			filter["userId"] = rule.User
+		}
+		afterId := ""
+		for {
+			batch, err := rs.uow.Conversations().Scan(ctx, filter, afterId, rs.batchSize)
+			if err != nil {
+				rs.log.Errorf("Error scanning conversations for retention rule %q: %v", rule.Name, err)
+				return report, err
+			}
+			for _, c := range batch {
+				if rs.governing(c) != i {
+					continue
+				}
+				if c.LegalHold {
+					report.Held++
+					continue
+				}
+				audit, err := rs.expire(ctx, c, rule, dryRun)
+				if err != nil {
+					rs.log.Errorf("Error expiring conversation %s under retention rule %q: %v", c.ID, rule.Name, err)
+					return report, err
+				}
+				if audit != nil {
+					report.Expired = append(report.Expired, audit)
+				}
+			}
+			if int64(len(batch)) < rs.batchSize {
+				break
+			}
+			if err = ctx.Err(); err != nil {
+				return report, err
+			}
+			afterId = batch[len(batch)-1].ID
+		}
+	}
+	return report, nil
+}
+
+// governing returns the index of the most specific rule matching c, preferring the longer max
+// age between equally specific ones, or -1 when none does.
+func (rs *retentionService) governing(c *dhauli.Conversation) int {
+	best, bestScore := -1, -1
+	for i, rule := range rs.rules {
+		if (rule.Tenant != "" && rule.Tenant != c.TenantID) ||
+			(rule.Workflow != "" && rule.Workflow != c.WorkflowID) ||
+			(rule.User != "" && rule.User != c.UserID) {
+			continue
+		}
+		score := 0
+		if rule.Tenant != "" {
+			score++
+		}
+		if rule.Workflow != "" {
+			score += 2
+		}
+		if rule.User != "" {
+			score += 4
+		}
+		if score > bestScore || (score == bestScore && rule.MaxAge > rs.rules[best].MaxAge) {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// expire deletes c with everything that depends on it and writes the audit record. It returns nil
+// when c changed since it was scanned, so it is no longer due.
+func (rs *retentionService) expire(ctx context.Context, c *dhauli.Conversation, rule settings.RetentionRule, dryRun bool) (*dhauli.RetentionAudit, error) {
+	audit := &dhauli.RetentionAudit{
+		ID:             primitive.NewObjectID().Hex(),
+		ConversationID: c.ID,
+		TenantID:       c.TenantID,
+		WorkflowID:     c.WorkflowID,
+		UserID:         c.UserID,
+		Rule:           rule.Name,
+		MaxAge:         rule.MaxAge.String(),
+		LastActivity:   c.UpdatedAt,
+		CreatedAt:      time.Now(),
+	}
+	byConversation := bson.M{"conversationId": c.ID}
+	if dryRun {
+		iids, err := rs.uow.Interactions().Distinct(ctx, "_id", byConversation)
+		if err != nil {
+			return nil, err
+		}
+		audit.Interactions = int64(len(iids))
+		if audit.InteractionHistory, err = rs.uow.InteractionHistory().Count(ctx, byConversation); err != nil {
+			return nil, err
+		}
+		if audit.ConversationHistory, err = rs.historyRepo.Count(ctx, byConversation); err != nil {
+			return nil, err
+		}
+		return audit, nil
+	}
+
+	expired := false
+	err := rs.uow.Execute(ctx, func(ctx context.Context) error {
+		expired = false
+		current, err := rs.uow.Conversations().GetByID(ctx, c.ID)
+		if err != nil {
+			return err
+		}
+		if current.LegalHold || current.Version != c.Version {
+			return nil
+		}
+		iids, err := rs.uow.Interactions().Distinct(ctx, "_id", byConversation)
+		if err != nil {
+			return err
+		}
+		if _, err = rs.chunkRepo.DeleteMany(ctx, bson.M{"interactionId": bson.M{"$in": iids}}); err != nil {
+			return err
+		}
+		if audit.Interactions, err = rs.uow.Interactions().DeleteMany(ctx, byConversation); err != nil {
+			return err
+		}
+		if audit.InteractionHistory, err = rs.uow.InteractionHistory().DeleteMany(ctx, byConversation); err != nil {
+			return err
+		}
+		if audit.ConversationHistory, err = rs.historyRepo.DeleteMany(ctx, byConversation); err != nil {
+			return err
+		}
+		if err = rs.uow.Conversations().Delete(ctx, c.ID); err != nil {
+			return err
+		}
+		// live subscribers and the outbox still get the deletion, the change log keeps nothing
+		if err = rs.changeSvc.Record(ctx, c.ID, "", contracts.ConversationChangeDeleted, "", nil); err != nil {
+			return err
+		}
+		if audit.Changes, err = rs.changeRepo.DeleteMany(ctx, byConversation); err != nil {
+			return err
+		}
+		if err = rs.changeRepo.DeleteSeq(ctx, c.ID); err != nil {
+			return err
+		}
+		if _, err = rs.auditRepo.Create(ctx, audit); err != nil {
+			return err
+		}
+		expired = true
+		return nil
+	})
+	if err != nil || !expired {
+		return nil, err
+	}
+	return audit, nil
+}
+
+func (rs *retentionService) ListAudit(ctx context.Context, query RetentionAuditQuery) ([]*dhauli.RetentionAudit, int64, error) {
+	filter := bson.M{}
+	if query.ConversationID != "" {
+		filter["conversationId"] = query.ConversationID
+	}
+	if query.TenantID != "" {
+		filter["tenantId"] = query.TenantID
+	}
+	if query.UserID != "" {
+		filter["userId"] = query.UserID
+	}
+	if query.Rule != "" {
+		filter["rule"] = query.Rule
+	}
+	audits, total, err := rs.auditRepo.Page(ctx, filter, query.Offset, query.Limit)
+	if err != nil {
+		rs.log.Errorf("Error listing retention audit records: %v", err)
+		return nil, 0, err
+	}
+	return audits, total, nil
+}
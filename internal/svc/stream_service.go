@@ -0,0 +1,455 @@
+package svc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mangudaigb/conversation-service/internal/apperr"
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	chunkFlushSize     = 32
+	chunkFlushInterval = 250 * time.Millisecond
+	streamPollInterval = 500 * time.Millisecond
+	streamRetention    = time.Minute
+	streamIdleTimeout  = 10 * time.Minute
+)
+
+// StreamService accumulates answers that arrive token by token. Chunks are kept in memory for
+// live subscribers and written to Mongo in batches; the final chunk turns the accumulated text
+// into a selected answer candidate of the interaction.
+// Producers number the chunks of an answer from 1. Redelivered chunks are ignored, and a chunk
+// that arrives ahead of one still missing is refused as Unavailable so it is retried later.
+// Chunks numbered 0 are taken in the order they arrive.
+// A stream is expected to be fed through a single instance; subscribers on other instances
+// follow it through the persisted chunks.
+type StreamService interface {
+	Append(ctx context.Context, iid string, seq int, delta, actor, model string, final bool) (*dhauli.AnswerChunk, *dhauli.Interaction, error)
+	Subscribe(ctx context.Context, iid string, afterSeq int) (<-chan dhauli.AnswerChunk, error)
+	Close()
+}
+
+type answerStream struct {
+	mu          sync.Mutex
+	flushMu     sync.Mutex
+	completeMu  sync.Mutex
+	iid         string
+	owner       dhauli.Ownership
+	answerId    string
+	actor       string
+	model       string
+	seq         int
+	chunks      []dhauli.AnswerChunk
+	pending     []*dhauli.AnswerChunk
+	final       bool
+	lastChunkAt time.Time
+	subscribers map[chan struct{}]struct{}
+	// answered is the interaction the answer was attached to once the final chunk is through.
+	// Until then the stream stays open, so a retried final chunk completes it.
+	answered *dhauli.Interaction
+}
+
+// takes reports whether the chunk numbered seq belongs to the stream: any chunk while the answer
+// is open, afterwards only a redelivered one. A new answer starts with chunk 1, so chunk 1 only
+// counts as redelivered when it repeats the first chunk.
+func (s *answerStream) takes(seq int, delta string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.answered == nil {
+		return true
+	}
+	if seq <= 0 || seq > s.seq {
+		return false
+	}
+	return seq > 1 || s.chunks[0].Delta == delta
+}
+
+func (s *answerStream) subscribe() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	notify := make(chan struct{}, 1)
+	s.subscribers[notify] = struct{}{}
+	return notify
+}
+
+func (s *answerStream) unsubscribe(notify chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, notify)
+}
+
+// notifyLocked wakes every subscriber without blocking the producer; subscribers read the
+// chunks themselves, so a missed wake-up never loses data.
+func (s *answerStream) notifyLocked() {
+	for notify := range s.subscribers {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *answerStream) chunksAfter(seq int) []dhauli.AnswerChunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq >= len(s.chunks) {
+		return nil
+	}
+	out := make([]dhauli.AnswerChunk, len(s.chunks)-seq)
+	copy(out, s.chunks[seq:])
+	return out
+}
+
+type streamService struct {
+	log     *logger.Logger
+	repo    repo.AnswerChunkRepository
+	iSvc    InteractionService
+	mu      sync.Mutex
+	streams map[string]*answerStream
+	done    chan struct{}
+}
+
+func NewStreamService(log *logger.Logger, repo repo.AnswerChunkRepository, iSvc InteractionService) StreamService {
+	ss := &streamService{
+		log:     log,
+		repo:    repo,
+		iSvc:    iSvc,
+		streams: make(map[string]*answerStream),
+		done:    make(chan struct{}),
+	}
+	go ss.flushLoop()
+	return ss
+}
+
+func (ss *streamService) Append(ctx context.Context, iid string, seq int, delta, actor, model string, final bool) (*dhauli.AnswerChunk, *dhauli.Interaction, error) {
+	stream, err := ss.open(ctx, iid, seq, delta, actor, model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream.mu.Lock()
+	if seq > 0 && seq <= stream.seq {
+		redelivered := stream.chunks[seq-1]
+		stream.mu.Unlock()
+		if !redelivered.Final {
+			return &redelivered, nil, nil
+		}
+		interaction, err := ss.complete(ctx, stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &redelivered, interaction, nil
+	}
+	if seq > stream.seq+1 {
+		next := stream.seq + 1
+		stream.mu.Unlock()
+		return nil, nil, apperr.New(apperr.Unavailable, "chunk %d of the answer to interaction %s arrived before chunk %d", seq, iid, next)
+	}
+	if stream.final {
+		last := stream.chunks[len(stream.chunks)-1]
+		stream.mu.Unlock()
+		if !final {
+			return nil, nil, apperr.NewConflict("answer stream of interaction %s already finalized", iid)
+		}
+		// the final chunk is retried because persisting the answer failed before
+		interaction, err := ss.complete(ctx, stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &last, interaction, nil
+	}
+	stream.seq++
+	chunk := dhauli.AnswerChunk{
+		ID:            primitive.NewObjectID().Hex(),
+		InteractionID: iid,
+		AnswerID:      stream.answerId,
+		Seq:           stream.seq,
+		Delta:         delta,
+		Final:         final,
+		CreatedAt:     time.Now(),
+		Ownership:     stream.owner,
+	}
+	stream.chunks = append(stream.chunks, chunk)
+	stream.pending = append(stream.pending, &chunk)
+	stream.final = final
+	stream.lastChunkAt = chunk.CreatedAt
+	flush := final || len(stream.pending) >= chunkFlushSize
+	stream.notifyLocked()
+	stream.mu.Unlock()
+
+	if !final {
+		if flush {
+			if err = ss.flush(ctx, stream); err != nil {
+				return nil, nil, err
+			}
+		}
+		return &chunk, nil, nil
+	}
+	interaction, err := ss.complete(ctx, stream)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &chunk, interaction, nil
+}
+
+// complete persists the chunks of a stream whose final chunk arrived and attaches the answer to
+// the interaction, once. A failure leaves the stream to be completed by a retry.
+func (ss *streamService) complete(ctx context.Context, stream *answerStream) (*dhauli.Interaction, error) {
+	stream.completeMu.Lock()
+	defer stream.completeMu.Unlock()
+	stream.mu.Lock()
+	answered := stream.answered
+	stream.mu.Unlock()
+	if answered != nil {
+		return answered, nil
+	}
+	if err := ss.flush(ctx, stream); err != nil {
+		return nil, err
+	}
+	interaction, err := ss.finalize(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+	stream.mu.Lock()
+	stream.answered = interaction
+	stream.mu.Unlock()
+	return interaction, nil
+}
+
+// Subscribe returns every chunk of the interaction's current answer with a sequence above
+// afterSeq, followed by new chunks as they arrive. The channel is closed after the final chunk
+// or when ctx is done.
+func (ss *streamService) Subscribe(ctx context.Context, iid string, afterSeq int) (<-chan dhauli.AnswerChunk, error) {
+	if _, err := ss.iSvc.GetInteractionById(ctx, iid); err != nil {
+		ss.log.Errorf("Error getting interaction %s to subscribe to its answer: %v", iid, err)
+		return nil, err
+	}
+	out := make(chan dhauli.AnswerChunk)
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(streamPollInterval)
+		defer ticker.Stop()
+
+		last := afterSeq
+		answerId := ""
+		var local *answerStream
+		var notify chan struct{}
+		defer func() {
+			if local != nil {
+				local.unsubscribe(notify)
+			}
+		}()
+
+		for {
+			if local == nil {
+				if stream := ss.lookup(iid); stream != nil && (answerId == "" || answerId == stream.answerId) {
+					local = stream
+					answerId = stream.answerId
+					notify = stream.subscribe()
+				}
+			}
+
+			var chunks []dhauli.AnswerChunk
+			if local != nil {
+				chunks = local.chunksAfter(last)
+			} else {
+				var err error
+				chunks, err = ss.persistedChunks(ctx, iid, &answerId, last)
+				if err != nil {
+					ss.log.Errorf("Error reading answer chunks of interaction %s: %v", iid, err)
+				}
+			}
+			for _, chunk := range chunks {
+				select {
+				case out <- chunk:
+				case <-ctx.Done():
+					return
+				}
+				last = chunk.Seq
+				if chunk.Final {
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-notify:
+			case <-ticker.C:
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (ss *streamService) persistedChunks(ctx context.Context, iid string, answerId *string, afterSeq int) ([]dhauli.AnswerChunk, error) {
+	if *answerId == "" {
+		latest, err := ss.repo.GetLatestAnswerId(ctx, iid)
+		if err != nil || latest == "" {
+			return nil, err
+		}
+		*answerId = latest
+	}
+	docs, err := ss.repo.GetByAnswerId(ctx, *answerId, afterSeq)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]dhauli.AnswerChunk, 0, len(docs))
+	for _, doc := range docs {
+		if doc.Seq != afterSeq+len(chunks)+1 {
+			break // a batch of the producer is not flushed yet
+		}
+		chunks = append(chunks, *doc)
+	}
+	return chunks, nil
+}
+
+func (ss *streamService) Close() {
+	close(ss.done)
+	ss.flushAll(context.Background())
+}
+
+func (ss *streamService) lookup(iid string) *answerStream {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.streams[iid]
+}
+
+// open returns the stream in progress for the interaction, starting a new answer when there is
+// none or the previous one was attached to the interaction.
+func (ss *streamService) open(ctx context.Context, iid string, seq int, delta, actor, model string) (*answerStream, error) {
+	ss.mu.Lock()
+	stream, ok := ss.streams[iid]
+	ss.mu.Unlock()
+	if ok {
+		if stream.takes(seq, delta) {
+			// the stream was opened for its tenant only
+			if owner, scoped := repo.OwnerFromContext(ctx); scoped && owner.TenantID != stream.owner.TenantID {
+				return nil, apperr.NewNotFound("interaction %s not found", iid)
+			}
+			return stream, nil
+		}
+	}
+
+	interaction, err := ss.iSvc.GetInteractionById(ctx, iid)
+	if err != nil {
+		ss.log.Errorf("Error getting interaction %s to stream an answer: %v", iid, err)
+		return nil, err
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if current, ok := ss.streams[iid]; ok && current != stream {
+		return current, nil // another producer opened it meanwhile
+	}
+	stream = &answerStream{
+		iid:         iid,
+		owner:       interaction.Ownership,
+		answerId:    primitive.NewObjectID().Hex(),
+		actor:       actor,
+		model:       model,
+		lastChunkAt: time.Now(),
+		subscribers: make(map[chan struct{}]struct{}),
+	}
+	ss.streams[iid] = stream
+	return stream, nil
+}
+
+// flush persists the pending chunks of stream. The chunks are written on behalf of the tenant the
+// stream was opened for, whoever flushes them, the background flush included.
+func (ss *streamService) flush(ctx context.Context, stream *answerStream) error {
+	ctx = repo.WithOwner(ctx, stream.owner)
+	stream.flushMu.Lock()
+	defer stream.flushMu.Unlock()
+
+	stream.mu.Lock()
+	batch := stream.pending
+	stream.pending = nil
+	stream.mu.Unlock()
+
+	if err := ss.repo.CreateMany(ctx, batch); err != nil {
+		ss.log.Errorf("Error persisting %d chunks of answer %s: %v", len(batch), stream.answerId, err)
+		stream.mu.Lock()
+		stream.pending = append(batch, stream.pending...)
+		stream.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (ss *streamService) finalize(ctx context.Context, stream *answerStream) (*dhauli.Interaction, error) {
+	// an earlier attempt may have stored the answer without learning it did
+	current, err := ss.iSvc.GetInteractionById(ctx, stream.iid)
+	if err != nil {
+		return nil, err
+	}
+	for _, answer := range current.Answers {
+		if answer.ID == stream.answerId {
+			return current, nil
+		}
+	}
+	var text strings.Builder
+	for _, chunk := range stream.chunksAfter(0) {
+		text.WriteString(chunk.Delta)
+	}
+	candidate := dhauli.AnswerCandidate{
+		ID:    stream.answerId,
+		Text:  text.String(),
+		Actor: stream.actor,
+		Model: stream.model,
+	}
+	interaction, err := ss.iSvc.AddAnswerToInteraction(ctx, stream.iid, candidate, true)
+	if err != nil {
+		ss.log.Errorf("Error storing streamed answer %s of interaction %s: %v", stream.answerId, stream.iid, err)
+		return nil, err
+	}
+	return interaction, nil
+}
+
+func (ss *streamService) flushLoop() {
+	ticker := time.NewTicker(chunkFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case <-ticker.C:
+			ss.flushAll(context.Background())
+		}
+	}
+}
+
+// flushAll persists pending chunks and forgets streams that finished or went idle, keeping
+// finished ones around for a while so late subscribers are served from memory.
+func (ss *streamService) flushAll(ctx context.Context) {
+	ss.mu.Lock()
+	streams := make([]*answerStream, 0, len(ss.streams))
+	for _, stream := range ss.streams {
+		streams = append(streams, stream)
+	}
+	ss.mu.Unlock()
+
+	now := time.Now()
+	for _, stream := range streams {
+		if err := ss.flush(ctx, stream); err != nil {
+			continue
+		}
+		stream.mu.Lock()
+		expired := (stream.answered != nil && now.Sub(stream.lastChunkAt) > streamRetention) ||
+			now.Sub(stream.lastChunkAt) > streamIdleTimeout
+		stream.mu.Unlock()
+		if expired {
+			ss.mu.Lock()
+			if ss.streams[stream.iid] == stream {
+				delete(ss.streams, stream.iid)
+			}
+			ss.mu.Unlock()
+		}
+	}
+}
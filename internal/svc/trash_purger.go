@@ -0,0 +1,54 @@
+package svc
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+// TrashPurger purges conversations that have been in the trash for longer than purgeAfter.
+type TrashPurger interface {
+	Run(ctx context.Context)
+}
+
+type trashPurger struct {
+	log        *logger.Logger
+	cSvc       ConversationService
+	purgeAfter time.Duration
+	interval   time.Duration
+}
+
+func NewTrashPurger(log *logger.Logger, cSvc ConversationService, purgeAfter, interval time.Duration) TrashPurger {
+	return &trashPurger{
+		log:        log,
+		cSvc:       cSvc,
+		purgeAfter: purgeAfter,
+		interval:   interval,
+	}
+}
+
+// Run purges every interval until ctx is done. Only one instance should run it at a time.
+func (tp *trashPurger) Run(ctx context.Context) {
+	tp.log.Infof("Trash purger started, purging after %v", tp.purgeAfter)
+	ticker := time.NewTicker(tp.interval)
+	defer ticker.Stop()
+	for {
+		purged, failed, err := tp.cSvc.PurgeTrash(ctx, time.Now().Add(-tp.purgeAfter))
+		if err != nil {
+			tp.log.Errorf("Error purging trash: %v", err)
+		}
+		if purged > 0 {
+			tp.log.Infof("Purged %d conversations from the trash", purged)
+		}
+		if len(failed) > 0 {
+			tp.log.Errorf("Failed to purge %d conversations from the trash, retrying next run: %v", len(failed), failed)
+		}
+		select {
+		case <-ctx.Done():
+			tp.log.Infof("Trash purger stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Package ws implements the server side of the WebSocket protocol (RFC 6455) on top of
+// net/http, covering what the live endpoints need: text messages, fragmentation, ping/pong
+// and the closing handshake. Extensions are not negotiated.
+package ws
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseTooLarge      = 1009
+	ClosePolicy        = 1008
+
+	maxMessageSize = 1 << 20
+	acceptGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	ErrNotWebSocket    = errors.New("request is not a websocket upgrade")
+	ErrOrigin          = errors.New("websocket origin not allowed")
+	ErrMessageTooLarge = errors.New("websocket message too large")
+	ErrProtocol        = errors.New("websocket protocol error")
+)
+
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// Upgrader completes opening handshakes. Browsers connect from any page they load, so only the
+// pages of the host itself and of Origins may connect; clients that are not browsers send no
+// origin and are let through.
+type Upgrader struct {
+	// Origins are the other origins allowed to connect, as in "https://app.example.com".
+	Origins []string
+	// Subprotocols are the subprotocols the server speaks, in order of preference. The first one
+	// the client offers is selected.
+	Subprotocols []string
+}
+
+// IsUpgrade reports whether r asks for a WebSocket.
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// Subprotocols returns the subprotocols the client offers, in its order.
+func Subprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				protocols = append(protocols, part)
+			}
+		}
+	}
+	return protocols
+}
+
+// Upgrade completes the opening handshake and takes over the underlying connection.
+func (u Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if !u.originAllowed(r) {
+		http.Error(w, ErrOrigin.Error(), http.StatusForbidden)
+		return nil, ErrOrigin
+	}
+	if r.Method != http.MethodGet || !IsUpgrade(r) || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+
+	netConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Deadlines set by the HTTP server for regular requests must not apply to the socket.
+	if err = netConn.SetDeadline(time.Time{}); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if protocol := u.selectSubprotocol(r); protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	response += "\r\n"
+	if _, err = rw.WriteString(response); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	if err = rw.Flush(); err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	return &Conn{conn: netConn, reader: rw.Reader}, nil
+}
+
+func (u Upgrader) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	return slices.ContainsFunc(u.Origins, func(allowed string) bool { return strings.EqualFold(allowed, origin) })
+}
+
+func (u Upgrader) selectSubprotocol(r *http.Request) string {
+	offered := Subprotocols(r)
+	for _, protocol := range u.Subprotocols {
+		if slices.Contains(offered, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next data message. Pings are answered and pongs skipped on the way;
+// a close frame from the peer is acknowledged and reported as io.EOF.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case PingMessage:
+			if err = c.WriteMessage(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			_ = c.WriteClose(CloseNormal, "")
+			return 0, nil, io.EOF
+		case continuationFrame:
+			if opcode == 0 {
+				return 0, nil, ErrProtocol
+			}
+		case TextMessage, BinaryMessage:
+			if opcode != 0 {
+				return 0, nil, ErrProtocol
+			}
+			opcode = op
+		default:
+			return 0, nil, ErrProtocol
+		}
+		if len(message)+len(payload) > maxMessageSize {
+			_ = c.WriteClose(CloseTooLarge, "")
+			return 0, nil, ErrMessageTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	if header[0]&0x70 != 0 || !masked {
+		return false, 0, nil, ErrProtocol
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= CloseMessage && (length > 125 || !fin) {
+		return false, 0, nil, ErrProtocol
+	}
+	if length > maxMessageSize {
+		_ = c.WriteClose(CloseTooLarge, "")
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends data as a single unfragmented frame. It is safe for concurrent use.
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	frame := make([]byte, 0, len(data)+10)
+	frame = append(frame, 0x80|byte(opcode))
+	switch {
+	case len(data) < 126:
+		frame = append(frame, byte(len(data)))
+	case len(data) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(data)))
+	}
+	frame = append(frame, data...)
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(frame)
+	if opcode == CloseMessage {
+		c.closed = true
+	}
+	return err
+}
+
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	return c.WriteMessage(CloseMessage, payload)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
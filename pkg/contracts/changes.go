@@ -0,0 +1,18 @@
+package contracts
+
+// Change types pushed to live subscribers of a conversation.
+const (
+	ConversationChangeCreated = "conversation.created"
+	ConversationChangeUpdated = "conversation.updated"
+	ConversationChangeDeleted = "conversation.deleted"
+	// Trashed and Restored move a conversation into the trash and back; Deleted is final.
+	ConversationChangeTrashed  = "conversation.trashed"
+	ConversationChangeRestored = "conversation.restored"
+
+	InteractionChangeCreated        = "interaction.created"
+	InteractionChangeQueryUpdated   = "interaction.query_updated"
+	InteractionChangeContextUpdated = "interaction.context_updated"
+	InteractionChangeAnswerUpdated  = "interaction.answer_updated"
+	InteractionChangeReverted       = "interaction.reverted"
+	InteractionChangeDeleted        = "interaction.deleted"
+)
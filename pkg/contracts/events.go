@@ -7,12 +7,15 @@ const (
 	UpdateConversation messaging.EventName = "UpdateConversation"
 	DeleteConversation messaging.EventName = "DeleteConversation"
 
-	ConversationCreated messaging.EventName = "ConversationCreated"
-	ConversationUpdated messaging.EventName = "ConversationUpdated"
-	ConversationDeleted messaging.EventName = "ConversationDeleted"
+	ConversationCreated  messaging.EventName = "ConversationCreated"
+	ConversationUpdated  messaging.EventName = "ConversationUpdated"
+	ConversationDeleted  messaging.EventName = "ConversationDeleted"
+	ConversationTrashed  messaging.EventName = "ConversationTrashed"
+	ConversationRestored messaging.EventName = "ConversationRestored"
 
 	CreateInteraction  messaging.EventName = "CreateInteraction"
 	UpdateInteraction  messaging.EventName = "UpdateInteraction"
 	InteractionCreated messaging.EventName = "InteractionCreated"
 	InteractionUpdated messaging.EventName = "InteractionUpdated"
+	InteractionDeleted messaging.EventName = "InteractionDeleted"
 )
@@ -5,4 +5,17 @@ import "github.com/mangudaigb/dhauli-base/consumer/messaging"
 const (
 	Conversation messaging.Type = "conversation"
 	Interaction  messaging.Type = "interaction"
+	Session      messaging.Type = "session"
+)
+
+const (
+	// Append streams a chunk of an answer into an interaction.
+	Append messaging.Action = "append"
+	// Revert restores an interaction from one of its history entries.
+	Revert messaging.Action = "revert"
+	// Undo and Redo step through the undo history of an interaction.
+	Undo messaging.Action = "undo"
+	Redo messaging.Action = "redo"
+	// Ended is announced by the session service when a session is over.
+	Ended messaging.Action = "ended"
 )
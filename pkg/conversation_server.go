@@ -6,12 +6,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/conversation-service/internal/auth"
+	"github.com/mangudaigb/conversation-service/internal/cluster"
 	"github.com/mangudaigb/conversation-service/internal/handler"
-	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/internal/settings"
 	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/conversation-service/pkg/dhauli"
 	"github.com/mangudaigb/dhauli-base/config"
 	"github.com/mangudaigb/dhauli-base/consumer"
 	"github.com/mangudaigb/dhauli-base/db"
@@ -26,38 +30,122 @@ type HttpServer struct {
 }
 
 type ConversationServer struct {
-	log *logger.Logger
-	cfg *config.Config
-	tr  trace.Tracer
+	log           *logger.Logger
+	cfg           *config.Config
+	tr            trace.Tracer
+	services      *Services
+	deadLetters   handler.DeadLetterReplayer
+	verifier      *auth.Verifier
+	auth          settings.Auth
+	clusterSecret string
 }
 
-func NewConversationServer(cfg *config.Config, tr trace.Tracer, log *logger.Logger) *ConversationServer {
+// NewConversationServer serves the REST API. Without a verifier it trusts the identity headers of
+// the gateway instead of requiring tokens, and serves the admin routes only to auth.AdminToken.
+// The internal routes are served only to peers presenting clusterSecret.
+func NewConversationServer(cfg *config.Config, tr trace.Tracer, log *logger.Logger, services *Services, deadLetters handler.DeadLetterReplayer, verifier *auth.Verifier, authSettings settings.Auth, clusterSecret string) *ConversationServer {
 	return &ConversationServer{
-		log: log,
-		cfg: cfg,
-		tr:  tr,
+		log:           log,
+		cfg:           cfg,
+		tr:            tr,
+		services:      services,
+		deadLetters:   deadLetters,
+		verifier:      verifier,
+		auth:          authSettings,
+		clusterSecret: clusterSecret,
 	}
 }
 
-func SetupRouter(log *logger.Logger, iSvc svc.InteractionService, cSvc svc.ConversationService) *gin.Engine {
+func SetupRouter(log *logger.Logger, iSvc svc.InteractionService, hSvc svc.InteractionHistoryService, chSvc svc.ConversationHistoryService, cSvc svc.ConversationService, sSvc svc.StreamService, changeSvc svc.ChangeService, oSvc svc.OutboxService, rSvc svc.RetentionService, pSvc svc.PrivacyService, deadLetters handler.DeadLetterReplayer, verifier *auth.Verifier, authSettings settings.Auth, clusterSecret string) *gin.Engine {
 	r := gin.Default()
-	interactionHandler := handler.NewInteractionHandler(log, iSvc)
+	r.Use(handler.CorrelationId())
+	interactionHandler := handler.NewInteractionHandler(log, iSvc, sSvc)
 	conversationHandler := handler.NewConversationHandler(log, cSvc, iSvc)
+	historyHandler := handler.NewHistoryHandler(log, iSvc, hSvc, chSvc)
+	liveHandler := handler.NewLiveHandler(log, cSvc, changeSvc, authSettings.Origins)
+	outboxHandler := handler.NewOutboxHandler(log, oSvc)
+	deadLetterHandler := handler.NewDeadLetterHandler(log, deadLetters)
+	retentionHandler := handler.NewRetentionHandler(log, rSvc)
+	privacyHandler := handler.NewPrivacyHandler(log, pSvc)
 
-	routes := r.Group("/conversations")
+	identity := handler.Identity()
+	var admin []gin.HandlerFunc
+	switch {
+	case verifier != nil:
+		identity = handler.Authenticate(log, verifier)
+		admin = append(admin, handler.AuthenticateAdmin(log, verifier), handler.RequireScope(authSettings.AdminScope))
+	case authSettings.AdminToken != "":
+		admin = append(admin, handler.RequireSecret(authSettings.AdminToken))
+	}
+
+	if clusterSecret != "" {
+		internalRoutes := r.Group("/internal", handler.RequireSecret(clusterSecret))
+		{
+			internalRoutes.POST(strings.TrimPrefix(cluster.ChangesPath, "/internal"), liveHandler.DeliverChanges)
+			internalRoutes.GET("/outbox", outboxHandler.GetStats)
+		}
+	} else {
+		log.Infof("Internal routes are disabled, set cluster.secret to serve them")
+	}
+	// the admin routes are never served without a credential of their own
+	if admin != nil {
+		adminRoutes := r.Group("/admin", admin...)
+		{
+			adminRoutes.POST("/dead-letters/replay", deadLetterHandler.Replay)
+			adminRoutes.POST("/retention/run", retentionHandler.Apply)
+			adminRoutes.GET("/retention/audit", retentionHandler.GetAudit)
+			adminRoutes.GET("/users/:uid/export", privacyHandler.Export)
+			adminRoutes.POST("/users/:uid/erase", privacyHandler.Erase)
+		}
+	} else {
+		log.Infof("Admin routes are disabled, set auth.enabled or auth.adminToken to serve them")
+	}
+
+	// every route of a conversation requires a role on it
+	view := handler.Authorize(cSvc, dhauli.RoleViewer)
+	edit := handler.Authorize(cSvc, dhauli.RoleEditor)
+	own := handler.Authorize(cSvc, dhauli.RoleOwner)
+	routes := r.Group("/conversations", identity)
 	{
 		routes.GET("", conversationHandler.GetConversationsForUser)
-		routes.GET("/:cid", conversationHandler.GetConversationById)
+		routes.GET("/live", liveHandler.Subscribe)
+		routes.GET("/trash", conversationHandler.GetTrash)
+		routes.POST("/trash/:cid/restore", own, conversationHandler.RestoreConversation)
+		routes.DELETE("/trash/:cid", own, conversationHandler.PurgeConversation)
+		routes.GET("/:cid", view, conversationHandler.GetConversationById)
 		routes.POST("/", conversationHandler.CreateConversation)
-		routes.PATCH("/:cid", conversationHandler.UpdateConversation)
-		routes.DELETE("/:cid", conversationHandler.DeleteConversation)
+		routes.PATCH("/:cid", edit, conversationHandler.UpdateConversation)
+		routes.DELETE("/:cid", own, conversationHandler.DeleteConversation)
+		routes.PUT("/:cid/hold", own, conversationHandler.HoldConversation)
+		routes.DELETE("/:cid/hold", own, conversationHandler.ReleaseConversation)
+		routes.PUT("/:cid/acl/:kind/:id", own, conversationHandler.ShareConversation)
+		routes.DELETE("/:cid/acl/:kind/:id", own, conversationHandler.UnshareConversation)
+		routes.GET("/:cid/history", view, historyHandler.GetConversationHistory)
+		routes.GET("/:cid/history/:hid", view, historyHandler.GetConversationHistoryEntry)
+		routes.GET("/:cid/branches", view, conversationHandler.GetBranches)
+		routes.GET("/:cid/branches/:iid", view, conversationHandler.GetBranchPath)
+		routes.POST("/:cid/branches/:iid/activate", edit, conversationHandler.SwitchBranch)
 
+		iView := handler.AuthorizeInteraction(cSvc, dhauli.RoleViewer)
+		iEdit := handler.AuthorizeInteraction(cSvc, dhauli.RoleEditor)
 		interactionRoutes := routes.Group("/:cid/interactions")
 		{
-			interactionRoutes.GET("", interactionHandler.GetInteractionsForConversation)
-			interactionRoutes.GET("/:iid", interactionHandler.GetInteractionById)
-			interactionRoutes.POST("/", interactionHandler.CreateInteraction)
-			interactionRoutes.PATCH("/:iid", interactionHandler.UpdateInteraction)
+			interactionRoutes.GET("", iView, interactionHandler.GetInteractionsForConversation)
+			interactionRoutes.GET("/:iid", iView, interactionHandler.GetInteractionById)
+			interactionRoutes.POST("/", iEdit, interactionHandler.CreateInteraction)
+			interactionRoutes.PATCH("/:iid", iEdit, interactionHandler.UpdateInteraction)
+			interactionRoutes.DELETE("/:iid", iEdit, interactionHandler.DeleteInteraction)
+			interactionRoutes.POST("/:iid/regenerate", iEdit, interactionHandler.RegenerateInteraction)
+			interactionRoutes.POST("/:iid/revert", iEdit, interactionHandler.RevertInteraction)
+			interactionRoutes.POST("/:iid/undo", iEdit, interactionHandler.UndoInteraction)
+			interactionRoutes.POST("/:iid/redo", iEdit, interactionHandler.RedoInteraction)
+			interactionRoutes.POST("/:iid/answers", iEdit, interactionHandler.AddAnswer)
+			interactionRoutes.POST("/:iid/answers/:aid/select", iEdit, interactionHandler.SelectAnswer)
+			interactionRoutes.POST("/:iid/stream", iEdit, interactionHandler.AppendAnswerChunk)
+			interactionRoutes.GET("/:iid/stream", iView, interactionHandler.StreamAnswer)
+			interactionRoutes.GET("/:iid/history", iView, historyHandler.GetHistory)
+			interactionRoutes.GET("/:iid/history/diff", iView, historyHandler.GetDiff)
+			interactionRoutes.GET("/:iid/history/:hid", iView, historyHandler.GetHistoryEntry)
 		}
 	}
 
@@ -65,18 +153,7 @@ func SetupRouter(log *logger.Logger, iSvc svc.InteractionService, cSvc svc.Conve
 }
 
 func (s *ConversationServer) Start() {
-	mongoClient, err := db.NewMongoClient(s.cfg, s.log)
-	if err != nil {
-		s.log.Fatalf("Error creating mongo client: %v", err)
-	}
-	var interactionHistoryRepo = repo.NewInteractionHistoryRepository(s.cfg, s.log, *mongoClient.Client, "interactions_history")
-	var interactionRepo = repo.NewMongoInteractionRepository(s.cfg, s.log, *mongoClient.Client, "interactions")
-	var conversationRepo = repo.NewConversationRepository(s.cfg, s.log, *mongoClient.Client, "conversations")
-	var conversationSvc = svc.NewConversationService(s.log, conversationRepo)
-	var interactionHistorySvc = svc.NewInteractionHistoryService(s.log, interactionHistoryRepo)
-	var interactionSvc = svc.NewInteractionService(s.log, interactionRepo, interactionHistorySvc, conversationSvc)
-
-	router := SetupRouter(s.log, interactionSvc, conversationSvc)
+	router := SetupRouter(s.log, s.services.Interaction, s.services.InteractionHistory, s.services.ConversationHistory, s.services.Conversation, s.services.Stream, s.services.Change, s.services.Outbox, s.services.Retention, s.services.Privacy, s.deadLetters, s.verifier, s.auth, s.clusterSecret)
 
 	serverAddr := fmt.Sprintf(":%d", s.cfg.Server.Port)
 
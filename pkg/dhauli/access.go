@@ -0,0 +1,70 @@
+package dhauli
+
+import (
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// Roles a user can hold on a conversation, each allowing everything the ones before it do.
+// Viewers read the conversation, editors also change it, and owners also delete and share it.
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// Grant gives one user, every member of a group or everyone in a tenant a role on a conversation.
+// Exactly one of User, Group and Tenant is set.
+type Grant struct {
+	Role      string               `json:"role" bson:"role"`
+	User      *entities.UserStub   `json:"user,omitempty" bson:"user,omitempty"`
+	Group     *entities.GroupStub  `json:"group,omitempty" bson:"group,omitempty"`
+	Tenant    *entities.TenantStub `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	GrantedBy string               `json:"grantedBy,omitempty" bson:"grantedBy,omitempty"`
+	GrantedAt time.Time            `json:"grantedAt" bson:"grantedAt"`
+}
+
+func ValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+// Allows reports whether holding role permits what required does.
+func Allows(role, required string) bool {
+	return ValidRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+// Grantee identifies whom the grant is for, as in "user:<id>", so grants to the same user, group
+// or tenant can be told apart from grants to others.
+func (g Grant) Grantee() string {
+	switch {
+	case g.User != nil:
+		return "user:" + g.User.ID
+	case g.Group != nil:
+		return "group:" + g.Group.ID
+	case g.Tenant != nil:
+		return "tenant:" + g.Tenant.ID
+	default:
+		return ""
+	}
+}
+
+// RoleOf returns the strongest role user uid, a member of group gid in tenant tid, holds on the
+// conversation, or "" when it holds none. The user the conversation belongs to is its owner.
+func (c *Conversation) RoleOf(uid, gid, tid string) string {
+	if uid != "" && c.UserID == uid {
+		return RoleOwner
+	}
+	role := ""
+	for _, g := range c.ACL {
+		matches := (g.User != nil && uid != "" && g.User.ID == uid) ||
+			(g.Group != nil && gid != "" && g.Group.ID == gid) ||
+			(g.Tenant != nil && tid != "" && g.Tenant.ID == tid)
+		if matches && roleRanks[g.Role] > roleRanks[role] {
+			role = g.Role
+		}
+	}
+	return role
+}
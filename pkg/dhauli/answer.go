@@ -0,0 +1,21 @@
+package dhauli
+
+func (in *Interaction) Candidate(id string) (AnswerCandidate, bool) {
+	for _, candidate := range in.Answers {
+		if candidate.ID == id {
+			return candidate, true
+		}
+	}
+	return AnswerCandidate{}, false
+}
+
+// SelectAnswer marks the candidate as the preferred answer and mirrors its text into Answer.
+func (in *Interaction) SelectAnswer(id string) bool {
+	candidate, ok := in.Candidate(id)
+	if !ok {
+		return false
+	}
+	in.SelectedAnswerID = candidate.ID
+	in.Answer = candidate.Text
+	return true
+}
@@ -0,0 +1,164 @@
+package dhauli
+
+// A conversation is a tree of interactions. Every stub points at the interaction it follows
+// through ParentID; stubs without a parent are roots. Editing or regenerating an interaction
+// adds a sibling next to it, and HeadID marks the leaf of the branch the user is looking at.
+
+// EnsureTree upgrades conversations stored before branching existed, whose stubs form an
+// implicit linear list without parent pointers.
+func (c *Conversation) EnsureTree() {
+	if c.HeadID != "" || len(c.Interactions) == 0 {
+		return
+	}
+	for i := 1; i < len(c.Interactions); i++ {
+		if c.Interactions[i].ParentID == "" {
+			c.Interactions[i].ParentID = c.Interactions[i-1].ID
+		}
+	}
+	c.HeadID = c.Interactions[len(c.Interactions)-1].ID
+}
+
+func (c *Conversation) Stub(id string) (InteractionStub, bool) {
+	for _, stub := range c.Interactions {
+		if stub.ID == id {
+			return stub, true
+		}
+	}
+	return InteractionStub{}, false
+}
+
+func (c *Conversation) Children(id string) []InteractionStub {
+	var children []InteractionStub
+	for _, stub := range c.Interactions {
+		if stub.ParentID == id {
+			children = append(children, stub)
+		}
+	}
+	return children
+}
+
+// PathTo returns the stubs from the root down to the interaction with the given id.
+func (c *Conversation) PathTo(id string) []InteractionStub {
+	var path []InteractionStub
+	seen := make(map[string]bool)
+	for id != "" && !seen[id] {
+		seen[id] = true
+		stub, ok := c.Stub(id)
+		if !ok {
+			break
+		}
+		path = append(path, stub)
+		id = stub.ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+func (c *Conversation) ActivePath() []InteractionStub {
+	return c.PathTo(c.HeadID)
+}
+
+// LatestLeaf follows the most recently added child from id until it reaches a leaf.
+func (c *Conversation) LatestLeaf(id string) string {
+	seen := make(map[string]bool)
+	for !seen[id] {
+		seen[id] = true
+		children := c.Children(id)
+		if len(children) == 0 {
+			break
+		}
+		id = children[len(children)-1].ID
+	}
+	return id
+}
+
+func (c *Conversation) Branches() []Branch {
+	parents := make(map[string]bool, len(c.Interactions))
+	for _, stub := range c.Interactions {
+		parents[stub.ParentID] = true
+	}
+	var branches []Branch
+	for _, stub := range c.Interactions {
+		if parents[stub.ID] {
+			continue
+		}
+		branches = append(branches, Branch{
+			LeafID: stub.ID,
+			Query:  stub.Query,
+			Depth:  len(c.PathTo(stub.ID)),
+			Active: stub.ID == c.HeadID,
+		})
+	}
+	return branches
+}
+
+// RemoveSubtree removes the interaction with the given id together with everything that follows
+// it and returns the ids removed. When the active branch was among them, the branch the parent
+// continues with most recently becomes active.
+func (c *Conversation) RemoveSubtree(id string) []string {
+	stub, ok := c.Stub(id)
+	if !ok {
+		return nil
+	}
+	removed := map[string]bool{id: true}
+	for changed := true; changed; {
+		changed = false
+		for _, s := range c.Interactions {
+			if !removed[s.ID] && removed[s.ParentID] {
+				removed[s.ID] = true
+				changed = true
+			}
+		}
+	}
+	ids := make([]string, 0, len(removed))
+	kept := c.Interactions[:0]
+	for _, s := range c.Interactions {
+		if removed[s.ID] {
+			ids = append(ids, s.ID)
+		} else {
+			kept = append(kept, s)
+		}
+	}
+	c.Interactions = kept
+	if removed[c.HeadID] {
+		c.activateAfterRemoving(stub)
+	}
+	return ids
+}
+
+// RemoveStub removes only the interaction with the given id. The interactions following it move
+// up to its parent, so the branches running through it stay intact.
+func (c *Conversation) RemoveStub(id string) bool {
+	stub, ok := c.Stub(id)
+	if !ok {
+		return false
+	}
+	kept := c.Interactions[:0]
+	for _, s := range c.Interactions {
+		if s.ID == id {
+			continue
+		}
+		if s.ParentID == id {
+			s.ParentID = stub.ParentID
+		}
+		kept = append(kept, s)
+	}
+	c.Interactions = kept
+	if c.HeadID == id {
+		c.activateAfterRemoving(stub)
+	}
+	return true
+}
+
+// activateAfterRemoving picks the active branch once the one ending in removed is gone: the one
+// its parent continues with most recently.
+func (c *Conversation) activateAfterRemoving(removed InteractionStub) {
+	c.HeadID = ""
+	if removed.ParentID != "" {
+		c.HeadID = c.LatestLeaf(removed.ParentID)
+	} else if len(c.Interactions) > 0 {
+		c.HeadID = c.LatestLeaf(c.Interactions[len(c.Interactions)-1].ID)
+	}
+}
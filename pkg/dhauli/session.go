@@ -1,24 +1,55 @@
 package dhauli
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
+// Memento is a saved state of an interaction. Index is the version the state was current at and
+// State the encoded state.
 type Memento struct {
 	Index int    `json:"index"`
 	State string `json:"state"`
 	Actor string `json:"actor"`
 }
 
+// Ownership names the organization, tenant and group a document belongs to. Documents are only
+// ever read and written on behalf of their own tenant.
+type Ownership struct {
+	OrganizationID string `json:"organizationId,omitempty" bson:"organizationId,omitempty"`
+	TenantID       string `json:"tenantId,omitempty" bson:"tenantId,omitempty"`
+	GroupID        string `json:"groupId,omitempty" bson:"groupId,omitempty"`
+}
+
 type Interaction struct {
-	ID             string    `json:"id" bson:"_id,omitempty"`
-	WorkflowID     string    `json:"workflowId" bson:"workflowId"`
-	SessionID      string    `json:"sessionId" bson:"sessionId"`
-	ConversationID string    `json:"conversationId" bson:"conversationId"`
-	Context        string    `json:"context" bson:"context"`
-	Query          string    `json:"query" bson:"query"`
-	Answer         string    `json:"answer" bson:"answer"`
-	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
-	UpdatedAt      time.Time `json:"updatedAt" bson:"updatedAt"`
-	Version        int       `json:"version" bson:"version"`
+	ID               string            `json:"id" bson:"_id,omitempty"`
+	WorkflowID       string            `json:"workflowId" bson:"workflowId"`
+	SessionID        string            `json:"sessionId" bson:"sessionId"`
+	ConversationID   string            `json:"conversationId" bson:"conversationId"`
+	ParentID         string            `json:"parentId,omitempty" bson:"parentId,omitempty"`
+	Context          string            `json:"context" bson:"context"`
+	Query            string            `json:"query" bson:"query"`
+	Answer           string            `json:"answer" bson:"answer"`
+	Answers          []AnswerCandidate `json:"answers,omitempty" bson:"answers,omitempty"`
+	SelectedAnswerID string            `json:"selectedAnswerId,omitempty" bson:"selectedAnswerId,omitempty"`
+	CreatedAt        time.Time         `json:"createdAt" bson:"createdAt"`
+	UpdatedAt        time.Time         `json:"updatedAt" bson:"updatedAt"`
+	Version          int               `json:"version" bson:"version"`
+	DeletedAt        *time.Time        `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// Undo and Redo are the per-interaction undo and redo stacks, most recent last.
+	Undo []Memento `json:"-" bson:"undo,omitempty"`
+	Redo []Memento `json:"-" bson:"redo,omitempty"`
+
+	Ownership `bson:",inline"`
+}
+
+type AnswerCandidate struct {
+	ID        string         `json:"id" bson:"_id"`
+	Text      string         `json:"text" bson:"text"`
+	Actor     string         `json:"actor,omitempty" bson:"actor,omitempty"`
+	Model     string         `json:"model,omitempty" bson:"model,omitempty"`
+	Metadata  map[string]any `json:"metadata,omitempty" bson:"metadata,omitempty"`
+	CreatedAt time.Time      `json:"createdAt" bson:"createdAt"`
 }
 
 type InteractionHistory struct {
@@ -29,11 +60,25 @@ type InteractionHistory struct {
 	InteractionID  string    `json:"interactionId" bson:"interactionId"`
 	Action         string    `json:"action" bson:"action"`
 	Actor          string    `json:"actor" bson:"actor"`
+	AnswerID       string    `json:"answerId,omitempty" bson:"answerId,omitempty"`
 	Context        string    `json:"context" bson:"context"`
 	Query          string    `json:"query" bson:"query"`
 	Answer         string    `json:"answer" bson:"answer"`
 	CreatedAt      time.Time `json:"createdAt" bson:"createdAt"`
 	Version        int       `json:"version" bson:"version"`
+
+	Ownership `bson:",inline"`
+}
+
+// InteractionDiff holds unified diffs of the fields of an interaction between two versions; a
+// field that did not change has no diff.
+type InteractionDiff struct {
+	InteractionID string `json:"interactionId"`
+	From          int    `json:"from"`
+	To            int    `json:"to"`
+	Context       string `json:"context,omitempty"`
+	Query         string `json:"query,omitempty"`
+	Answer        string `json:"answer,omitempty"`
 }
 
 type Conversation struct {
@@ -42,13 +87,198 @@ type Conversation struct {
 	SessionID    string            `json:"sessionId" bson:"sessionId"`
 	UserID       string            `json:"userId,omitempty" bson:"userId,omitempty"`
 	Interactions []InteractionStub `json:"interactions" bson:"interactions"`
+	HeadID       string            `json:"headId,omitempty" bson:"headId,omitempty"`
 	CreatedAt    time.Time         `json:"createdAt" bson:"createdAt"`
 	UpdatedAt    time.Time         `json:"updatedAt" bson:"updatedAt"`
-	Version      int               `json:"version" bson:"version"`
+	ClosedAt     *time.Time        `json:"closedAt,omitempty" bson:"closedAt,omitempty"`
+	// DeletedAt is set while the conversation is in the trash. It is stored even when empty so
+	// a restore clears it.
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt"`
+	DeletedBy string     `json:"deletedBy,omitempty" bson:"deletedBy"`
+	// LegalHold keeps the conversation from being purged, by retention or from the trash.
+	LegalHold bool `json:"legalHold,omitempty" bson:"legalHold"`
+	// ACL shares the conversation beyond its owner, the user it belongs to. Like DeletedAt it is
+	// stored even when empty, so revoking the last grant clears it.
+	ACL     []Grant `json:"acl,omitempty" bson:"acl"`
+	Version int     `json:"version" bson:"version"`
+	// Shared and Role tell a user listing their conversations which ones others shared with them,
+	// and what they may do with each. They are never stored.
+	Shared bool   `json:"shared,omitempty" bson:"-"`
+	Role   string `json:"role,omitempty" bson:"-"`
+
+	Ownership `bson:",inline"`
+}
+
+// ConversationHistory holds the conversation as it was before the action, at Version.
+type ConversationHistory struct {
+	ID             string       `json:"id" bson:"_id,omitempty"`
+	ConversationID string       `json:"conversationId" bson:"conversationId"`
+	Action         string       `json:"action" bson:"action"`
+	Actor          string       `json:"actor" bson:"actor"`
+	Conversation   Conversation `json:"conversation" bson:"conversation"`
+	CreatedAt      time.Time    `json:"createdAt" bson:"createdAt"`
+	Version        int          `json:"version" bson:"version"`
 }
 
 type InteractionStub struct {
-	ID     string `json:"id" bson:"_id,omitempty"`
-	Query  string `json:"query,omitempty" bson:"query"`
-	Answer string `json:"answer,omitempty" bson:"answer"`
+	ID       string `json:"id" bson:"_id,omitempty"`
+	ParentID string `json:"parentId,omitempty" bson:"parentId,omitempty"`
+	Query    string `json:"query,omitempty" bson:"query"`
+	Answer   string `json:"answer,omitempty" bson:"answer"`
+}
+
+type Branch struct {
+	LeafID string `json:"leafId"`
+	Query  string `json:"query,omitempty"`
+	Depth  int    `json:"depth"`
+	Active bool   `json:"active"`
+}
+
+type AnswerChunk struct {
+	ID            string    `json:"id" bson:"_id,omitempty"`
+	InteractionID string    `json:"interactionId" bson:"interactionId"`
+	AnswerID      string    `json:"answerId" bson:"answerId"`
+	Seq           int       `json:"seq" bson:"seq"`
+	Delta         string    `json:"delta" bson:"delta"`
+	Final         bool      `json:"final,omitempty" bson:"final,omitempty"`
+	CreatedAt     time.Time `json:"createdAt" bson:"createdAt"`
+
+	Ownership `bson:",inline"`
+}
+
+type ChangeEvent struct {
+	ID             string          `json:"id" bson:"_id,omitempty"`
+	ConversationID string          `json:"conversationId" bson:"conversationId"`
+	Seq            int64           `json:"seq" bson:"seq"`
+	Type           string          `json:"type" bson:"type"`
+	InteractionID  string          `json:"interactionId,omitempty" bson:"interactionId,omitempty"`
+	Actor          string          `json:"actor,omitempty" bson:"actor,omitempty"`
+	Data           json.RawMessage `json:"data,omitempty" bson:"data,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt" bson:"createdAt"`
+}
+
+type OutboxEntry struct {
+	ID          string     `json:"id" bson:"_id,omitempty"`
+	EventName   string     `json:"eventName" bson:"eventName"`
+	Key         string     `json:"key" bson:"key"`
+	Payload     []byte     `json:"payload" bson:"payload"`
+	CreatedAt   time.Time  `json:"createdAt" bson:"createdAt"`
+	Attempts    int        `json:"attempts" bson:"attempts"`
+	LastError   string     `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty" bson:"deliveredAt"`
+}
+
+type OutboxStats struct {
+	Pending         int64      `json:"pending"`
+	OldestPendingAt *time.Time `json:"oldestPendingAt,omitempty"`
+	LagSeconds      float64    `json:"lagSeconds"`
+	Relaying        bool       `json:"relaying"`
+	LastDeliveredAt *time.Time `json:"lastDeliveredAt,omitempty"`
+	LastError       string     `json:"lastError,omitempty"`
+}
+
+// OrphanReport lists what an orphan sweep found: interactions, conversation history and changes of
+// conversations that no longer exist, and history and answer chunks of interactions that no longer
+// exist.
+type OrphanReport struct {
+	ConversationIDs     []string `json:"conversationIds,omitempty"`
+	Interactions        int      `json:"interactions"`
+	ConversationHistory int64    `json:"conversationHistory"`
+	Changes             int64    `json:"changes"`
+	InteractionIDs      []string `json:"interactionIds,omitempty"`
+	HistoryEntries      int64    `json:"historyEntries"`
+	AnswerChunks        int64    `json:"answerChunks"`
+	Removed             bool     `json:"removed"`
+}
+
+// RetentionAudit records a conversation expired under a retention rule and how many of its
+// documents went with it.
+type RetentionAudit struct {
+	ID                  string    `json:"id" bson:"_id,omitempty"`
+	ConversationID      string    `json:"conversationId" bson:"conversationId"`
+	TenantID            string    `json:"tenantId,omitempty" bson:"tenantId,omitempty"`
+	WorkflowID          string    `json:"workflowId,omitempty" bson:"workflowId,omitempty"`
+	UserID              string    `json:"userId,omitempty" bson:"userId,omitempty"`
+	Rule                string    `json:"rule" bson:"rule"`
+	MaxAge              string    `json:"maxAge" bson:"maxAge"`
+	LastActivity        time.Time `json:"lastActivity" bson:"lastActivity"`
+	Interactions        int64     `json:"interactions" bson:"interactions"`
+	InteractionHistory  int64     `json:"interactionHistory" bson:"interactionHistory"`
+	ConversationHistory int64     `json:"conversationHistory" bson:"conversationHistory"`
+	Changes             int64     `json:"changes" bson:"changes"`
+	CreatedAt           time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// RetentionReport lists the conversations a retention run expired or, on a dry run, would have.
+type RetentionReport struct {
+	DryRun  bool              `json:"dryRun"`
+	Expired []*RetentionAudit `json:"expired"`
+	Held    int               `json:"held"`
+}
+
+// ExportManifest describes a user data export archive. It is written last, as manifest.json, and
+// lists every other file of the archive with its SHA-256.
+type ExportManifest struct {
+	UserID              string       `json:"userId"`
+	CreatedAt           time.Time    `json:"createdAt"`
+	Conversations       int          `json:"conversations"`
+	Interactions        int          `json:"interactions"`
+	InteractionHistory  int          `json:"interactionHistory"`
+	ConversationHistory int          `json:"conversationHistory"`
+	Files               []ExportFile `json:"files"`
+}
+
+type ExportFile struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ErasureReport confirms the erasure of the data of a user. Signature is the hex HMAC-SHA256 of
+// the report encoded as JSON without it.
+type ErasureReport struct {
+	ID                  string    `json:"id"`
+	UserID              string    `json:"userId"`
+	Mode                string    `json:"mode"`
+	Conversations       int64     `json:"conversations"`
+	Interactions        int64     `json:"interactions"`
+	InteractionHistory  int64     `json:"interactionHistory"`
+	ConversationHistory int64     `json:"conversationHistory"`
+	AnswerChunks        int64     `json:"answerChunks"`
+	Changes             int64     `json:"changes"`
+	Held                []string  `json:"held,omitempty"`
+	StartedAt           time.Time `json:"startedAt"`
+	CompletedAt         time.Time `json:"completedAt"`
+	Signature           string    `json:"signature,omitempty"`
+}
+
+// ProcessedMessageKey identifies a message by its idempotency key within the tenant and user that
+// sent it, so the same key sent by someone else is processed on its own.
+type ProcessedMessageKey struct {
+	TenantID string `json:"tenantId" bson:"tenantId"`
+	UserID   string `json:"userId" bson:"userId"`
+	Key      string `json:"key" bson:"key"`
+}
+
+type ProcessedMessage struct {
+	ID          ProcessedMessageKey `json:"id" bson:"_id"`
+	Status      string              `json:"status" bson:"status"`
+	Response    []byte              `json:"response,omitempty" bson:"response,omitempty"`
+	LockedUntil time.Time           `json:"lockedUntil" bson:"lockedUntil"`
+	CreatedAt   time.Time           `json:"createdAt" bson:"createdAt"`
+	ExpiresAt   time.Time           `json:"expiresAt" bson:"expiresAt"`
+}
+
+type DeadLetter struct {
+	ID             string    `json:"id"`
+	Topic          string    `json:"topic"`
+	Partition      int       `json:"partition"`
+	Offset         int64     `json:"offset"`
+	Key            string    `json:"key,omitempty"`
+	IdempotencyKey string    `json:"idempotencyKey,omitempty"`
+	Code           int       `json:"code"`
+	Error          string    `json:"error"`
+	RetryCount     int       `json:"retryCount"`
+	Payload        []byte    `json:"payload"`
+	FailedAt       time.Time `json:"failedAt"`
 }
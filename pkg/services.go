@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"github.com/mangudaigb/conversation-service/internal/repo"
+	"github.com/mangudaigb/conversation-service/internal/settings"
+	"github.com/mangudaigb/conversation-service/internal/svc"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/db"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+// Services is shared by the HTTP server and the Kafka consumer so both feed the same
+// in-memory state, such as answer streams.
+type Services struct {
+	Conversation        svc.ConversationService
+	Interaction         svc.InteractionService
+	InteractionHistory  svc.InteractionHistoryService
+	ConversationHistory svc.ConversationHistoryService
+	Stream              svc.StreamService
+	Change              svc.ChangeService
+	Outbox              svc.OutboxService
+	Idempotency         svc.IdempotencyService
+	Orphans             svc.OrphanSweeper
+	Trash               svc.TrashPurger
+	Retention           svc.RetentionService
+	Privacy             svc.PrivacyService
+}
+
+func NewServices(cfg *config.Config, sts *settings.Settings, log *logger.Logger, mongoClient *db.MongoClient, broadcaster svc.ChangeBroadcaster, publisher svc.EventPublisher) *Services {
+	var interactionHistoryRepo = repo.NewInteractionHistoryRepository(cfg, log, *mongoClient.Client, "interactions_history")
+	var conversationHistoryRepo = repo.NewConversationHistoryRepository(cfg, log, *mongoClient.Client, "conversations_history")
+	var interactionRepo = repo.NewMongoInteractionRepository(cfg, log, *mongoClient.Client, "interactions")
+	var conversationRepo = repo.NewConversationRepository(cfg, log, *mongoClient.Client, "conversations")
+	var chunkRepo = repo.NewAnswerChunkRepository(cfg, log, *mongoClient.Client, "answer_chunks")
+	var changeRepo = repo.NewChangeRepository(cfg, log, *mongoClient.Client, "conversation_changes")
+	var outboxRepo = repo.NewOutboxRepository(cfg, log, *mongoClient.Client, "outbox")
+	var retentionAuditRepo = repo.NewRetentionAuditRepository(cfg, log, *mongoClient.Client, "retention_audit")
+	var processedMessageRepo = repo.NewProcessedMessageRepository(cfg, log, *mongoClient.Client, "processed_messages")
+	var uow = repo.NewMongoUnitOfWork(log, mongoClient.Client, conversationRepo, interactionRepo, interactionHistoryRepo)
+	var outboxSvc = svc.NewOutboxService(log, outboxRepo, publisher)
+	var changeSvc = svc.NewChangeService(log, changeRepo, broadcaster, outboxSvc)
+	var conversationHistorySvc = svc.NewConversationHistoryService(log, conversationHistoryRepo)
+	var conversationSvc = svc.NewConversationService(log, uow, conversationHistorySvc, conversationHistoryRepo, chunkRepo, changeRepo, changeSvc)
+	var interactionHistorySvc = svc.NewInteractionHistoryService(log, interactionHistoryRepo)
+	var interactionSvc = svc.NewInteractionService(log, uow, interactionHistorySvc, conversationSvc, changeSvc)
+	var streamSvc = svc.NewStreamService(log, chunkRepo, interactionSvc)
+	var idempotencySvc = svc.NewIdempotencyService(log, processedMessageRepo, uow, sts.Idempotency.TTL)
+	var retentionSvc = svc.NewRetentionService(log, uow, conversationHistoryRepo, chunkRepo, changeRepo, retentionAuditRepo, changeSvc,
+		sts.Retention.Rules, sts.Retention.BatchSize, sts.Retention.Interval, sts.Retention.DryRun)
+
+	return &Services{
+		Conversation:        conversationSvc,
+		Interaction:         interactionSvc,
+		InteractionHistory:  interactionHistorySvc,
+		ConversationHistory: conversationHistorySvc,
+		Stream:              streamSvc,
+		Change:              changeSvc,
+		Outbox:              outboxSvc,
+		Idempotency:         idempotencySvc,
+		Orphans:             svc.NewOrphanSweeper(log, uow, conversationHistoryRepo, chunkRepo, changeRepo, sts.Sweeper.Interval, sts.Sweeper.Remove),
+		Trash:               svc.NewTrashPurger(log, conversationSvc, sts.Trash.PurgeAfter, sts.Trash.PurgeInterval),
+		Retention:           retentionSvc,
+		Privacy:             svc.NewPrivacyService(log, uow, conversationHistoryRepo, chunkRepo, changeRepo, retentionAuditRepo, changeSvc, sts.Privacy.SigningKey),
+	}
+}
+
+func (s *Services) Close() {
+	s.Stream.Close()
+}